@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// maxToolOutput bounds how much of each output stream is sent back to the
+// model after a command runs
+const maxToolOutput = 4 * 1024
+
+// runCommandTool lets the agent run one command and observe the outcome
+var runCommandTool = ToolSpec{
+	Name:        "run_command",
+	Description: "Run one command in the user's shell and observe its exit code, stdout and stderr",
+	Strict:      true,
+	Parameters:  stepSchema,
+}
+
+// finishTool lets the agent end the task
+var finishTool = ToolSpec{
+	Name:        "finish",
+	Description: "End the task, reporting what was done or why it could not be done",
+	Strict:      true,
+	Parameters: map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"reply": map[string]interface{}{
+				"type":        "string",
+				"description": "Short summary for the user of what was done, or why it could not be done",
+			},
+			"success": map[string]interface{}{
+				"type":        "boolean",
+				"description": "true if the request was carried out",
+			},
+		},
+		"required":             []string{"reply", "success"},
+		"additionalProperties": false,
+	},
+}
+
+// AgentFinish is the argument of the finish tool
+type AgentFinish struct {
+	Reply   string `json:"reply"`   // Summary of what was done
+	Success bool   `json:"success"` // Whether the request was carried out
+}
+
+// Validate accepts any finish; the schema covers it
+func (f *AgentFinish) Validate() error {
+	return nil
+}
+
+// commandOutcome is what the agent is told about a command it ran
+type commandOutcome struct {
+	Command  string `json:"command,omitempty"` // What ran instead, if the user edited the command
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	Error    string `json:"error,omitempty"`
+}
+
+const agentSystemPrompt = `You are ShellAI running as an agent in the user's shell. You carry out the user's request by running commands one at a time with the run_command tool. After each command you are told its exit code, stdout and stderr.
+
+1. Run one command per call. The arguments in "cmd" are passed to the executable exactly as given, with no shell quoting, globbing or expansion. Only if a command genuinely needs the shell (a pipeline, redirection, glob or variable), give shell source in "shell" instead and leave "cmd" empty.
+2. Rate each command's risk_score (0–10, based on potential data loss or system impact) and whether it reads or writes data.
+3. If a command fails, read its output, diagnose the problem and run a command that fixes it. Do not repeat a failing command unchanged.
+4. Commands run in a terminal and cannot be answered interactively, so prefer non-interactive flags.
+5. When the request is done, or cannot be done, call finish with a short summary for the user.`
+
+// AgentProcessor carries out a request by running commands and feeding
+// their outcome back to the model until it declares the task done
+type AgentProcessor struct {
+	provider       Provider       // Model backend, nil if none is configured
+	settings       *ModelSettings // Shared with the `model` builtin, which changes it at runtime
+	contextManager *ContextManager
+	assessor       *RiskAssessor
+	policy         *Policy
+	confirmer      *Confirmer
+	dryRun         *DryRun
+	sandbox        *Sandbox
+	config         *AgentConfig
+	session        *Session
+	audit          *AuditLog
+	mode           string // Mode the policy is applied for
+	yolo           bool   // Whether to execute commands without confirmation
+}
+
+func NewAgentProcessor(provider Provider, settings *ModelSettings, contextManager *ContextManager, assessor *RiskAssessor, policy *Policy, confirmer *Confirmer, dryRun *DryRun, sandbox *Sandbox, config *AgentConfig, session *Session, audit *AuditLog) *AgentProcessor {
+	return &AgentProcessor{
+		provider:       provider,
+		settings:       settings,
+		contextManager: contextManager,
+		assessor:       assessor,
+		policy:         policy,
+		confirmer:      confirmer,
+		dryRun:         dryRun,
+		sandbox:        sandbox,
+		config:         config,
+		session:        session,
+		audit:          audit,
+		mode:           "agent",
+		yolo:           false,
+	}
+}
+
+// NewAgentYoloProcessor creates an agent that executes commands without confirmation
+func NewAgentYoloProcessor(provider Provider, settings *ModelSettings, contextManager *ContextManager, assessor *RiskAssessor, policy *Policy, confirmer *Confirmer, dryRun *DryRun, sandbox *Sandbox, config *AgentConfig, session *Session, audit *AuditLog) *AgentProcessor {
+	return &AgentProcessor{
+		provider:       provider,
+		settings:       settings,
+		contextManager: contextManager,
+		assessor:       assessor,
+		policy:         policy,
+		confirmer:      confirmer,
+		dryRun:         dryRun,
+		sandbox:        sandbox,
+		config:         config,
+		session:        session,
+		audit:          audit,
+		mode:           "agent-yolo",
+		yolo:           true,
+	}
+}
+
+func (p *AgentProcessor) Process(ctx context.Context, command string, history []Turn, stdio *IO) (*Result, error) {
+	// Skip AI processing if there is no provider (e.g. no API key)
+	if p.provider == nil {
+		fmt.Fprintln(stdio.Stdout, "[Agent] API key not set. Please set OPENAI_API_KEY environment variable or configure a provider.")
+		return &Result{}, nil
+	}
+
+	prefix := "[Agent] "
+	if p.yolo {
+		prefix = "[Agent YOLO] "
+	}
+
+	model := p.settings.ModelFor(p.provider)
+	messages, usage := p.contextManager.Build(agentSystemPrompt, command, history, model, p.settings)
+	reportContext(stdio, usage)
+
+	// The result covers every command the agent ran
+	capture := newCaptureBuffer(maxCapturedOutput)
+	var commands []string
+	exitCode := 0
+	reply := ""
+	result := func() *Result {
+		return &Result{
+			Command:  strings.Join(commands, "\n"),
+			ExitCode: exitCode,
+			Output:   capture.String(),
+			Reply:    reply,
+		}
+	}
+
+	for iteration := 1; iteration <= p.config.MaxIterations; iteration++ {
+		var step AIResponse
+		var finish AgentFinish
+		var call ToolCall
+		var err error
+		messages = p.contextManager.Compact(messages, model, p.settings)
+		audit := p.audit.Request(p.mode, command, model, messages)
+		messages, call, err = requestToolCall(ctx, p.provider, p.settings, messages,
+			[]ToolSpec{runCommandTool, finishTool}, ToolChoiceAny,
+			func(call ToolCall) error {
+				if call.Name == finishTool.Name {
+					finish = AgentFinish{}
+					return decodeArguments(call.Arguments, &finish)
+				}
+				step = AIResponse{}
+				return decodeArguments(call.Arguments, &step)
+			})
+		if err != nil {
+			return result(), err
+		}
+
+		if call.Name == finishTool.Name {
+			reply = finish.Reply
+			fmt.Fprintf(stdio.Stdout, "%s%s\n", prefix, finish.Reply)
+			return result(), nil
+		}
+
+		cmd := step.Command()
+		shellCmdString := cmd.String()
+		reply = step.Reply
+
+		fmt.Fprintf(stdio.Stdout, "%s(%d/%d) %s\n", prefix, iteration, p.config.MaxIterations, step.Reply)
+		assessment := p.assessor.Assess(step, cmd, model)
+		printRisk(stdio.Stdout, assessment, cmd, "")
+
+		// Every step gets the same confirmation as a command in AI mode
+		decision := p.policy.Decide(p.mode, assessment, sessionDir(p.session))
+
+		// The agent cannot go on without running its command, so a dry run
+		// stops at the first one
+		if p.dryRun.On {
+			printDecision(stdio.Stdout, decision, assessment.Risk, "command", "")
+			fmt.Fprintf(stdio.Stdout, "Command: %s\n", shellCmdString)
+			next := &planStep{AIResponse: step, cmd: cmd, assessment: assessment, decision: decision}
+			p.dryRun.Suggest(&Suggestion{Request: command, Mode: p.mode, Reply: step.Reply, Steps: []*planStep{next}, Audit: audit}, stdio)
+			return result(), nil
+		}
+
+		confirmation := &Confirmation{Mode: p.mode, Cmd: cmd, Assessment: assessment, Decision: decision, Provider: p.provider, Settings: p.settings}
+		if !p.confirmer.Confirm(ctx, stdio, confirmation) {
+			audit.Confirmed(step, confirmation, nil)
+			return result(), nil
+		}
+		edited := confirmation.Cmd.String() != shellCmdString
+		cmd, shellCmdString = confirmation.Cmd, confirmation.Cmd.String()
+
+		if p.yolo {
+			fmt.Fprintf(stdio.Stdout, "Running: %s\n\n", shellCmdString)
+		} else {
+			fmt.Fprintf(stdio.Stdout, "Command: %s\n\n", shellCmdString)
+		}
+
+		// Execute the command, streaming its output
+		res, err := p.sandbox.Execute(ctx, p.mode, confirmation.Assessment, cmd, stdio)
+		reportExitStatus(stdio, res, err)
+		audit.Confirmed(step, confirmation, res)
+		fmt.Fprintln(stdio.Stdout)
+
+		commands = append(commands, shellCmdString)
+		capture.Write([]byte(res.Output))
+		exitCode = res.ExitCode
+
+		// Send the outcome back, and turn down any further calls in the reply
+		outcome := commandOutcome{
+			ExitCode: res.ExitCode,
+			Stdout:   truncateTail(res.Stdout, maxToolOutput),
+			Stderr:   truncateTail(res.Stderr, maxToolOutput),
+		}
+		if edited {
+			outcome.Command = shellCmdString
+		}
+		if err != nil {
+			outcome.Error = err.Error()
+		}
+		data, _ := json.Marshal(outcome)
+		for _, c := range messages[len(messages)-1].ToolCalls {
+			content := "Not run: run one command at a time."
+			if c.ID == call.ID {
+				content = string(data)
+			}
+			messages = append(messages, ChatMessage{Role: RoleTool, Content: content, ToolCallID: c.ID})
+		}
+
+		// An interrupted command or a lost session ends the task
+		if err != nil || ctx.Err() != nil {
+			return result(), nil
+		}
+	}
+
+	fmt.Fprintf(stdio.Stderr, "%sStopped after %d commands without finishing (see agent.max_iterations).\n", prefix, p.config.MaxIterations)
+	return result(), nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestAgent returns an agent whose commands run in a new directory, with
+// the model's replies scripted
+func newTestAgent(t *testing.T, maxIterations int, responses ...*ChatResponse) (*AgentProcessor, *scriptedProvider, string) {
+	t.Helper()
+	d, dir := newTestDryRun(t)
+	d.On = false
+	provider := &scriptedProvider{responses: responses}
+	contextManager := NewContextManager(&ContextConfig{MaxTokens: 100000, Providers: map[string]bool{}}, d.session)
+	p := NewAgentProcessor(provider, &ModelSettings{}, contextManager, d.assessor, d.policy,
+		NewConfirmer(d.assessor, d.policy, d.session), d, d.sandbox, &AgentConfig{MaxIterations: maxIterations}, d.session,
+		NewAuditLog(&AuditConfig{Disabled: true}, nil))
+	return p, provider, dir
+}
+
+// callTool returns a reply that calls tool with arguments
+func callTool(id string, tool ToolSpec, arguments string) ToolCall {
+	return ToolCall{ID: id, Name: tool.Name, Arguments: arguments}
+}
+
+// toolResults returns the tool messages of a request, by call ID
+func toolResults(req ChatRequest) map[string]string {
+	results := map[string]string{}
+	for _, msg := range req.Messages {
+		if msg.Role == RoleTool {
+			results[msg.ToolCallID] = msg.Content
+		}
+	}
+	return results
+}
+
+func TestAgentRetriesAfterFailure(t *testing.T) {
+	p, provider, dir := newTestAgent(t, 5,
+		&ChatResponse{ToolCalls: []ToolCall{callTool("1", runCommandTool, `{"reply":"Look","cmd":["cat","missing"],"shell":"","risk_score":0,"does_read":true,"does_write":false}`)}},
+		&ChatResponse{ToolCalls: []ToolCall{callTool("2", runCommandTool, `{"reply":"Create","cmd":["touch","missing"],"shell":"","risk_score":1,"does_read":false,"does_write":true}`)}},
+		&ChatResponse{ToolCalls: []ToolCall{callTool("3", finishTool, `{"reply":"Created it","success":true}`)}},
+	)
+	var out syncBuffer
+	stdio := &IO{Input: bufio.NewReader(strings.NewReader("y\ny\n")), Stdout: &out, Stderr: &out}
+	result, err := p.Process(context.Background(), "make sure missing exists", nil, stdio)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Command != "cat missing\ntouch missing" || result.ExitCode != 0 || result.Reply != "Created it" {
+		t.Errorf("result %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing")); err != nil {
+		t.Error(err)
+	}
+
+	// The model is told how each command went before it chooses the next
+	var outcome commandOutcome
+	if err := json.Unmarshal([]byte(toolResults(provider.requests[1])["1"]), &outcome); err != nil {
+		t.Fatal(err)
+	}
+	if outcome.ExitCode == 0 || !strings.Contains(outcome.Stderr, "missing") {
+		t.Errorf("outcome of the failed command: %+v", outcome)
+	}
+	if results := toolResults(provider.requests[2]); results["2"] == "" || len(results) != 2 {
+		t.Errorf("tool results of the last request: %v", results)
+	}
+}
+
+func TestAgentRunsOneCommandAtATime(t *testing.T) {
+	p, provider, dir := newTestAgent(t, 5,
+		&ChatResponse{ToolCalls: []ToolCall{
+			callTool("1", runCommandTool, `{"reply":"a","cmd":["touch","a"],"shell":"","risk_score":1,"does_read":false,"does_write":true}`),
+			callTool("2", runCommandTool, `{"reply":"b","cmd":["touch","b"],"shell":"","risk_score":1,"does_read":false,"does_write":true}`),
+		}},
+		&ChatResponse{ToolCalls: []ToolCall{callTool("3", finishTool, `{"reply":"Done","success":true}`)}},
+	)
+	stdio := &IO{Input: bufio.NewReader(strings.NewReader("y\ny\n")), Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}
+	if _, err := p.Process(context.Background(), "make a and b", nil, stdio); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b")); err == nil {
+		t.Error("the second call ran")
+	}
+	if results := toolResults(provider.requests[1]); results["2"] != "Not run: run one command at a time." || !strings.Contains(results["1"], `"exit_code":0`) {
+		t.Errorf("tool results: %v", results)
+	}
+}
+
+func TestAgentStopsAfterMaxIterations(t *testing.T) {
+	run := &ChatResponse{ToolCalls: []ToolCall{callTool("1", runCommandTool, `{"reply":"Again","cmd":["true"],"shell":"","risk_score":0,"does_read":false,"does_write":false}`)}}
+	p, provider, _ := newTestAgent(t, 2, run, run)
+	var out syncBuffer
+	stdio := &IO{Input: bufio.NewReader(strings.NewReader("y\ny\n")), Stdout: &out, Stderr: &out}
+	result, err := p.Process(context.Background(), "loop", nil, stdio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(provider.requests) != 2 || result.Command != "true\ntrue" || !strings.Contains(out.String(), "Stopped after 2 commands") {
+		t.Errorf("%d requests, result %+v, output:\n%s", len(provider.requests), result, out.String())
+	}
+}
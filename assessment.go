@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultDisagreementThreshold is how far apart the model's and the local
+// risk score must be before the disagreement is reported
+const defaultDisagreementThreshold = 3
+
+// Assessment is the final risk of a generated command. The model's rating
+// cannot lower the risk found locally, so a model that under-reports risk
+// does not get past confirmation.
+type Assessment struct {
+	Risk      int      // The higher of the model's and the local risk
+	Reads     bool     // Whether the model or the analysis says it reads data
+	Writes    bool     // Whether the model or the analysis says it writes data
+	Network   bool     // Whether the analysis says it uses the network
+	HasModel  bool     // Whether the model rated the command
+	ModelRisk int      // The model's risk score, if HasModel
+	Local     Analysis // The local analysis
+	Disagree  bool     // Whether the model's and the local risk are far apart
+}
+
+// disagreementRecord is one line of the disagreement log
+type disagreementRecord struct {
+	Time        time.Time `json:"time"`
+	Model       string    `json:"model"`
+	Kind        string    `json:"kind"`
+	Command     string    `json:"command"`
+	ModelRisk   int       `json:"model_risk"`
+	ModelReads  bool      `json:"model_reads"`
+	ModelWrites bool      `json:"model_writes"`
+	LocalRisk   int       `json:"local_risk"`
+	LocalReads  bool      `json:"local_reads"`
+	LocalWrites bool      `json:"local_writes"`
+	Reasons     []string  `json:"reasons"`
+}
+
+// RiskAssessor combines the model's rating of generated commands with the
+// local analysis, and logs where the two disagree so the rules can be tuned
+type RiskAssessor struct {
+	config   *RiskConfig
+	redactor *Redactor // Masks secrets in logged commands, as in what is sent to models
+
+	mu sync.Mutex // Serialises writes to the log
+}
+
+func NewRiskAssessor(config *RiskConfig, redactor *Redactor) *RiskAssessor {
+	return &RiskAssessor{config: config, redactor: redactor}
+}
+
+// Assess rates a command proposed by model in step
+func (r *RiskAssessor) Assess(step AIResponse, cmd Command, model string) Assessment {
+	local := AnalyzeCommand(cmd)
+	a := Assessment{
+		Risk:      max(step.RiskScore, local.Risk),
+		Reads:     step.DoesRead || local.Reads,
+		Writes:    step.DoesWrite || local.Writes,
+		Network:   local.Network,
+		HasModel:  true,
+		ModelRisk: step.RiskScore,
+		Local:     local,
+	}
+	a.Disagree = abs(step.RiskScore-local.Risk) >= r.config.DisagreementThreshold
+	if a.Disagree {
+		r.logDisagreement(a, cmd, step, model)
+	}
+	return a
+}
+
+// AssessLocal rates a command nobody else has rated, such as one from the
+// knowledge base or typed by the user
+func (r *RiskAssessor) AssessLocal(cmd Command) Assessment {
+	local := AnalyzeCommand(cmd)
+	return Assessment{
+		Risk:    local.Risk,
+		Reads:   local.Reads,
+		Writes:  local.Writes,
+		Network: local.Network,
+		Local:   local,
+	}
+}
+
+// logDisagreement appends a disagreement to the log. Failing to log is
+// reported but does not stop the command.
+func (r *RiskAssessor) logDisagreement(a Assessment, cmd Command, step AIResponse, model string) {
+	if r.config.DisagreementLog == "" {
+		return
+	}
+	command, reasons := cmd.String(), a.Local.Reasons
+	if r.redactor != nil {
+		texts := r.redactor.RedactStrings(append([]string{command}, reasons...))
+		command, reasons = texts[0], texts[1:]
+	}
+	data, _ := json.Marshal(disagreementRecord{
+		Time:        time.Now().UTC(),
+		Model:       model,
+		Kind:        cmd.Kind.String(),
+		Command:     command,
+		ModelRisk:   step.RiskScore,
+		ModelReads:  step.DoesRead,
+		ModelWrites: step.DoesWrite,
+		LocalRisk:   a.Local.Risk,
+		LocalReads:  a.Local.Reads,
+		LocalWrites: a.Local.Writes,
+		Reasons:     reasons,
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := appendLine(r.config.DisagreementLog, data); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to log risk disagreement: %v\n", err)
+	}
+}
+
+// appendLine appends data and a newline to the file at path, creating it
+// and its directory if needed. The file is made readable only by the user,
+// even if it already existed.
+func appendLine(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := file.Chmod(0o600); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// stateDir returns the directory vibesh keeps logs and other state in,
+// $XDG_STATE_HOME/vibesh or ~/.local/state/vibesh
+func stateDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "vibesh"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "state", "vibesh"), nil
+}
+
+// printRisk shows the assessment of a command, with the reasons found
+// locally and a warning if the model and the analysis disagree
+func printRisk(w io.Writer, a Assessment, cmd Command, indent string) {
+	fmt.Fprintf(w, "%s%s\n", indent, riskTags(a, cmd))
+	for _, reason := range a.Local.Reasons {
+		fmt.Fprintf(w, "%s  - %s\n", indent, reason)
+	}
+	if !a.Disagree {
+		return
+	}
+	if a.Local.Risk > a.ModelRisk {
+		fmt.Fprintf(w, "%s\033[1;33mWARNING: The AI rated this command %d/10, but local analysis rates it %d/10.\033[0m\n",
+			indent, a.ModelRisk, a.Local.Risk)
+	} else {
+		fmt.Fprintf(w, "%s\033[1;33mNOTE: The AI rated this command %d/10, higher than local analysis (%d/10); it may know something the rules do not.\033[0m\n",
+			indent, a.ModelRisk, a.Local.Risk)
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
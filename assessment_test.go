@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAssess(t *testing.T) {
+	assessor := NewRiskAssessor(&RiskConfig{DisagreementThreshold: defaultDisagreementThreshold}, nil)
+
+	tests := []struct {
+		src       string
+		modelRisk int
+		risk      int // Lowest risk expected
+		disagree  bool
+	}{
+		{"ls", 0, 0, false},
+		{"ls", 5, 5, true},
+		{"rm -rf /", 1, 10, true},
+		{"rm -rf /", 10, 10, false},
+	}
+	for _, tt := range tests {
+		cmd := NewShellCommand(tt.src)
+		a := assessor.Assess(AIResponse{Shell: tt.src, RiskScore: tt.modelRisk}, cmd, "test")
+		if a.Risk < tt.risk || a.Risk < tt.modelRisk || a.Disagree != tt.disagree || a.ModelRisk != tt.modelRisk {
+			t.Errorf("%q rated %d by the model: %+v", tt.src, tt.modelRisk, a)
+		}
+	}
+}
+
+func TestDisagreementLog(t *testing.T) {
+	session, err := NewSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	redactor, err := NewRedactor(&PrivacyConfig{}, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "state", "disagreements.jsonl")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// A log left readable by others is tightened
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	assessor := NewRiskAssessor(&RiskConfig{DisagreementThreshold: 3, DisagreementLog: path}, redactor)
+
+	for _, src := range []string{"mysql --password hunter2 -e 'drop database app'", `curl -H "Authorization: Bearer abc123" -X DELETE https://api/x`} {
+		assessor.Assess(AIResponse{Shell: src, RiskScore: 10}, NewShellCommand(src), "test")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("log permissions %v, want 0600", perm)
+	}
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d records, want 2:\n%s", len(lines), data)
+	}
+	want := []string{"mysql --password [REDACTED] -e 'drop database app'", `curl -H "Authorization: Bearer [REDACTED]" -X DELETE https://api/x`}
+	for i, line := range lines {
+		var record disagreementRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Command != want[i] {
+			t.Errorf("logged %q, want %q", record.Command, want[i])
+		}
+	}
+}
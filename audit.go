@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// defaultAuditShown is how many records the `audit` builtin shows by default
+const defaultAuditShown = 20
+
+// How a command was decided on, as recorded in the audit log
+const (
+	AuditAllowed   = "allowed"   // Ran without asking, as the policy or YOLO mode allows
+	AuditConfirmed = "confirmed" // The user said yes to it
+	AuditAlways    = "always"    // The user said yes to it and to commands like it
+	AuditApproved  = "approved"  // Ran as part of a plan, or a dry run, the user approved
+	AuditDeclined  = "declined"  // The user said no to it
+	AuditDenied    = "denied"    // The policy did not let it run
+	AuditSkipped   = "skipped"   // The user skipped it in a plan, or the plan stopped first
+	AuditDryRun    = "dry_run"   // Shown in a dry run, not run
+)
+
+// AuditRecord is one line of the audit log: a command generated or typed,
+// how it was decided on and, if it ran, how it went
+type AuditRecord struct {
+	Time        time.Time `json:"time"`
+	Mode        string    `json:"mode"`
+	Input       string    `json:"input"`                 // What the user typed
+	Model       string    `json:"model,omitempty"`       // Model that generated the command
+	PromptHash  string    `json:"prompt_hash,omitempty"` // SHA-256 of the messages the model was sent
+	Argv        []string  `json:"argv,omitempty"`        // Command as generated, if it was an argv command
+	Shell       string    `json:"shell,omitempty"`       // Command as generated, if it was shell source
+	Command     string    `json:"command"`               // Command as decided on, after any edit
+	Edited      bool      `json:"edited,omitempty"`      // Whether the user changed the generated command
+	LocalRisk   int       `json:"local_risk"`
+	ModelRisk   *int      `json:"model_risk,omitempty"`
+	Policy      string    `json:"policy,omitempty"`    // What the policy said, e.g. "confirm by rule 2"
+	Decision    string    `json:"decision"`            // How it was decided on, e.g. "confirmed"
+	ExitCode    *int      `json:"exit_code,omitempty"` // Set if the command ran
+	DurationMS  int64     `json:"duration_ms,omitempty"`
+	OutputBytes int64     `json:"output_bytes,omitempty"`
+	Limit       string    `json:"limit,omitempty"` // Limit that stopped the command, if any
+	Hash        string    `json:"hash,omitempty"`  // Chains the record to the one before; always the last field
+}
+
+// AuditLog appends a record of every command vibesh generates or runs to a
+// JSON Lines file. With chaining on, each record ends with a hash over the
+// record and the hash of the one before, so changing or removing a record
+// shows when the log is verified.
+type AuditLog struct {
+	config   *AuditConfig
+	redactor *Redactor // Masks secrets in what is recorded, as in what is sent to models
+
+	mu   sync.Mutex
+	size int64  // Size of the file after the last record written
+	last string // Hash of that record
+}
+
+func NewAuditLog(config *AuditConfig, redactor *Redactor) *AuditLog {
+	return &AuditLog{config: config, redactor: redactor}
+}
+
+// AuditRequest is a request whose commands are being audited: what the user
+// asked for in which mode, and what the model was sent
+type AuditRequest struct {
+	log        *AuditLog
+	mode       string
+	input      string
+	model      string
+	promptHash string
+}
+
+// Request starts auditing a request for input in mode. model and messages
+// are what generated its commands, empty if no model did. The messages are
+// hashed as the model is sent them, redacted.
+func (l *AuditLog) Request(mode, input, model string, messages []ChatMessage) *AuditRequest {
+	r := &AuditRequest{log: l, mode: mode, input: input, model: model}
+	if messages != nil && !l.config.Disabled {
+		if l.redactor != nil {
+			messages = l.redactor.Redact(messages)
+		}
+		data, _ := json.Marshal(messages)
+		sum := sha256.Sum256(data)
+		r.promptHash = hex.EncodeToString(sum[:])
+	}
+	return r
+}
+
+// Confirmed records a command generated as generated and decided on by c,
+// with its result if it ran
+func (r *AuditRequest) Confirmed(generated AIResponse, c *Confirmation, result *Result) {
+	r.record(generated, c.Cmd, c.Assessment, c.Decision, c.Answer, result)
+}
+
+// Step records a step of a plan, decided on as decision, with its result if
+// it ran
+func (r *AuditRequest) Step(step *planStep, decision string, result *Result) {
+	r.record(step.AIResponse, step.cmd, step.assessment, step.decision, decision, result)
+}
+
+func (r *AuditRequest) record(generated AIResponse, cmd Command, a Assessment, policy PolicyDecision, decision string, result *Result) {
+	if r == nil || r.log.config.Disabled {
+		return
+	}
+	original := generated.Command()
+	record := AuditRecord{
+		Time:      time.Now().UTC(),
+		Mode:      r.mode,
+		Input:     r.input,
+		Model:     r.model,
+		Command:   cmd.String(),
+		Edited:    cmd.String() != original.String(),
+		LocalRisk: a.Local.Risk,
+		Decision:  decision,
+	}
+	if r.model != "" {
+		record.PromptHash = r.promptHash
+		record.ModelRisk = &generated.RiskScore
+	}
+	if original.Kind == ArgvCommand {
+		record.Argv = original.Argv
+	} else {
+		record.Shell = original.Shell
+	}
+	if policy.Action != "" {
+		record.Policy = string(policy.Action)
+		if policy.By != "" {
+			record.Policy += " by " + policy.By
+		}
+	}
+	if r.log.redactor != nil {
+		// Secrets typed or generated are masked on disk too
+		texts := append([]string{record.Input, record.Command, record.Shell}, record.Argv...)
+		texts = r.log.redactor.RedactStrings(texts)
+		record.Input, record.Command, record.Shell = texts[0], texts[1], texts[2]
+		if record.Argv != nil {
+			record.Argv = texts[3:]
+		}
+	}
+	if result != nil {
+		record.ExitCode = &result.ExitCode
+		record.DurationMS = result.Duration.Milliseconds()
+		record.OutputBytes = result.OutputSize
+		record.Limit = result.Limit
+	}
+	if err := r.log.write(record); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write the audit log: %v\n", err)
+	}
+}
+
+// write appends record to the log, chaining it to the last record if the
+// config asks for it. The file is locked, so several vibesh sessions can
+// share one log.
+func (l *AuditLog) write(record AuditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	path := l.config.File
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+
+	record.Hash = ""
+	line, _ := json.Marshal(record)
+	if l.config.Chain {
+		// Another session may have written since this one last did
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() != l.size {
+			if l.last, err = lastAuditHash(file); err != nil {
+				return err
+			}
+		}
+		hash := auditHash(l.last, line)
+		line = fmt.Appendf(line[:len(line)-1], `,"hash":%q}`, hash)
+		l.last = hash
+	}
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	l.size = info.Size()
+	return nil
+}
+
+// auditHash chains a record, as written without its hash, to the hash of the
+// record before it
+func auditHash(previous string, record []byte) string {
+	h := sha256.New()
+	io.WriteString(h, previous+"\n")
+	h.Write(record)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// auditHashField matches the hash that ends a chained record
+var auditHashField = regexp.MustCompile(`,"hash":"([0-9a-f]{64})"}$`)
+
+// splitAuditHash separates a line of the log into the record as it was
+// hashed and its hash, which is empty if the record is not chained
+func splitAuditHash(line []byte) ([]byte, string) {
+	m := auditHashField.FindSubmatchIndex(line)
+	if m == nil {
+		return line, ""
+	}
+	record := append(bytes.Clone(line[:m[0]]), '}')
+	return record, string(line[m[2]:m[3]])
+}
+
+// lastAuditHash returns the hash of the last record in file
+func lastAuditHash(file *os.File) (string, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	last := ""
+	err := scanAuditLines(file, func(n int, line []byte) error {
+		_, last = splitAuditHash(line)
+		return nil
+	})
+	return last, err
+}
+
+// scanAuditLines calls fn with each non-empty line of r, numbered from 1
+func scanAuditLines(r io.Reader, fn func(n int, line []byte) error) error {
+	reader := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if line = bytes.TrimSuffix(line, []byte("\n")); len(line) > 0 {
+			if fnErr := fn(n, line); fnErr != nil {
+				return fnErr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Records returns the records of the log, oldest first
+func (l *AuditLog) Records() ([]AuditRecord, error) {
+	file, err := os.Open(l.config.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []AuditRecord
+	err = scanAuditLines(file, func(n int, line []byte) error {
+		var record AuditRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+		records = append(records, record)
+		return nil
+	})
+	return records, err
+}
+
+// Verify checks the hash chain of the log. It returns how many records
+// there are and how many of them are chained, or an error naming the first
+// line where the chain does not hold.
+func (l *AuditLog) Verify() (int, int, error) {
+	file, err := os.Open(l.config.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	total, chained := 0, 0
+	previous := ""
+	err = scanAuditLines(file, func(n int, line []byte) error {
+		total++
+		record, hash := splitAuditHash(line)
+		switch {
+		case hash == "" && previous != "":
+			return fmt.Errorf("line %d has no hash, but the record before it is chained", n)
+		case hash == "":
+			return nil
+		case auditHash(previous, record) != hash:
+			return fmt.Errorf("line %d does not match its hash: it, or a record before it, was changed or removed", n)
+		}
+		chained++
+		previous = hash
+		return nil
+	})
+	return total, chained, err
+}
+
+// auditFilter selects records for the `audit` builtin
+type auditFilter struct {
+	count    int           // How many of the newest matching records to show
+	mode     string        // Mode they were decided in
+	decision string        // How they were decided on
+	since    time.Duration // How long ago at most
+	failed   bool          // Only commands that ran and failed
+	words    []string      // Words the input or command must contain
+}
+
+// parseAuditFilter reads the arguments of the `audit` builtin
+func parseAuditFilter(args []string) (auditFilter, error) {
+	filter := auditFilter{count: defaultAuditShown}
+	for _, arg := range args {
+		key, value, found := strings.Cut(arg, "=")
+		switch {
+		case isNumber(arg):
+			filter.count, _ = strconv.Atoi(arg)
+		case arg == "failed":
+			filter.failed = true
+		case found && key == "mode":
+			filter.mode = value
+		case found && key == "decision":
+			filter.decision = value
+		case found && key == "since":
+			since, err := time.ParseDuration(value)
+			if err != nil {
+				return filter, fmt.Errorf("since must be a duration such as 2h")
+			}
+			filter.since = since
+		default:
+			filter.words = append(filter.words, strings.ToLower(arg))
+		}
+	}
+	return filter, nil
+}
+
+// matches reports whether record is selected by f
+func (f auditFilter) matches(record AuditRecord) bool {
+	if f.mode != "" && record.Mode != f.mode ||
+		f.decision != "" && record.Decision != f.decision ||
+		f.since > 0 && time.Since(record.Time) > f.since ||
+		f.failed && (record.ExitCode == nil || *record.ExitCode == 0) {
+		return false
+	}
+	text := strings.ToLower(record.Input + "\n" + record.Command)
+	for _, word := range f.words {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// showAudit is the `audit` builtin: it lists the newest records that match
+// args, or with `verify` checks the hash chain
+func showAudit(log *AuditLog, args []string, stdio *IO) {
+	if len(args) == 1 && args[0] == "verify" {
+		total, chained, err := log.Verify()
+		switch {
+		case err != nil:
+			fmt.Fprintf(stdio.Stdout, "\033[1;31mThe audit log failed verification: %v\033[0m\n", err)
+		case chained == 0:
+			fmt.Fprintf(stdio.Stdout, "None of the %d record(s) are chained (see audit.chain).\n", total)
+		default:
+			fmt.Fprintf(stdio.Stdout, "The chain of %d record(s) is intact; %d older record(s) are not chained.\n", chained, total-chained)
+		}
+		return
+	}
+
+	filter, err := parseAuditFilter(args)
+	if err != nil {
+		fmt.Fprintln(stdio.Stdout, err)
+		return
+	}
+	records, err := log.Records()
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "Failed to read the audit log: %v\n", err)
+		return
+	}
+	var shown []AuditRecord
+	for i := len(records) - 1; i >= 0 && len(shown) < filter.count; i-- {
+		if filter.matches(records[i]) {
+			shown = append(shown, records[i])
+		}
+	}
+	if len(shown) == 0 {
+		fmt.Fprintln(stdio.Stdout, "No audit records.")
+		return
+	}
+	for i := len(shown) - 1; i >= 0; i-- {
+		printAuditRecord(stdio.Stdout, shown[i])
+	}
+}
+
+// printAuditRecord shows one record of the audit log
+func printAuditRecord(w io.Writer, record AuditRecord) {
+	outcome := "not run"
+	if record.ExitCode != nil {
+		outcome = fmt.Sprintf("exit %d in %s, %s of output", *record.ExitCode,
+			time.Duration(record.DurationMS)*time.Millisecond, formatSize(record.OutputBytes))
+		if record.Limit != "" {
+			outcome += ", stopped by " + record.Limit
+		}
+	}
+	risk := fmt.Sprintf("risk %d", record.LocalRisk)
+	if record.ModelRisk != nil {
+		risk += fmt.Sprintf(", AI %d", *record.ModelRisk)
+	}
+
+	fmt.Fprintf(w, "%s  %-10s %-9s %s\n", record.Time.Local().Format(time.DateTime), record.Mode, record.Decision, outcome)
+	if record.Input != record.Command {
+		fmt.Fprintf(w, "    > %s\n", record.Input)
+	}
+	edited := ""
+	if record.Edited {
+		edited = "edited, "
+	}
+	fmt.Fprintf(w, "    $ %s  (%s%s)\n", strings.ReplaceAll(record.Command, "\n", "; "), edited, risk)
+}
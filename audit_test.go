@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAuditLog(t *testing.T, chain bool) *AuditLog {
+	t.Helper()
+	return NewAuditLog(&AuditConfig{File: filepath.Join(t.TempDir(), "audit.jsonl"), Chain: chain}, nil)
+}
+
+// auditCommand records a command typed in direct mode, as run with status
+func auditCommand(log *AuditLog, command string, status int) {
+	confirmation := &Confirmation{Mode: "direct", Cmd: NewShellCommand(command), Answer: AuditAllowed}
+	log.Request("direct", command, "", nil).Confirmed(AIResponse{Shell: command}, confirmation, &Result{ExitCode: status})
+}
+
+func TestAuditChain(t *testing.T) {
+	log := newTestAuditLog(t, true)
+	auditCommand(log, "echo one", 0)
+	auditCommand(log, "false", 1)
+
+	// Another session appending to the same file continues the chain
+	other := NewAuditLog(log.config, nil)
+	auditCommand(other, "echo three", 0)
+	auditCommand(log, "echo four", 0)
+
+	total, chained, err := log.Verify()
+	if err != nil || total != 4 || chained != 4 {
+		t.Fatalf("Verify() = %d, %d, %v; want 4, 4, nil", total, chained, err)
+	}
+
+	records, err := log.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || records[1].Command != "false" || *records[1].ExitCode != 1 || records[1].Hash == "" {
+		t.Errorf("records: %+v", records)
+	}
+}
+
+func TestAuditChainTampering(t *testing.T) {
+	tests := map[string]func(lines []string) []string{
+		"changed": func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], "rm -rf build", "ls", 1)
+			return lines
+		},
+		"removed": func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		},
+		"reordered": func(lines []string) []string {
+			lines[0], lines[1] = lines[1], lines[0]
+			return lines
+		},
+		"unchained": func(lines []string) []string {
+			record, _ := splitAuditHash([]byte(lines[2]))
+			lines[2] = string(record)
+			return lines
+		},
+	}
+	for name, tamper := range tests {
+		t.Run(name, func(t *testing.T) {
+			log := newTestAuditLog(t, true)
+			for _, command := range []string{"echo one", "rm -rf build", "echo three"} {
+				auditCommand(log, command, 0)
+			}
+			data, err := os.ReadFile(log.config.File)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := tamper(strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"))
+			if err := os.WriteFile(log.config.File, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := log.Verify(); err == nil {
+				t.Error("Verify() passed a tampered log")
+			}
+		})
+	}
+}
+
+func TestAuditUnchained(t *testing.T) {
+	log := newTestAuditLog(t, false)
+	auditCommand(log, "echo one", 0)
+	total, chained, err := log.Verify()
+	if err != nil || total != 1 || chained != 0 {
+		t.Errorf("Verify() = %d, %d, %v; want 1, 0, nil", total, chained, err)
+	}
+}
+
+func TestAuditDisabled(t *testing.T) {
+	log := newTestAuditLog(t, true)
+	log.config.Disabled = true
+	auditCommand(log, "echo one", 0)
+	if _, err := os.Stat(log.config.File); !os.IsNotExist(err) {
+		t.Errorf("disabled log was written: %v", err)
+	}
+}
+
+func TestAuditPromptHash(t *testing.T) {
+	log := newTestAuditLog(t, false)
+	messages := []ChatMessage{{Role: "user", Content: "list files"}}
+	data, _ := json.Marshal(messages)
+	sum := sha256.Sum256(data)
+
+	request := log.Request("ai", "list files", "gpt", messages)
+	request.Confirmed(AIResponse{Cmd: []string{"ls"}, RiskScore: 1}, &Confirmation{Cmd: NewArgvCommand("ls", "-la"), Answer: AuditConfirmed}, nil)
+	records, err := log.Records()
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Records() = %v, %v", records, err)
+	}
+	record := records[0]
+	if record.PromptHash != hex.EncodeToString(sum[:]) {
+		t.Errorf("prompt hash %s", record.PromptHash)
+	}
+	if !record.Edited || len(record.Argv) != 1 || record.Command != "ls -la" || record.ModelRisk == nil || *record.ModelRisk != 1 {
+		t.Errorf("record: %+v", record)
+	}
+	if record.ExitCode != nil {
+		t.Errorf("exit code recorded for a command that did not run")
+	}
+}
+
+func TestAuditRedaction(t *testing.T) {
+	session, err := NewSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	redactor, err := NewRedactor(&PrivacyConfig{}, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := NewAuditLog(&AuditConfig{File: filepath.Join(t.TempDir(), "audit.jsonl")}, redactor)
+
+	secret := "sk-" + strings.Repeat("a", 30)
+	messages := []ChatMessage{{Role: "user", Content: "use key " + secret}}
+	command := "curl -H 'Authorization: Bearer " + secret + "' example.com"
+	log.Request("ai", "use key "+secret, "gpt", messages).Confirmed(AIResponse{Shell: command}, &Confirmation{Cmd: NewShellCommand(command), Answer: AuditAllowed}, nil)
+
+	data, err := os.ReadFile(log.config.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), secret) {
+		t.Errorf("secret written to the log: %s", data)
+	}
+
+	// The prompt is hashed as sent to the model, redacted
+	records, _ := log.Records()
+	sent, _ := json.Marshal(redactor.Redact(messages))
+	sum := sha256.Sum256(sent)
+	if records[0].PromptHash != hex.EncodeToString(sum[:]) {
+		t.Errorf("prompt hash is not of the redacted messages")
+	}
+}
+
+func TestAuditFilter(t *testing.T) {
+	now := time.Now()
+	one, zero := 1, 0
+	records := []AuditRecord{
+		{Time: now.Add(-3 * time.Hour), Mode: "ai", Input: "clean up", Command: "rm -rf build", Decision: AuditConfirmed, ExitCode: &zero},
+		{Time: now.Add(-time.Hour), Mode: "agent-yolo", Input: "run tests", Command: "go test ./...", Decision: AuditAllowed, ExitCode: &one},
+		{Time: now, Mode: "direct", Input: "ls", Command: "ls", Decision: AuditDeclined},
+	}
+	tests := []struct {
+		args []string
+		want []int
+	}{
+		{nil, []int{0, 1, 2}},
+		{[]string{"failed"}, []int{1}},
+		{[]string{"mode=ai"}, []int{0}},
+		{[]string{"decision=declined"}, []int{2}},
+		{[]string{"since=2h"}, []int{1, 2}},
+		{[]string{"RM"}, []int{0}},
+		{[]string{"test", "mode=agent-yolo"}, []int{1}},
+	}
+	for _, tt := range tests {
+		filter, err := parseAuditFilter(tt.args)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.args, err)
+		}
+		var got []int
+		for i, record := range records {
+			if filter.matches(record) {
+				got = append(got, i)
+			}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%q: matched %v, want %v", tt.args, got, tt.want)
+		}
+	}
+	if _, err := parseAuditFilter([]string{"since=yesterday"}); err == nil {
+		t.Error("since=yesterday accepted")
+	}
+	if filter, _ := parseAuditFilter([]string{"5"}); filter.count != 5 {
+		t.Errorf("count %d, want 5", filter.count)
+	}
+}
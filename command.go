@@ -0,0 +1,80 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// CommandKind says how a generated command is to be interpreted
+type CommandKind int
+
+const (
+	// ArgvCommand is an executable and its arguments, run exactly as given
+	// with no word splitting, globbing or expansion
+	ArgvCommand CommandKind = iota
+	// ShellCommand is shell source, for pipelines, redirections and the like
+	ShellCommand
+)
+
+func (k CommandKind) String() string {
+	if k == ShellCommand {
+		return "shell"
+	}
+	return "argv"
+}
+
+// Command is a command to run in the session
+type Command struct {
+	Kind  CommandKind
+	Argv  []string // Executable and arguments, for ArgvCommand
+	Shell string   // Shell source, for ShellCommand
+}
+
+// NewArgvCommand returns a command that runs argv without shell interpretation
+func NewArgvCommand(argv ...string) Command {
+	return Command{Kind: ArgvCommand, Argv: argv}
+}
+
+// NewShellCommand returns a command that runs source through the shell
+func NewShellCommand(source string) Command {
+	return Command{Kind: ShellCommand, Shell: source}
+}
+
+// String returns the command as the user would type it, quoting arguments
+// only where needed so argument boundaries stay visible
+func (c Command) String() string {
+	if c.Kind == ShellCommand {
+		return c.Shell
+	}
+	words := make([]string, len(c.Argv))
+	for i, arg := range c.Argv {
+		words[i] = quoteArg(arg)
+	}
+	return strings.Join(words, " ")
+}
+
+// Source returns the shell source the session runs. Every argument of an
+// argv command is quoted, so the shell passes them to the program exactly as
+// exec would, and `command` skips shell functions that could shadow it. It
+// still runs in the session, so `cd` or `export` persist as usual.
+func (c Command) Source() string {
+	if c.Kind == ShellCommand {
+		return c.Shell
+	}
+	words := make([]string, len(c.Argv))
+	for i, arg := range c.Argv {
+		words[i] = shellQuote(arg)
+	}
+	return "command -- " + strings.Join(words, " ")
+}
+
+// safeArg matches arguments the shell would leave unchanged without quotes
+var safeArg = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// quoteArg quotes s for the shell unless it needs no quoting
+func quoteArg(s string) string {
+	if safeArg.MatchString(s) {
+		return s
+	}
+	return shellQuote(s)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestCommandString(t *testing.T) {
+	tests := []struct {
+		command Command
+		want    string
+	}{
+		{NewArgvCommand("ls", "-la", "/tmp"), "ls -la /tmp"},
+		{NewArgvCommand("grep", "-r", "TODO list", "."), "grep -r 'TODO list' ."},
+		{NewArgvCommand("echo", "it's"), `echo 'it'\''s'`},
+		{NewArgvCommand("rm", "*.log"), "rm '*.log'"},
+		{NewArgvCommand("echo", "$HOME", ""), "echo '$HOME' ''"},
+		{NewArgvCommand("git", "commit", "--author=A <a@b.c>"), "git commit '--author=A <a@b.c>'"},
+		{NewShellCommand("ls *.go | wc -l"), "ls *.go | wc -l"},
+	}
+	for _, tt := range tests {
+		if got := tt.command.String(); got != tt.want {
+			t.Errorf("%q: String() = %s, want %s", tt.command.Argv, got, tt.want)
+		}
+	}
+}
+
+func TestCommandSource(t *testing.T) {
+	if got := NewShellCommand("cd /tmp && ls").Source(); got != "cd /tmp && ls" {
+		t.Errorf("shell command Source() = %s", got)
+	}
+	if got, want := NewArgvCommand("ls", "-la").Source(), "command -- 'ls' '-la'"; got != want {
+		t.Errorf("Source() = %s, want %s", got, want)
+	}
+
+	// The shell passes every argument on exactly as given
+	args := []string{"plain", "two words", "it's", "*", "$HOME", "`id`", "", "a\nb", `back\slash`}
+	command := NewArgvCommand(append([]string{"printf", `%s|`}, args...)...)
+	out, err := exec.Command("sh", "-c", command.Source()).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(out), strings.Join(args, "|")+"|"; got != want {
+		t.Errorf("arguments seen by the program: %q, want %q", got, want)
+	}
+}
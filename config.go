@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the user's vibesh configuration. It is read from
+// $VIBESH_CONFIG, or config.yaml in the user's config directory
+// (e.g. ~/.config/vibesh/config.yaml). Every field is optional.
+type Config struct {
+	// Providers maps a name of the user's choosing to a model backend
+	Providers map[string]ProviderConfig `yaml:"providers"`
+	// DefaultProvider is used by modes that have no entry in Modes
+	DefaultProvider string `yaml:"default_provider"`
+	// Modes maps a mode (e.g. "ai" or "rag-yolo") to a provider name
+	Modes map[string]string `yaml:"modes"`
+	// Model holds sampling settings that apply to every provider, and the
+	// model of the default provider
+	Model ModelSettings `yaml:"model"`
+	// Agent controls the agent modes
+	Agent AgentConfig `yaml:"agent"`
+	// Context controls how much context is sent with each request
+	Context ContextConfig `yaml:"context"`
+	// Privacy controls what is masked before anything is sent to a model
+	Privacy PrivacyConfig `yaml:"privacy"`
+	// Risk controls how generated commands are rated
+	Risk RiskConfig `yaml:"risk"`
+	// PolicyFile is the policy of allowed and denied commands, by default
+	// policy.yaml next to this file
+	PolicyFile string `yaml:"policy_file"`
+	// Guard controls where generated commands may write
+	Guard GuardConfig `yaml:"guard"`
+	// Sandbox chooses which commands run isolated from the system
+	Sandbox SandboxConfig `yaml:"sandbox"`
+	// Snapshots controls the snapshots taken for `undo`
+	Snapshots SnapshotConfig `yaml:"snapshots"`
+	// Limits bounds the time, memory and output of commands
+	Limits LimitsConfig `yaml:"limits"`
+	// Audit controls the log of generated and executed commands
+	Audit AuditConfig `yaml:"audit"`
+}
+
+// AuditConfig controls the audit log, which records every command vibesh
+// generates or runs and what became of it
+type AuditConfig struct {
+	Disabled bool   `yaml:"disabled"` // Whether to keep no audit log
+	File     string `yaml:"file"`     // JSON Lines file records are appended to
+	Chain    bool   `yaml:"chain"`    // Whether to chain records by hash, so tampering shows in `audit verify`
+}
+
+// LimitsConfig bounds the resources of every command, with overrides for
+// the commands of a mode and for command lines that run a given program
+type LimitsConfig struct {
+	// LimitSettings are the limits of every command
+	LimitSettings `yaml:",inline"`
+
+	Modes    map[string]LimitSettings `yaml:"modes"`    // Overrides for commands run in a mode, e.g. "agent-yolo"
+	Commands map[string]LimitSettings `yaml:"commands"` // Overrides for command lines that run a program, e.g. "make"
+}
+
+// SnapshotConfig controls the snapshots of files taken before generated
+// commands that write, which the `undo` builtin restores
+type SnapshotConfig struct {
+	Disabled  bool   `yaml:"disabled"`    // Whether to take no snapshots
+	Dir       string `yaml:"dir"`         // Where snapshots are kept, by default in the state directory
+	Keep      int    `yaml:"keep"`        // Snapshots kept; older ones are removed
+	MaxFiles  int    `yaml:"max_files"`   // Most files one snapshot may hold
+	MaxSizeMB int    `yaml:"max_size_mb"` // Largest total size, in MiB, of the files one snapshot holds
+}
+
+// SandboxConfig chooses which commands run in the sandbox, where the system
+// is read-only and writes to the workspace go to an overlay
+type SandboxConfig struct {
+	Modes   []string `yaml:"modes"`    // Modes whose commands always run in the sandbox, e.g. ["agent-yolo"]
+	MinRisk int      `yaml:"min_risk"` // Risk at which commands run in the sandbox in any mode; 0 for never
+	Network bool     `yaml:"network"`  // Whether sandboxed commands may use the network
+	// Preview chooses which commands are tried in the sandbox first
+	Preview PreviewConfig `yaml:"preview"`
+}
+
+// PreviewConfig chooses which commands that write are first run in the
+// sandbox, so their changes can be reviewed before they are applied
+type PreviewConfig struct {
+	MinRisk int      `yaml:"min_risk"` // Risk at which commands that write are previewed; 0 for never
+	Modes   []string `yaml:"modes"`    // Modes commands are previewed in, by default the non-YOLO ones
+}
+
+// defaultPreviewModes are the modes commands are previewed in by default
+var defaultPreviewModes = []string{"ai", "rag", "agent"}
+
+// GuardConfig controls the path guard, which escalates commands writing
+// outside the workspace or into protected paths
+type GuardConfig struct {
+	Workspace          string       `yaml:"workspace"`            // Directory commands may write in, by default the git repository or directory vibesh starts in
+	Writable           []string     `yaml:"writable"`             // Paths outside the workspace that may be written too
+	Protected          []string     `yaml:"protected"`            // Paths that need leave to be written, even in the workspace
+	OnOutsideWorkspace PolicyAction `yaml:"on_outside_workspace"` // confirm (default), deny or allow
+	OnProtected        PolicyAction `yaml:"on_protected"`         // confirm (default), deny or allow
+	Direct             bool         `yaml:"direct"`               // Whether commands typed in direct mode are guarded too
+}
+
+// RiskConfig controls how the model's risk rating is checked against the
+// local analysis
+type RiskConfig struct {
+	DisagreementThreshold int    `yaml:"disagreement_threshold"` // Difference in score at which the two are said to disagree
+	DisagreementLog       string `yaml:"disagreement_log"`       // JSON Lines file disagreements are appended to
+}
+
+// PrivacyConfig adds to the secrets vibesh masks in model requests
+type PrivacyConfig struct {
+	Redact []string `yaml:"redact"` // Regular expressions whose matches are masked
+	Ignore []string `yaml:"ignore"` // Paths never to name, as globs like in .vibeshignore
+}
+
+// ContextConfig controls the context sent with each model request
+type ContextConfig struct {
+	MaxTokens int             `yaml:"max_tokens"` // Token budget for a request, capped by the model's context window
+	Providers map[string]bool `yaml:"providers"`  // Turns context providers (e.g. "git") on or off; all are on by default
+}
+
+// AgentConfig controls the observe-and-retry loop of the agent modes
+type AgentConfig struct {
+	MaxIterations int `yaml:"max_iterations"` // Commands the agent may run for one request
+}
+
+// defaultAgentIterations is used when max_iterations is not configured
+const defaultAgentIterations = 8
+
+// ProviderConfig describes how to reach one model backend
+type ProviderConfig struct {
+	Type         string `yaml:"type"`         // "openai" (default, any OpenAI-compatible server), "anthropic" or "ollama"
+	BaseURL      string `yaml:"base_url"`     // API endpoint, defaults to the vendor's public API
+	APIKey       string `yaml:"api_key"`      // Key to send; prefer APIKeyEnv to keep keys out of the file
+	APIKeyEnv    string `yaml:"api_key_env"`  // Environment variable holding the key
+	AuthHeader   string `yaml:"auth_header"`  // Header to send the key in instead of the vendor default
+	Organization string `yaml:"organization"` // OpenAI organization ID
+	Model        string `yaml:"model"`        // Default model for this provider
+}
+
+// defaultProviderName is the provider used when no config file exists
+const defaultProviderName = "openai"
+
+// configPath returns the location of the config file
+func configPath() (string, error) {
+	if path := os.Getenv("VIBESH_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "vibesh", "config.yaml"), nil
+}
+
+// LoadConfig reads the config file, falling back to defaults for anything
+// it does not set. A missing file is not an error.
+func LoadConfig() (*Config, error) {
+	cfg := &Config{}
+
+	path, err := configPath()
+	if err == nil {
+		data, readErr := os.ReadFile(path)
+		if readErr == nil {
+			if err := yaml.Unmarshal(data, cfg); err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+			}
+		} else if !errors.Is(readErr, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read %s: %v", path, readErr)
+		}
+	}
+
+	if err := cfg.Model.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid model setting in %s: %v", path, err)
+	}
+	if cfg.Providers == nil {
+		cfg.Providers = map[string]ProviderConfig{}
+	}
+	if _, ok := cfg.Providers[defaultProviderName]; !ok {
+		cfg.Providers[defaultProviderName] = ProviderConfig{Type: "openai"}
+	}
+	if cfg.DefaultProvider == "" {
+		cfg.DefaultProvider = defaultProviderName
+	}
+	if cfg.Agent.MaxIterations <= 0 {
+		cfg.Agent.MaxIterations = defaultAgentIterations
+	}
+	if cfg.Context.MaxTokens <= 0 {
+		cfg.Context.MaxTokens = defaultContextTokens
+	}
+	if cfg.Risk.DisagreementThreshold <= 0 {
+		cfg.Risk.DisagreementThreshold = defaultDisagreementThreshold
+	}
+	if cfg.Risk.DisagreementLog == "" {
+		if dir, err := stateDir(); err == nil {
+			cfg.Risk.DisagreementLog = filepath.Join(dir, "risk-disagreements.jsonl")
+		}
+	}
+	if cfg.Guard.Writable == nil {
+		cfg.Guard.Writable = defaultWritablePaths
+	}
+	if cfg.Guard.Protected == nil {
+		cfg.Guard.Protected = defaultProtectedPaths
+	}
+	if cfg.Guard.OnOutsideWorkspace == "" {
+		cfg.Guard.OnOutsideWorkspace = PolicyConfirm
+	}
+	if cfg.Guard.OnProtected == "" {
+		cfg.Guard.OnProtected = PolicyConfirm
+	}
+	if cfg.Snapshots.Dir == "" {
+		if dir, err := stateDir(); err == nil {
+			cfg.Snapshots.Dir = filepath.Join(dir, "snapshots")
+		} else {
+			cfg.Snapshots.Disabled = true
+		}
+	}
+	if cfg.Audit.File == "" {
+		if dir, err := stateDir(); err == nil {
+			cfg.Audit.File = filepath.Join(dir, "audit.jsonl")
+		} else {
+			cfg.Audit.Disabled = true
+		}
+	}
+	if cfg.Snapshots.Keep <= 0 {
+		cfg.Snapshots.Keep = defaultSnapshotKeep
+	}
+	if cfg.Snapshots.MaxFiles <= 0 {
+		cfg.Snapshots.MaxFiles = defaultSnapshotMaxFiles
+	}
+	if cfg.Snapshots.MaxSizeMB <= 0 {
+		cfg.Snapshots.MaxSizeMB = defaultSnapshotMaxSize
+	}
+	if cfg.Sandbox.Preview.Modes == nil {
+		cfg.Sandbox.Preview.Modes = defaultPreviewModes
+	}
+	for name := range cfg.Context.Providers {
+		if !slices.ContainsFunc(contextProviders, func(p ContextProvider) bool { return p.Name == name }) {
+			return nil, fmt.Errorf("unknown context provider %q in %s (available: %s)", name, path, contextProviderNames())
+		}
+	}
+	return cfg, nil
+}
+
+// ProviderFor returns the name of the provider configured for mode. A YOLO
+// mode without its own entry uses the entry of its non-YOLO counterpart.
+func (c *Config) ProviderFor(mode string) string {
+	if name, ok := c.Modes[mode]; ok {
+		return name
+	}
+	if name, ok := c.Modes[strings.TrimSuffix(mode, "-yolo")]; ok {
+		return name
+	}
+	return c.DefaultProvider
+}
+
+// apiKey resolves the key for a provider from the config or the environment
+func (p ProviderConfig) apiKey() string {
+	if p.APIKey != "" {
+		return p.APIKey
+	}
+	if p.APIKeyEnv != "" {
+		return os.Getenv(p.APIKeyEnv)
+	}
+	switch p.Type {
+	case "anthropic":
+		return os.Getenv("ANTHROPIC_API_KEY")
+	case "ollama":
+		return ""
+	default:
+		return os.Getenv("OPENAI_API_KEY")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// explainPrompt asks the model to break down a command awaiting confirmation
+const explainPrompt = `Explain the shell command the user gives, for someone deciding whether to run it. Go through it part by part: each program, subcommand, flag and argument, and what it does. Point out anything that deletes, overwrites or sends data, or would be hard to undo. Be brief and use a list.`
+
+// Confirmer asks the user whether to run a command that needs confirmation.
+// Besides yes and no, the user can edit the command, have the model explain
+// it, or allow commands like it for the rest of the session.
+type Confirmer struct {
+	assessor *RiskAssessor // Assesses edited commands
+	policy   *Policy
+	session  *Session // Runs the user's editor
+}
+
+func NewConfirmer(assessor *RiskAssessor, policy *Policy, session *Session) *Confirmer {
+	return &Confirmer{assessor: assessor, policy: policy, session: session}
+}
+
+// Confirmation is a command awaiting the user's decision. Editing the
+// command updates it, with its assessment and decision.
+type Confirmation struct {
+	Mode       string // Mode the policy is applied for
+	Cmd        Command
+	Assessment Assessment
+	Decision   PolicyDecision
+	Provider   Provider // Explains the command, nil if there is no model
+	Settings   *ModelSettings
+	Answer     string // How it was decided on, e.g. AuditConfirmed, once Confirm returns
+}
+
+// Confirm carries out the policy decision for c, asking the user if it says
+// to confirm. It reports whether c.Cmd, which the user may have edited, may
+// run.
+func (k *Confirmer) Confirm(ctx context.Context, stdio *IO, c *Confirmation) bool {
+	switch c.Decision.Action {
+	case PolicyDeny:
+		printDecision(stdio.Stdout, c.Decision, c.Assessment.Risk, "command", "")
+		fmt.Fprintf(stdio.Stdout, "Command: %s\n", c.Cmd)
+		c.Answer = AuditDenied
+		return false
+	case PolicyAllow:
+		c.Answer = AuditAllowed
+		return true
+	}
+
+	for {
+		printDecision(stdio.Stdout, c.Decision, c.Assessment.Risk, "command", "")
+		fmt.Fprintf(stdio.Stdout, "Command: %s\n\n", c.Cmd)
+
+		// Rules, the path guard and critical commands cannot be waived for
+		// the session
+		pattern := ""
+		if !c.Decision.Mandatory() && c.Assessment.Local.Risk < criticalRisk {
+			pattern = commandPattern(c.Assessment.Local)
+		}
+		options := "[y]es, [n]o, [e]dit"
+		if c.Provider != nil {
+			options += ", e[x]plain"
+		}
+		if pattern != "" {
+			options += fmt.Sprintf(", [a]lways allow %q", pattern)
+		}
+		fmt.Fprintf(stdio.Stdout, "Do you want to execute this command? %s: ", options)
+
+		answer, _ := stdio.Input.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			c.Answer = AuditConfirmed
+			return true
+		case "e", "edit":
+			if !k.edit(ctx, stdio, c) {
+				continue
+			}
+			printRisk(stdio.Stdout, c.Assessment, c.Cmd, "")
+			if c.Decision.Action == PolicyDeny {
+				printDecision(stdio.Stdout, c.Decision, c.Assessment.Risk, "command", "")
+				c.Answer = AuditDenied
+				return false
+			}
+			// Ask again, so the edited command is seen before it runs
+		case "x", "explain":
+			if c.Provider == nil {
+				continue
+			}
+			explanation, err := explainCommand(ctx, c.Provider, c.Settings, c.Cmd)
+			if err != nil {
+				fmt.Fprintf(stdio.Stderr, "Failed to explain the command: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(stdio.Stdout, "\n%s\n\n", strings.TrimSpace(explanation))
+		case "a", "always":
+			if pattern == "" {
+				continue
+			}
+			k.policy.AllowForSession(pattern)
+			fmt.Fprintf(stdio.Stdout, "Commands like %q will run without confirmation for the rest of the session.\n", pattern)
+			c.Answer = AuditAlways
+			return true
+		default:
+			fmt.Fprintln(stdio.Stdout, "Command execution cancelled by user.")
+			c.Answer = AuditDeclined
+			return false
+		}
+	}
+}
+
+// edit lets the user change the command, in their $VISUAL or $EDITOR if
+// they have one and on a line of input otherwise. It reports whether the
+// command changed.
+func (k *Confirmer) edit(ctx context.Context, stdio *IO, c *Confirmation) bool {
+	current := c.Cmd.String()
+
+	var edited string
+	if editor := cmp.Or(os.Getenv("VISUAL"), os.Getenv("EDITOR")); editor != "" {
+		text, err := k.editInEditor(ctx, stdio, editor, current)
+		if err != nil {
+			fmt.Fprintf(stdio.Stderr, "Failed to edit the command: %v\n", err)
+			return false
+		}
+		edited = text
+	} else {
+		fmt.Fprintf(stdio.Stdout, "Current: %s\n", current)
+		fmt.Fprint(stdio.Stdout, "New command (empty to keep): ")
+		edited, _ = stdio.Input.ReadString('\n')
+	}
+
+	edited = strings.TrimSpace(edited)
+	if edited == "" || edited == current {
+		return false
+	}
+	c.Cmd = NewShellCommand(edited)
+	c.Assessment = k.assessor.AssessLocal(c.Cmd)
+	c.Decision = k.policy.Decide(c.Mode, c.Assessment, sessionDir(k.session))
+	return true
+}
+
+// editInEditor opens text in editor, run in the session so it gets the
+// terminal, and returns what the user saved
+func (k *Confirmer) editInEditor(ctx context.Context, stdio *IO, editor, text string) (string, error) {
+	file, err := os.CreateTemp("", "vibesh-*.sh")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(text + "\n"); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+
+	// The editor setting may include arguments, e.g. "code --wait"
+	status, err := k.session.Run(ctx, editor+" "+quoteArg(file.Name()), Limits{}, stdio.Stdout, stdio.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if status != 0 {
+		return "", fmt.Errorf("%s exited with status %d", editor, status)
+	}
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// explainCommand asks the model for a breakdown of cmd
+func explainCommand(ctx context.Context, provider Provider, settings *ModelSettings, cmd Command) (string, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, settings.RequestTimeout())
+	defer cancel()
+
+	resp, err := provider.Chat(reqCtx, ChatRequest{
+		Messages: []ChatMessage{
+			{Role: RoleSystem, Content: explainPrompt},
+			{Role: RoleUser, Content: cmd.String()},
+		},
+		Settings: settings.For(provider),
+	})
+	if err != nil {
+		return "", fmt.Errorf("%s API error: %v", provider.Name(), err)
+	}
+	if strings.TrimSpace(resp.Content) == "" {
+		return "", fmt.Errorf("%s returned no explanation", provider.Name())
+	}
+	return resp.Content, nil
+}
+
+// commandPattern describes the commands an analysis is of, for allowing
+// them again: each executable with all its arguments as written, so that
+// allowing `rm -rf build` does not allow `rm -rf ~`. Wrappers such as sudo
+// are left out, but elevated commands are marked.
+func commandPattern(a Analysis) string {
+	patterns := make([]string, 0, len(a.Commands))
+	for _, cmd := range a.Commands {
+		words := []string{quoteArg(cmd.Name)}
+		if cmd.Elevated {
+			words = append([]string{"sudo"}, words...)
+		}
+		for _, arg := range cmd.Args {
+			words = append(words, quoteArg(arg))
+		}
+		patterns = append(patterns, strings.Join(words, " "))
+	}
+	return strings.Join(patterns, "; ")
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestCommandPattern(t *testing.T) {
+	tests := map[string]string{
+		"rm -rf build":                 "rm -rf build",
+		"git push --force origin main": "git push --force origin main",
+		"sudo apt-get install vim":     "sudo apt-get install vim",
+		"rm 'my file'":                 "rm 'my file'",
+		"ls | wc -l":                   "ls; wc -l",
+	}
+	for src, want := range tests {
+		if got := commandPattern(AnalyzeCommand(NewShellCommand(src))); got != want {
+			t.Errorf("commandPattern(%q) = %q, want %q", src, got, want)
+		}
+	}
+}
+
+func TestAllowForSession(t *testing.T) {
+	policy := &Policy{ConfirmRisk: defaultConfirmRisk}
+	assessor := NewRiskAssessor(&RiskConfig{}, nil)
+	decide := func(src string) PolicyAction {
+		return policy.decideByRules("ai", assessor.AssessLocal(NewShellCommand(src)), "/work").Action
+	}
+
+	for _, src := range []string{"rm -rf build", "rm -rf ~"} {
+		if got := decide(src); got != PolicyConfirm {
+			t.Fatalf("%s before allowing: %s, want confirm", src, got)
+		}
+		policy.AllowForSession(commandPattern(AnalyzeCommand(NewShellCommand(src))))
+	}
+
+	tests := []struct {
+		src  string
+		want PolicyAction
+	}{
+		{"rm -rf build", PolicyAllow},
+		{"rm -rf dist", PolicyConfirm},
+		{"rm -rf *", PolicyConfirm},
+		{"rm -rf ~", PolicyConfirm}, // Critical, so never waived
+	}
+	for _, tt := range tests {
+		if got := decide(tt.src); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.src, got, tt.want)
+		}
+	}
+}
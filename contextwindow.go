@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultContextTokens bounds what is sent with each request when the
+// config sets no budget, keeping requests fast and cheap
+const defaultContextTokens = 16000
+
+// defaultReplyTokens is kept free for the reply when max_tokens is unset
+const defaultReplyTokens = 1024
+
+// messageOverheadTokens approximates the tokens a message costs beyond its text
+const messageOverheadTokens = 4
+
+// contextWindows gives the context window of known models by name prefix,
+// more specific prefixes first
+var contextWindows = []struct {
+	prefix string
+	tokens int
+}{
+	{"gpt-4.1", 1000000},
+	{"gpt-4o", 128000},
+	{"gpt-4-turbo", 128000},
+	{"gpt-4", 8192},
+	{"gpt-3.5-turbo", 16385},
+	{"o1", 200000},
+	{"o3", 200000},
+	{"o4", 200000},
+	{"claude", 200000},
+	{"llama3.1", 128000},
+	{"llama3.2", 128000},
+	{"llama3.3", 128000},
+	{"llama3", 8192},
+	{"qwen2.5", 32768},
+	{"mistral", 32768},
+}
+
+// fallbackContextWindow is assumed for models missing from contextWindows
+const fallbackContextWindow = 8192
+
+// contextWindow returns the context window of model in tokens
+func contextWindow(model string) int {
+	model = strings.ToLower(model)
+	// Ignore an organisation prefix such as "meta-llama/"
+	if i := strings.LastIndex(model, "/"); i >= 0 {
+		model = model[i+1:]
+	}
+	for _, w := range contextWindows {
+		if strings.HasPrefix(model, w.prefix) {
+			return w.tokens
+		}
+	}
+	return fallbackContextWindow
+}
+
+// estimateMarginPercent is added to every estimate, since running out of
+// context fails a request while a few tokens unused cost nothing
+const estimateMarginPercent = 15
+
+// estimateTokens approximates, erring high, the tokens text costs with
+// model. Without the model's tokenizer, text is split as BPE tokenizers
+// split it: a word costs a token per four letters (three for Llama), and a
+// number one per three digits, while punctuation and symbols, common in code
+// and JSON, and characters outside ASCII, as in non-Latin scripts, cost up
+// to a token each.
+func estimateTokens(model, text string) int {
+	lettersPerToken := 4
+	if strings.Contains(strings.ToLower(model), "llama") {
+		lettersPerToken = 3
+	}
+
+	tokens, letters, digits, spaces := 0, 0, 0, 0
+	flush := func() {
+		if letters > 0 {
+			tokens += max(letters/lettersPerToken, 1)
+		}
+		tokens += (digits + 2) / 3
+		letters, digits = 0, 0
+	}
+	for _, r := range text {
+		switch {
+		case r < utf8.RuneSelf && unicode.IsLetter(r):
+			if digits > 0 {
+				flush()
+			}
+			letters++
+		case r < utf8.RuneSelf && unicode.IsDigit(r):
+			if letters > 0 {
+				flush()
+			}
+			digits++
+		case r == ' ':
+			flush()
+			// A space joins the next word, but a run of them, as in
+			// indentation, is a token of its own
+			if spaces++; spaces == 2 {
+				tokens++
+			}
+			continue
+		default:
+			// Newlines, punctuation, symbols and characters outside ASCII
+			flush()
+			tokens++
+		}
+		spaces = 0
+	}
+	flush()
+	return tokens + tokens*estimateMarginPercent/100 + 1
+}
+
+// estimateMessages approximates the tokens messages cost with model
+func estimateMessages(model string, messages []ChatMessage) int {
+	total := 0
+	for _, msg := range messages {
+		total += messageOverheadTokens + estimateTokens(model, msg.Content)
+		for _, call := range msg.ToolCalls {
+			total += estimateTokens(model, call.Name+call.Arguments)
+		}
+	}
+	return total
+}
+
+// ContextUsage describes what was sent with a request
+type ContextUsage struct {
+	Model      string // Model the request was for
+	Budget     int    // Tokens allowed for the request
+	Tokens     int    // Estimated tokens sent
+	Turns      int    // Earlier turns in the transcript
+	Full       int    // Turns sent with their output
+	Trimmed    int    // Turns sent without their output
+	Summarised int    // Turns reduced to one line of a summary
+	Dropped    int    // Turns left out entirely
+	EnvClipped bool   // Whether the environment context was cut short
+	Required   int    // Estimated tokens of the system prompt and request, which are always sent
+}
+
+// Reduced reports whether anything was left out to fit the budget
+func (u ContextUsage) Reduced() bool {
+	return u.Trimmed > 0 || u.Summarised > 0 || u.Dropped > 0 || u.EnvClipped
+}
+
+// OverBudget reports whether the request was sent over the budget, as it is
+// when the system prompt and request alone do not fit
+func (u ContextUsage) OverBudget() bool {
+	return u.Tokens > u.Budget
+}
+
+func (u ContextUsage) String() string {
+	s := fmt.Sprintf("~%d of %d tokens for %s; history: %d of %d turns in full",
+		u.Tokens, u.Budget, u.Model, u.Full, u.Turns)
+	if u.Trimmed > 0 {
+		s += fmt.Sprintf(", %d without output", u.Trimmed)
+	}
+	if u.Summarised > 0 {
+		s += fmt.Sprintf(", %d summarised", u.Summarised)
+	}
+	if u.Dropped > 0 {
+		s += fmt.Sprintf(", %d dropped", u.Dropped)
+	}
+	if u.EnvClipped {
+		s += "; environment context clipped"
+	}
+	if u.OverBudget() {
+		s += fmt.Sprintf("; over budget, as the system prompt and request alone need ~%d tokens", u.Required)
+	}
+	return s
+}
+
+// ContextManager builds the messages sent with each request within a token
+// budget. The system prompt and the user's request are always sent. The
+// environment context gets at most a quarter of the budget, and earlier turns
+// fill what is left, newest first: recent turns keep their output, older
+// ones lose it, and the oldest are reduced to a one-line summary each.
+type ContextManager struct {
+	config  *ContextConfig
+	session *Session // Asked for the working directory and PATH
+
+	mu   sync.Mutex
+	last *ContextUsage // Usage of the most recent request, nil before the first
+}
+
+func NewContextManager(config *ContextConfig, session *Session) *ContextManager {
+	return &ContextManager{config: config, session: session}
+}
+
+// Budget returns the tokens allowed for a request to model, leaving room for
+// a reply of up to settings.MaxTokens
+func (m *ContextManager) Budget(model string, settings *ModelSettings) int {
+	reply := settings.MaxTokens
+	if reply <= 0 {
+		reply = defaultReplyTokens
+	}
+	budget := contextWindow(model) - reply
+	if limit := m.config.MaxTokens; limit > 0 && limit < budget {
+		budget = limit
+	}
+	return max(budget, 0)
+}
+
+// Build returns the messages for command, fitting the environment context and
+// as much of history as the budget for model allows
+func (m *ContextManager) Build(systemPrompt, command string, history []Turn, model string, settings *ModelSettings) ([]ChatMessage, ContextUsage) {
+	messages, usage := m.Preview(systemPrompt, command, history, model, settings)
+	m.mu.Lock()
+	m.last = &usage
+	m.mu.Unlock()
+	return messages, usage
+}
+
+// Preview is Build without recording the usage, for showing what a request
+// would send
+func (m *ContextManager) Preview(systemPrompt, command string, history []Turn, model string, settings *ModelSettings) ([]ChatMessage, ContextUsage) {
+	usage := ContextUsage{Model: model, Budget: m.Budget(model, settings), Turns: len(history)}
+
+	system := ChatMessage{Role: RoleSystem, Content: systemPrompt}
+	request := ChatMessage{Role: RoleUser, Content: command}
+	usage.Required = estimateMessages(model, []ChatMessage{system, request})
+	remaining := max(usage.Budget-usage.Required, 0)
+
+	// Add environment context, clipped to its share of the budget and to
+	// what the required messages leave
+	const environmentHeader = "Environment context:\n"
+	envContext := m.Environment()
+	limit := min(usage.Budget/4, remaining-messageOverheadTokens-estimateTokens(model, environmentHeader+clippedMark))
+	if estimateTokens(model, envContext) > limit {
+		envContext = clipLines(model, envContext, limit)
+		usage.EnvClipped = true
+	}
+	environment := ChatMessage{Role: RoleSystem, Content: environmentHeader + envContext}
+	remaining = max(remaining-estimateMessages(model, []ChatMessage{environment}), 0)
+
+	// Fit earlier turns newest first, dropping output before whole turns
+	var recent [][]ChatMessage
+	oldest := len(history)
+	for oldest > 0 {
+		n := oldest
+		turn := history[n-1]
+		messages := turnMessages(n, turn)
+		cost := estimateMessages(model, messages)
+		if cost > remaining && turn.Output != "" {
+			turn.Output = "[output omitted to save context]"
+			messages = turnMessages(n, turn)
+			cost = estimateMessages(model, messages)
+			if cost <= remaining {
+				usage.Trimmed++
+			}
+		} else if cost <= remaining {
+			usage.Full++
+		}
+		if cost > remaining {
+			break
+		}
+		remaining -= cost
+		recent = append(recent, messages)
+		oldest--
+	}
+
+	// Summarise the turns that did not fit, keeping the latest of them
+	const summaryHeader = "Earlier in this session, summarised:\n"
+	var summary []string
+	if oldest > 0 {
+		remaining = max(remaining-messageOverheadTokens-estimateTokens(model, summaryHeader), 0)
+	}
+	for i := oldest - 1; i >= 0; i-- {
+		line := "- " + describeTurn(history[i])
+		cost := estimateTokens(model, line+"\n")
+		if cost > remaining {
+			break
+		}
+		remaining -= cost
+		summary = append([]string{line}, summary...)
+	}
+	usage.Summarised = len(summary)
+	usage.Dropped = oldest - len(summary)
+
+	messages := []ChatMessage{system, environment}
+	if len(summary) > 0 {
+		messages = append(messages, ChatMessage{
+			Role:    RoleSystem,
+			Content: summaryHeader + strings.Join(summary, "\n"),
+		})
+	}
+	for i := len(recent) - 1; i >= 0; i-- {
+		messages = append(messages, recent[i]...)
+	}
+	messages = append(messages, request)
+
+	usage.Tokens = estimateMessages(model, messages)
+	return messages, usage
+}
+
+// Compact shrinks a conversation that has outgrown the budget, as an agent's
+// does while it runs commands, by omitting the content of tool results other
+// than the latest, oldest first
+func (m *ContextManager) Compact(messages []ChatMessage, model string, settings *ModelSettings) []ChatMessage {
+	budget := m.Budget(model, settings)
+	total := estimateMessages(model, messages)
+
+	latest := len(messages)
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == RoleTool {
+			latest = i
+			break
+		}
+	}
+
+	for i := 0; i < latest && total > budget; i++ {
+		if messages[i].Role != RoleTool {
+			continue
+		}
+		omitted := "[output omitted to save context]"
+		total -= estimateTokens(model, messages[i].Content) - estimateTokens(model, omitted)
+		messages[i].Content = omitted
+	}
+	return messages
+}
+
+// Environment returns the output of the enabled context providers
+func (m *ContextManager) Environment() string {
+	return collectEnvironment(m.config, m.session)
+}
+
+// Last returns the usage of the most recent request, if there was one
+func (m *ContextManager) Last() (ContextUsage, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.last == nil {
+		return ContextUsage{}, false
+	}
+	return *m.last, true
+}
+
+// clippedMark ends text cut short by clipLines
+const clippedMark = "... (clipped to fit the context budget)\n"
+
+// clipLines keeps the leading lines of text that fit in limit tokens
+func clipLines(model, text string, limit int) string {
+	var b strings.Builder
+	used := 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		cost := estimateTokens(model, line)
+		if used+cost > limit {
+			break
+		}
+		used += cost
+		b.WriteString(line)
+	}
+	b.WriteString(clippedMark)
+	return b.String()
+}
+
+// reportContext tells the user when a request left context out or went over
+// the budget
+func reportContext(stdio *IO, usage ContextUsage) {
+	if usage.OverBudget() {
+		fmt.Fprintf(stdio.Stderr, "\033[1;33mWARNING: This request is over the context budget and may fail: %s\033[0m\n", usage)
+		return
+	}
+	if usage.Reduced() {
+		fmt.Fprintf(stdio.Stdout, "\033[2m[Context] %s\033[0m\n", usage)
+	}
+}
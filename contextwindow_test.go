@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	// At least the tokens OpenAI's cl100k tokenizer counts
+	tests := []struct {
+		text string
+		min  int
+	}{
+		{"", 0},
+		{"The quick brown fox jumps over the lazy dog.", 10},
+		{`{"name":"value","n":12,"ok":true}`, 14},
+		{"if err != nil {\n\treturn fmt.Errorf(\"open %s: %v\", path, err)\n}\n", 21},
+		{"        indented", 3},
+		{"1234567890", 4},
+		{"Привет, как дела?", 9},
+		{"你好，世界。今天天气很好。", 12},
+		{"getUserAccountDetailsFromDatabase", 6},
+	}
+	for _, tt := range tests {
+		if got := estimateTokens("gpt-4o", tt.text); got < tt.min {
+			t.Errorf("estimateTokens(%q) = %d, want at least %d", tt.text, got, tt.min)
+		}
+	}
+	if gpt, llama := estimateTokens("gpt-4o", "a fairly ordinary sentence"), estimateTokens("llama3.1", "a fairly ordinary sentence"); llama < gpt {
+		t.Errorf("llama estimate %d below gpt estimate %d", llama, gpt)
+	}
+}
+
+func TestContextWindow(t *testing.T) {
+	tests := map[string]int{
+		"gpt-4o-mini":                    128000,
+		"gpt-4":                          8192,
+		"GPT-4.1":                        1000000,
+		"claude-3-5-haiku-latest":        200000,
+		"meta-llama/llama3.1:70b":        128000,
+		"llama3":                         8192,
+		"some-model-nobody-has-heard-of": fallbackContextWindow,
+	}
+	for model, want := range tests {
+		if got := contextWindow(model); got != want {
+			t.Errorf("contextWindow(%q) = %d, want %d", model, got, want)
+		}
+	}
+
+	m := &ContextManager{config: &ContextConfig{MaxTokens: 16000}}
+	budgets := []struct {
+		model     string
+		maxTokens int
+		want      int
+	}{
+		{"gpt-4o", 0, 16000},
+		{"gpt-4", 0, 8192 - defaultReplyTokens},
+		{"gpt-4", 4096, 8192 - 4096},
+		{"gpt-4", 10000, 0},
+	}
+	for _, tt := range budgets {
+		if got := m.Budget(tt.model, &ModelSettings{MaxTokens: tt.maxTokens}); got != tt.want {
+			t.Errorf("Budget(%s, max_tokens %d) = %d, want %d", tt.model, tt.maxTokens, got, tt.want)
+		}
+	}
+}
+
+// newTestContextManager returns a context manager whose environment is the
+// listing of a directory of files, or nothing if files is 0
+func newTestContextManager(t *testing.T, maxTokens, files int) *ContextManager {
+	t.Helper()
+	session, err := NewSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+
+	dir := t.TempDir()
+	for i := range files {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file-%04d.txt", i)), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := session.Run(context.Background(), "cd "+shellQuote(dir), Limits{}, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	providers := map[string]bool{}
+	for _, provider := range contextProviders {
+		providers[provider.Name] = provider.Name == "directory" && files > 0
+	}
+	return NewContextManager(&ContextConfig{MaxTokens: maxTokens, Providers: providers}, session)
+}
+
+func TestContextPreview(t *testing.T) {
+	var history []Turn
+	for i := range 20 {
+		history = append(history, Turn{
+			Input:   fmt.Sprintf("request %d", i),
+			Mode:    "ai",
+			Command: fmt.Sprintf("ls dir%d", i),
+			Output:  strings.Repeat("output line\n", 40),
+		})
+	}
+
+	tests := []struct {
+		name      string
+		maxTokens int
+		files     int
+		command   string
+		full      int  // Turns sent in full
+		reduced   bool // Whether anything was left out
+		over      bool // Whether the request is over budget
+		envKept   bool // Whether any of the environment is sent
+	}{
+		{"everything fits", 100000, 0, "list files", 20, false, false, true},
+		{"history reduced", 2000, 0, "list files", 5, true, false, true},
+		{"environment clipped", 2000, 500, "list files", 1, true, false, true},
+		{"request over budget", 500, 500, strings.Repeat("word ", 1000), 0, true, true, false},
+	}
+	for _, tt := range tests {
+		m := newTestContextManager(t, tt.maxTokens, tt.files)
+		messages, usage := m.Preview("system prompt", tt.command, history, "gpt-4o", &ModelSettings{})
+
+		if usage.Full < tt.full || usage.Reduced() != tt.reduced || usage.OverBudget() != tt.over {
+			t.Errorf("%s: %s", tt.name, usage)
+		}
+		if usage.Full+usage.Trimmed+usage.Summarised+usage.Dropped != len(history) {
+			t.Errorf("%s: turns do not add up: %+v", tt.name, usage)
+		}
+		if !tt.over && usage.Tokens > usage.Budget {
+			t.Errorf("%s: %d tokens over a budget of %d", tt.name, usage.Tokens, usage.Budget)
+		}
+		if usage.Tokens != estimateMessages("gpt-4o", messages) {
+			t.Errorf("%s: usage of %d tokens, messages of %d", tt.name, usage.Tokens, estimateMessages("gpt-4o", messages))
+		}
+		if first, last := messages[0], messages[len(messages)-1]; first.Content != "system prompt" || last.Content != tt.command {
+			t.Errorf("%s: the system prompt and request were not both sent", tt.name)
+		}
+		if envKept := strings.Contains(messages[1].Content, "file-0000"); tt.files > 0 && envKept != tt.envKept {
+			t.Errorf("%s: environment kept %v:\n%s", tt.name, envKept, messages[1].Content)
+		}
+	}
+}
+
+func TestClipLines(t *testing.T) {
+	text := "one\ntwo\nthree\n"
+	tests := []struct {
+		limit int
+		want  string
+	}{
+		{100, text},
+		{estimateTokens("gpt-4o", "one\n") + estimateTokens("gpt-4o", "two\n"), "one\ntwo\n"},
+		{0, ""},
+		{-5, ""},
+	}
+	for _, tt := range tests {
+		if got := clipLines("gpt-4o", text, tt.limit); got != tt.want+clippedMark {
+			t.Errorf("clipLines(%d) = %q, want %q", tt.limit, got, tt.want+clippedMark)
+		}
+	}
+}
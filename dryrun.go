@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Suggestion is what a processor would have run in dry-run mode
+type Suggestion struct {
+	Request string // What the user asked for
+	Mode    string // Mode it was asked in, whose policy applies
+	Reply   string
+	Steps   []*planStep
+	Audit   *AuditRequest // Where the steps are recorded, as shown and if they run
+}
+
+// DryRun is shared by the AI, RAG and agent processors. While it is on they
+// show what they would run instead of running it, and keep it as the last
+// suggestion, which the `run` and `edit` builtins act on.
+type DryRun struct {
+	On bool
+
+	assessor *RiskAssessor
+	policy   *Policy
+	sandbox  *Sandbox
+	session  *Session
+	last     *Suggestion
+}
+
+func NewDryRun(on bool, assessor *RiskAssessor, policy *Policy, sandbox *Sandbox, session *Session) *DryRun {
+	return &DryRun{On: on, assessor: assessor, policy: policy, sandbox: sandbox, session: session}
+}
+
+// Suggest keeps s as the last suggestion and tells the user how to use it
+func (d *DryRun) Suggest(s *Suggestion, stdio *IO) {
+	for _, step := range s.Steps {
+		s.Audit.Step(step, AuditDryRun, nil)
+	}
+	d.last = s
+	fmt.Fprintln(stdio.Stdout, "\033[1;36mDry run: nothing was executed. Type `run` to run it or `edit` to change it.\033[0m")
+}
+
+// Run runs the steps of the last suggestion in order, rechecked against the
+// policy in the current directory. Typing `run` only confirms suggestions the
+// policy allows: if any step needs confirmation, for its risk or by a rule,
+// every step is confirmed one by one, and denied steps stop it as in a plan.
+// It returns the suggestion's request and the result, or a nil result if
+// there was nothing to run.
+func (d *DryRun) Run(ctx context.Context, stdio *IO) (string, string, *Result) {
+	s := d.last
+	if s == nil {
+		fmt.Fprintln(stdio.Stdout, "There is no suggestion to run.")
+		return "", "", nil
+	}
+	d.last = nil
+
+	dir := sessionDir(d.session)
+	stepByStep := false
+	for _, step := range s.Steps {
+		step.decision = d.policy.Decide(s.Mode, step.assessment, dir)
+		stepByStep = stepByStep || step.decision.Action != PolicyAllow
+	}
+	result := executePlan(ctx, d.sandbox, s.Audit, s.Mode, s.Steps, stepByStep, stdio)
+	result.Reply = s.Reply
+	return s.Request, s.Mode, result
+}
+
+// Edit replaces the command of a step of the last suggestion, the only one
+// unless args names another, with one typed by the user. The new command is
+// assessed locally and shown, but not run.
+func (d *DryRun) Edit(args []string, stdio *IO) {
+	s := d.last
+	if s == nil {
+		fmt.Fprintln(stdio.Stdout, "There is no suggestion to edit.")
+		return
+	}
+
+	n := 1
+	if len(args) > 0 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil || n < 1 || n > len(s.Steps) {
+			fmt.Fprintf(stdio.Stdout, "No step %q; steps are numbered 1 to %d.\n", args[0], len(s.Steps))
+			return
+		}
+	} else if len(s.Steps) > 1 {
+		fmt.Fprintf(stdio.Stdout, "Give the step number, 1 to %d, e.g. \"edit 2\".\n", len(s.Steps))
+		return
+	}
+	step := s.Steps[n-1]
+
+	fmt.Fprintf(stdio.Stdout, "Current: %s\n", step.cmd)
+	fmt.Fprint(stdio.Stdout, "New command (empty to keep): ")
+	line, _ := stdio.Input.ReadString('\n')
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+
+	step.cmd = NewShellCommand(line)
+	step.assessment = d.assessor.AssessLocal(step.cmd)
+	step.decision = d.policy.Decide(s.Mode, step.assessment, sessionDir(d.session))
+	step.edited = true
+	if len(s.Steps) > 1 {
+		printPlan(stdio, s.Steps)
+		return
+	}
+	printRisk(stdio.Stdout, step.assessment, step.cmd, "")
+	printDecision(stdio.Stdout, step.decision, step.assessment.Risk, "command", "")
+}
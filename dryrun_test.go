@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+// newTestDryRun returns a dry run whose commands run in a session in a new
+// directory, which is also the workspace
+func newTestDryRun(t *testing.T) (*DryRun, string) {
+	t.Helper()
+	dir := t.TempDir()
+	session, err := NewSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	if _, err := session.Run(context.Background(), "cd "+shellQuote(dir), Limits{}, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	guard, err := NewPathGuard(&GuardConfig{Workspace: dir, OnOutsideWorkspace: PolicyConfirm, OnProtected: PolicyConfirm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &Policy{ConfirmRisk: defaultConfirmRisk, guard: guard}
+	limiter, err := NewLimiter(&LimitsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sandbox, err := NewSandbox(&SandboxConfig{}, limiter, NewSnapshotStore(&SnapshotConfig{Disabled: true}), dir, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewDryRun(true, NewRiskAssessor(&RiskConfig{}, nil), policy, sandbox, session), dir
+}
+
+// suggest makes a suggestion of commands, assessed and decided as in mode
+func suggest(d *DryRun, mode string, commands ...string) *Suggestion {
+	s := &Suggestion{Request: "test", Mode: mode, Audit: NewAuditLog(&AuditConfig{Disabled: true}, nil).Request(mode, "test", "", nil)}
+	for _, command := range commands {
+		step := &planStep{cmd: NewShellCommand(command)}
+		step.assessment = d.assessor.AssessLocal(step.cmd)
+		s.Steps = append(s.Steps, step)
+	}
+	d.Suggest(s, &IO{Stdout: io.Discard, Stderr: io.Discard})
+	return s
+}
+
+func TestDryRunEdit(t *testing.T) {
+	d, _ := newTestDryRun(t)
+
+	tests := []struct {
+		steps  []string
+		args   []string
+		input  string
+		want   []string // Commands of the steps after editing
+		output string   // Substring of what is shown
+	}{
+		{[]string{"ls"}, nil, "ls -la\n", []string{"ls -la"}, "Current: ls"},
+		{[]string{"ls"}, nil, "\n", []string{"ls"}, "New command"},
+		{[]string{"ls", "pwd"}, []string{"2"}, "date\n", []string{"ls", "date"}, "Plan (2 steps)"},
+		{[]string{"ls", "pwd"}, nil, "date\n", []string{"ls", "pwd"}, "Give the step number"},
+		{[]string{"ls", "pwd"}, []string{"3"}, "date\n", []string{"ls", "pwd"}, "No step \"3\""},
+		{[]string{"ls"}, []string{"x"}, "date\n", []string{"ls"}, "No step \"x\""},
+		{[]string{"ls"}, nil, "rm -rf /\n", []string{"rm -rf /"}, "Risk"},
+	}
+	for _, tt := range tests {
+		s := suggest(d, "ai", tt.steps...)
+		var out bytes.Buffer
+		d.Edit(tt.args, &IO{Input: bufio.NewReader(strings.NewReader(tt.input)), Stdout: &out, Stderr: &out})
+		for i, step := range s.Steps {
+			if step.cmd.String() != tt.want[i] || step.edited != (tt.want[i] != tt.steps[i]) {
+				t.Errorf("edit %v of %q with %q: step %d is %q, edited %v", tt.args, tt.steps, tt.input, i+1, step.cmd, step.edited)
+			}
+		}
+		if !strings.Contains(out.String(), tt.output) {
+			t.Errorf("edit %v of %q: output %q does not contain %q", tt.args, tt.steps, out.String(), tt.output)
+		}
+	}
+
+	d.last = nil
+	var out bytes.Buffer
+	d.Edit(nil, &IO{Stdout: &out})
+	if !strings.Contains(out.String(), "no suggestion") {
+		t.Errorf("edit without a suggestion: %q", out.String())
+	}
+}
+
+func TestDryRunRunConfirms(t *testing.T) {
+	d, _ := newTestDryRun(t)
+
+	tests := []struct {
+		mode     string
+		commands []string
+		input    string
+		asked    bool   // Whether the steps are confirmed one by one
+		output   string // Substring of what is shown
+	}{
+		{"ai", []string{"echo allowed"}, "", false, "allowed"},
+		{"ai", []string{"echo first", "echo second"}, "", false, "second"},
+		{"ai", []string{"rm -rf build"}, "n\n", true, "Step skipped"},
+		{"ai", []string{"echo first", "mkfs.ext4 /dev/vibesh-test"}, "y\nq\n", true, "Plan stopped by user"},
+		{"ai", []string{"touch ../outside"}, "n\n", true, "needs confirmation by the path guard"},
+		{"ai-yolo", []string{"rm -rf build"}, "", false, "Step 1/1"},
+	}
+	for _, tt := range tests {
+		suggest(d, tt.mode, tt.commands...)
+		var out syncBuffer
+		_, _, result := d.Run(context.Background(), &IO{Input: bufio.NewReader(strings.NewReader(tt.input)), Stdout: &out, Stderr: &out})
+		if result == nil {
+			t.Fatalf("%q: nothing run", tt.commands)
+		}
+		if asked := strings.Contains(out.String(), "Run this step?"); asked != tt.asked {
+			t.Errorf("%s: %q: asked %v, want %v", tt.mode, tt.commands, asked, tt.asked)
+		}
+		if !strings.Contains(out.String(), tt.output) {
+			t.Errorf("%s: %q: output %q does not contain %q", tt.mode, tt.commands, out.String(), tt.output)
+		}
+	}
+
+	var out bytes.Buffer
+	if _, _, result := d.Run(context.Background(), &IO{Stdout: &out}); result != nil || !strings.Contains(out.String(), "no suggestion") {
+		t.Errorf("run again: %v, %q", result, out.String())
+	}
+}
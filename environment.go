@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// gitTimeout bounds how long the git provider waits, so a huge repository
+// cannot hold up every request
+const gitTimeout = time.Second
+
+// ContextProvider contributes one kind of information about the user's
+// environment to the context sent with each request
+type ContextProvider struct {
+	Name    string                  // Key under context.providers in the config
+	Collect func(ShellState) string // Returns "" when there is nothing to tell
+}
+
+// contextProviders lists every provider in the order their output is sent.
+// Each is enabled unless the config turns it off.
+var contextProviders = []ContextProvider{
+	{"os", collectOS},
+	{"shell", collectShell},
+	{"package_managers", collectPackageManagers},
+	{"binaries", collectBinaries},
+	{"git", collectGit},
+	{"project", collectProject},
+	{"container", collectContainer},
+	{"last_exit", collectLastExit},
+	{"directory", collectDirectory},
+}
+
+// contextProviderNames returns the names of all providers, for messages
+func contextProviderNames() string {
+	names := make([]string, len(contextProviders))
+	for i, provider := range contextProviders {
+		names[i] = provider.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// Enabled reports whether the provider called name is turned on
+func (c *ContextConfig) Enabled(name string) bool {
+	enabled, ok := c.Providers[name]
+	return !ok || enabled
+}
+
+// collectEnvironment returns the output of every enabled provider. The
+// session supplies the working directory and PATH, falling back to vibesh's
+// own if the shell cannot be asked.
+func collectEnvironment(config *ContextConfig, session *Session) string {
+	state, err := session.State()
+	if err != nil {
+		state.Dir, _ = os.Getwd()
+		state.Path = os.Getenv("PATH")
+	}
+
+	var b strings.Builder
+	for _, provider := range contextProviders {
+		if !config.Enabled(provider.Name) {
+			continue
+		}
+		if text := provider.Collect(state); text != "" {
+			b.WriteString(text)
+			if !strings.HasSuffix(text, "\n") {
+				b.WriteString("\n")
+			}
+		}
+	}
+	return b.String()
+}
+
+func collectOS(ShellState) string {
+	name := runtime.GOOS
+	switch runtime.GOOS {
+	case "linux":
+		if pretty := osRelease()["PRETTY_NAME"]; pretty != "" {
+			name = pretty
+		}
+	case "darwin":
+		if out, err := exec.Command("sw_vers", "-productVersion").Output(); err == nil {
+			name = "macOS " + strings.TrimSpace(string(out))
+		}
+	}
+	return fmt.Sprintf("OS: %s (%s/%s)", name, runtime.GOOS, runtime.GOARCH)
+}
+
+// osRelease parses /etc/os-release, returning nil if it cannot be read
+func osRelease() map[string]string {
+	file, err := os.Open("/etc/os-release")
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	fields := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if ok {
+			fields[key] = strings.Trim(value, `"'`)
+		}
+	}
+	return fields
+}
+
+func collectShell(state ShellState) string {
+	// Commands run in sh, which is often dash rather than bash
+	shell := "sh"
+	if path := lookPathIn("sh", state.Path); path != "" {
+		if target, err := filepath.EvalSymlinks(path); err == nil && filepath.Base(target) != "sh" {
+			shell = fmt.Sprintf("sh (%s)", filepath.Base(target))
+		}
+	}
+	text := fmt.Sprintf("Shell: commands run in %s, so use POSIX syntax", shell)
+	if login := os.Getenv("SHELL"); login != "" {
+		text += fmt.Sprintf("; the user's login shell is %s", login)
+	}
+	return text
+}
+
+// packageManagers are looked up on PATH, system ones first
+var packageManagers = []string{
+	"apt", "dnf", "yum", "pacman", "zypper", "apk", "brew", "port", "nix", "snap", "flatpak",
+	"pip3", "pip", "npm", "pnpm", "yarn", "cargo", "gem",
+}
+
+func collectPackageManagers(state ShellState) string {
+	found := onPath(packageManagers, state.Path)
+	if len(found) == 0 {
+		return ""
+	}
+	return "Package managers: " + strings.Join(found, ", ")
+}
+
+// commonBinaries are tools whose presence changes which command is best;
+// checking a fixed list keeps the context short on any PATH
+var commonBinaries = []string{
+	"git", "docker", "podman", "kubectl", "systemctl", "journalctl", "sudo",
+	"python3", "node", "go", "rustc", "java", "make", "gcc", "clang",
+	"curl", "wget", "rsync", "ssh", "jq", "rg", "fd", "fzf", "tmux",
+	"gsed", "gawk", "ip", "ifconfig", "ss", "netstat", "lsof", "free", "vm_stat",
+}
+
+func collectBinaries(state ShellState) string {
+	found := onPath(commonBinaries, state.Path)
+	if len(found) == 0 {
+		return ""
+	}
+	return "Tools on PATH: " + strings.Join(found, ", ")
+}
+
+func collectGit(state ShellState) string {
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", "status", "--porcelain", "--branch")
+	cmd.Dir = state.Dir
+	out, err := cmd.Output()
+	if err != nil {
+		// Not a repository, or git is missing
+		return ""
+	}
+
+	lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	branch := strings.TrimPrefix(lines[0], "## ")
+	changes := len(lines) - 1
+	if changes == 0 {
+		return fmt.Sprintf("Git: on branch %s, working tree clean", branch)
+	}
+	return fmt.Sprintf("Git: on branch %s, %d uncommitted change(s)", branch, changes)
+}
+
+// projectMarkers maps files in a project's root to what they say about it
+var projectMarkers = []struct {
+	file    string
+	meaning string
+}{
+	{"go.mod", "Go module"},
+	{"package.json", "Node.js"},
+	{"Cargo.toml", "Rust"},
+	{"pyproject.toml", "Python"},
+	{"requirements.txt", "Python"},
+	{"setup.py", "Python"},
+	{"Gemfile", "Ruby"},
+	{"pom.xml", "Java (Maven)"},
+	{"build.gradle", "Java (Gradle)"},
+	{"build.gradle.kts", "Kotlin (Gradle)"},
+	{"composer.json", "PHP"},
+	{"CMakeLists.txt", "CMake"},
+	{"Makefile", "Make"},
+	{"Dockerfile", "Docker image"},
+	{"docker-compose.yml", "Docker Compose"},
+	{"compose.yaml", "Docker Compose"},
+}
+
+func collectProject(state ShellState) string {
+	var found []string
+	for _, marker := range projectMarkers {
+		if fileExists(filepath.Join(state.Dir, marker.file)) {
+			found = append(found, fmt.Sprintf("%s (%s)", marker.file, marker.meaning))
+		}
+	}
+	if len(found) == 0 {
+		return ""
+	}
+	return "Project files: " + strings.Join(found, ", ")
+}
+
+func collectContainer(state ShellState) string {
+	var found []string
+	switch {
+	case os.Getenv("CODESPACES") == "true":
+		found = append(found, "running in a GitHub Codespace")
+	case os.Getenv("REMOTE_CONTAINERS") == "true":
+		found = append(found, "running in a devcontainer")
+	case os.Getenv("KUBERNETES_SERVICE_HOST") != "":
+		found = append(found, "running in a Kubernetes pod")
+	case fileExists("/.dockerenv"):
+		found = append(found, "running in a Docker container")
+	case fileExists("/run/.containerenv"):
+		found = append(found, "running in a Podman container")
+	case os.Getenv("container") != "":
+		found = append(found, "running in a "+os.Getenv("container")+" container")
+	}
+	if fileExists(filepath.Join(state.Dir, ".devcontainer")) || fileExists(filepath.Join(state.Dir, ".devcontainer.json")) {
+		found = append(found, "project has a devcontainer configuration")
+	}
+	if len(found) == 0 {
+		return ""
+	}
+	return "Container: " + strings.Join(found, "; ")
+}
+
+func collectLastExit(state ShellState) string {
+	return fmt.Sprintf("Exit status of the previous command: %d", state.LastStatus)
+}
+
+func collectDirectory(state ShellState) string {
+	return getDirectoryContext(state.Dir)
+}
+
+// onPath returns the names in names that are executables on path
+func onPath(names []string, path string) []string {
+	var found []string
+	for _, name := range names {
+		if lookPathIn(name, path) != "" {
+			found = append(found, name)
+		}
+	}
+	return found
+}
+
+// lookPathIn is exec.LookPath for a PATH other than vibesh's own. It
+// returns "" if name is not found.
+func lookPathIn(name, path string) string {
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			dir = "."
+		}
+		candidate := filepath.Join(dir, name)
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// fileExists reports whether path exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLookPathIn(t *testing.T) {
+	dir := t.TempDir()
+	other := t.TempDir()
+	for _, file := range []struct {
+		path string
+		mode os.FileMode
+	}{
+		{filepath.Join(dir, "tool"), 0o755},
+		{filepath.Join(dir, "data"), 0o644},
+		{filepath.Join(other, "tool"), 0o755},
+		{filepath.Join(other, "late"), 0o755},
+	} {
+		if err := os.WriteFile(file.path, nil, file.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := dir + string(os.PathListSeparator) + other
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"tool", filepath.Join(dir, "tool")},
+		{"late", filepath.Join(other, "late")},
+		{"data", ""},
+		{"sub", ""},
+		{"missing", ""},
+	}
+	for _, tt := range tests {
+		if got := lookPathIn(tt.name, path); got != tt.want {
+			t.Errorf("lookPathIn(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if got := onPath([]string{"late", "data", "tool"}, path); !slices.Equal(got, []string{"late", "tool"}) {
+		t.Errorf("onPath: %q", got)
+	}
+}
+
+func TestCollectProject(t *testing.T) {
+	tests := []struct {
+		files []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"README.md"}, ""},
+		{[]string{"Makefile", "go.mod"}, "Project files: go.mod (Go module), Makefile (Make)"},
+		{[]string{"requirements.txt", "pyproject.toml"}, "Project files: pyproject.toml (Python), requirements.txt (Python)"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		for _, file := range tt.files {
+			if err := os.WriteFile(filepath.Join(dir, file), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := collectProject(ShellState{Dir: dir}); got != tt.want {
+			t.Errorf("%q: %q, want %q", tt.files, got, tt.want)
+		}
+	}
+}
+
+func TestCollectGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	if got := collectGit(ShellState{Dir: dir}); got != "" {
+		t.Errorf("outside a repository: %q", got)
+	}
+
+	if out, err := exec.Command("git", "-C", dir, "init", "-q", "-b", "trunk").CombinedOutput(); err != nil {
+		t.Skipf("git init: %v: %s", err, out)
+	}
+	// How git words a branch with no commits depends on its version
+	if got := collectGit(ShellState{Dir: dir}); !strings.HasPrefix(got, "Git: on branch ") || !strings.HasSuffix(got, "trunk, working tree clean") {
+		t.Errorf("new repository: %q", got)
+	}
+	for _, file := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(dir, file), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := collectGit(ShellState{Dir: dir}); !strings.HasSuffix(got, "trunk, 2 uncommitted change(s)") {
+		t.Errorf("with changes: %q", got)
+	}
+}
+
+func TestCollectEnvironment(t *testing.T) {
+	session, err := NewSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	session.Run(context.Background(), "cd "+shellQuote(dir)+" && false", Limits{}, io.Discard, io.Discard)
+
+	// Providers missing from the config are on
+	providers := map[string]bool{}
+	for _, provider := range contextProviders {
+		providers[provider.Name] = false
+	}
+	delete(providers, "project")
+	providers["last_exit"] = true
+	config := &ContextConfig{Providers: providers}
+
+	want := "Project files: go.mod (Go module)\nExit status of the previous command: 1\n"
+	if got := collectEnvironment(config, session); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
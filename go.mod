@@ -2,4 +2,14 @@ module vibesh
 
 go 1.24.2
 
-require github.com/sashabaranov/go-openai v1.38.2
+require (
+	github.com/creack/pty v1.1.24
+	github.com/sashabaranov/go-openai v1.38.2
+	golang.org/x/term v0.36.0
+)
+
+require golang.org/x/sys v0.37.0
+
+require gopkg.in/yaml.v3 v3.0.1
+
+require mvdan.cc/sh/v3 v3.12.0
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Paths guarded by default: dotfiles in the home directory, system
+// configuration and the internals of git repositories
+var defaultProtectedPaths = []string{"~/.*", "/etc", ".git"}
+
+// Paths outside the workspace that may be written by default
+var defaultWritablePaths = []string{"/tmp", "/var/tmp"}
+
+// PathGuard escalates commands that write outside the workspace or into
+// protected paths, whatever their risk score
+type PathGuard struct {
+	config    *GuardConfig
+	workspace string
+	env       func(name string) (string, bool) // Looks up variables in paths; vibesh's environment until SetEnv
+}
+
+// NewPathGuard checks config and settles the workspace, which defaults to
+// the git repository vibesh is started in, or else its working directory
+func NewPathGuard(config *GuardConfig) (*PathGuard, error) {
+	for _, action := range []PolicyAction{config.OnOutsideWorkspace, config.OnProtected} {
+		switch action {
+		case PolicyAllow, PolicyConfirm, PolicyDeny:
+		default:
+			return nil, fmt.Errorf("guard action must be allow, confirm or deny, not %q", action)
+		}
+	}
+	for _, pattern := range append(append([]string{}, config.Protected...), config.Writable...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid guard path %q: %v", pattern, err)
+		}
+	}
+
+	workspace := config.Workspace
+	if workspace == "" {
+		if out, err := exec.Command("git", "rev-parse", "--show-toplevel").Output(); err == nil {
+			workspace = strings.TrimSpace(string(out))
+		} else if workspace, err = os.Getwd(); err != nil {
+			return nil, fmt.Errorf("failed to find the workspace: %v", err)
+		}
+	}
+	workspace, err := filepath.Abs(expandPath(workspace, ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the workspace: %v", err)
+	}
+	return &PathGuard{config: config, workspace: workspace, env: os.LookupEnv}, nil
+}
+
+// SetEnv makes the guard expand variables in paths with lookup, normally
+// the session's, whose variables commands actually see
+func (g *PathGuard) SetEnv(lookup func(name string) (string, bool)) {
+	g.env = lookup
+}
+
+// Workspace returns the directory commands may write in freely
+func (g *PathGuard) Workspace() string {
+	return g.workspace
+}
+
+// Check returns the decision for a command assessed as a, looking at every
+// path its simple commands write to. dir is the working directory relative
+// paths are resolved against. Variables in paths are expanded; a path that
+// depends on one that is unset, or on anything else the shell expands, such
+// as a command substitution, cannot be checked and always needs
+// confirmation.
+func (g *PathGuard) Check(a Assessment, dir string) PolicyDecision {
+	decision := PolicyDecision{Action: PolicyAllow}
+	for _, cmd := range a.Local.Commands {
+		for _, path := range cmd.Writes {
+			written := path
+			expanded, ok := g.expandVariables(path, dir)
+			path = expandPath(expanded, dir)
+
+			var found PolicyDecision
+			switch {
+			case !ok:
+				found = PolicyDecision{
+					Action: PolicyConfirm,
+					By:     fmt.Sprintf("the path guard: %s writes to %s, which cannot be checked", cmd.Name, written),
+				}
+			case guardedPath(path, g.config.Protected):
+				found = PolicyDecision{
+					Action: g.config.OnProtected,
+					By:     fmt.Sprintf("the path guard: %s writes to %s, which is protected", cmd.Name, path),
+				}
+			case !underPattern(path, g.workspace) && !guardedPath(path, g.config.Writable):
+				found = PolicyDecision{
+					Action: g.config.OnOutsideWorkspace,
+					By:     fmt.Sprintf("the path guard: %s writes to %s, outside the workspace %s", cmd.Name, path, g.workspace),
+				}
+			}
+			if severity(found.Action) > severity(decision.Action) {
+				decision = found
+			}
+		}
+	}
+	return decision
+}
+
+// shellVariable matches a variable in a path, as $NAME or ${NAME}
+var shellVariable = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// expandVariables replaces the variables in path with their values, $PWD
+// with dir. It reports false if a variable is unset or something else is
+// left for the shell to expand.
+func (g *PathGuard) expandVariables(path, dir string) (string, bool) {
+	ok := true
+	path = shellVariable.ReplaceAllStringFunc(path, func(match string) string {
+		name := strings.Trim(match, "${}")
+		if name == "PWD" && dir != "" {
+			return dir
+		}
+		value, set := g.env(name)
+		if !set || value == "" {
+			ok = false
+		}
+		return value
+	})
+	return path, ok && !strings.ContainsAny(path, "$`")
+}
+
+// guardedPath reports whether path is covered by one of patterns. Patterns
+// starting with / or ~ cover the paths below them; others, such as ".git",
+// cover any path with a matching name in it.
+func guardedPath(path string, patterns []string) bool {
+	var names []string
+	for _, pattern := range patterns {
+		if filepath.IsAbs(pattern) || strings.HasPrefix(pattern, "~") {
+			if underPattern(path, expandPath(pattern, "")) {
+				return true
+			}
+		} else {
+			names = append(names, pattern)
+		}
+	}
+	return len(names) > 0 && ignoredPath(path, names)
+}
+
+// severity orders policy actions from least to most restrictive
+func severity(action PolicyAction) int {
+	switch action {
+	case PolicyDeny:
+		return 2
+	case PolicyConfirm:
+		return 1
+	}
+	return 0
+}
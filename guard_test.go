@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPathGuardCheck(t *testing.T) {
+	config := &GuardConfig{
+		Workspace:          "/work",
+		Writable:           defaultWritablePaths,
+		Protected:          []string{"/home/me/.*", "/etc", ".git"},
+		OnOutsideWorkspace: PolicyConfirm,
+		OnProtected:        PolicyDeny,
+	}
+	guard, err := NewPathGuard(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"HOME": "/home/me", "OUT": "/work/out"}
+	guard.SetEnv(func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	})
+
+	tests := []struct {
+		src  string
+		want PolicyAction
+	}{
+		{"touch a", PolicyAllow},
+		{"echo hi > /tmp/x", PolicyAllow},
+		{"cp a /dev/null", PolicyAllow},
+		{"rm -rf $OUT/build", PolicyAllow},
+		{"echo hi > /etc/hosts", PolicyDeny},
+		{"rm -rf .git", PolicyDeny},
+		{"rm -rf /home/me/.ssh", PolicyDeny},
+		{"rm -rf $HOME/.ssh", PolicyDeny},
+		{"echo x > ${HOME}/.bashrc", PolicyDeny},
+		{`chmod 777 "$HOME/.profile"`, PolicyDeny},
+		{"cd /etc && touch x", PolicyDeny},
+		{"touch /srv/x", PolicyConfirm},
+		{"rm -rf $UNSET/x", PolicyConfirm},
+		{"rm -rf $(pwd)/x", PolicyConfirm},
+		{"rm -rf ${OUT:-/}", PolicyConfirm},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			a := Assessment{Local: AnalyzeCommand(NewShellCommand(tt.src))}
+			got := guard.Check(a, "/work")
+			if got.Action != tt.want {
+				t.Errorf("got %s (%s), want %s", got.Action, got.By, tt.want)
+			}
+			if got.Action != PolicyAllow && !strings.HasPrefix(got.By, "the path guard") {
+				t.Errorf("decision by %q", got.By)
+			}
+		})
+	}
+}
+
+func TestGuardedPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		patterns []string
+		want     bool
+	}{
+		{"/etc/hosts", []string{"/etc"}, true},
+		{"/etcetera", []string{"/etc"}, false},
+		{"/work/.git/config", []string{".git"}, true},
+		{"/work/git/config", []string{".git"}, false},
+		{"/work/app/.env", []string{".env"}, true},
+	}
+	for _, tt := range tests {
+		if got := guardedPath(tt.path, tt.patterns); got != tt.want {
+			t.Errorf("guardedPath(%q, %q) = %v, want %v", tt.path, tt.patterns, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// killDelay is how long a command stopped for a limit has to exit after
+// SIGINT before it is killed
+const killDelay = 2 * time.Second
+
+// Limits bounds the resources of one command. A zero field is no limit.
+type Limits struct {
+	Timeout time.Duration `json:"timeout"` // Wall-clock time
+	CPU     time.Duration `json:"cpu"`     // CPU time of each process, in whole seconds
+	Memory  int64         `json:"memory"`  // Address space of each process, in bytes
+	Output  int64         `json:"output"`  // Bytes written to stdout and stderr together
+}
+
+// LimitSettings are limits as configured. Unset fields leave a limit as the
+// layer below set it; zero, or "none" in the `limit` builtin, removes it.
+type LimitSettings struct {
+	Timeout  *time.Duration `yaml:"timeout"`   // Wall-clock time, e.g. "10m"
+	CPU      *time.Duration `yaml:"cpu"`       // CPU time, e.g. "1m"
+	MemoryMB *int           `yaml:"memory_mb"` // Address space, in MiB
+	OutputMB *int           `yaml:"output_mb"` // Output, in MiB
+}
+
+// limitKeys lists the limits accepted by Set, in display order
+var limitKeys = []string{"timeout", "cpu", "memory_mb", "output_mb"}
+
+// Set changes one limit from its string form
+func (s *LimitSettings) Set(key, value string) error {
+	if value == "none" {
+		value = "0"
+	}
+
+	switch key {
+	case "timeout", "cpu":
+		v, err := time.ParseDuration(value)
+		if value == "0" {
+			v, err = 0, nil
+		}
+		if err != nil || v < 0 {
+			return fmt.Errorf("%s must be a duration such as 10m, or none", key)
+		}
+		if key == "timeout" {
+			s.Timeout = &v
+		} else {
+			s.CPU = &v
+		}
+	case "memory_mb", "output_mb":
+		v, err := strconv.Atoi(value)
+		if err != nil || v < 0 {
+			return fmt.Errorf("%s must be a number of MiB, or none", key)
+		}
+		if key == "memory_mb" {
+			s.MemoryMB = &v
+		} else {
+			s.OutputMB = &v
+		}
+	default:
+		return fmt.Errorf("unknown limit %q (expected one of %s)", key, strings.Join(limitKeys, ", "))
+	}
+	return nil
+}
+
+// validate rejects negative limits
+func (s LimitSettings) validate() error {
+	if s.Timeout != nil && *s.Timeout < 0 || s.CPU != nil && *s.CPU < 0 {
+		return errors.New("durations must not be negative")
+	}
+	if s.MemoryMB != nil && *s.MemoryMB < 0 || s.OutputMB != nil && *s.OutputMB < 0 {
+		return errors.New("sizes must not be negative")
+	}
+	return nil
+}
+
+// apply overrides l with the limits s sets
+func (s LimitSettings) apply(l *Limits) {
+	if s.Timeout != nil {
+		l.Timeout = *s.Timeout
+	}
+	if s.CPU != nil {
+		l.CPU = *s.CPU
+	}
+	if s.MemoryMB != nil {
+		l.Memory = int64(*s.MemoryMB) << 20
+	}
+	if s.OutputMB != nil {
+		l.Output = int64(*s.OutputMB) << 20
+	}
+}
+
+// Describe lists the limits s sets, e.g. "timeout 1h0m0s, cpu none"
+func (s LimitSettings) Describe() string {
+	var limits Limits
+	s.apply(&limits)
+	var parts []string
+	if s.Timeout != nil {
+		parts = append(parts, "timeout "+formatDuration(limits.Timeout))
+	}
+	if s.CPU != nil {
+		parts = append(parts, "cpu "+formatDuration(limits.CPU))
+	}
+	if s.MemoryMB != nil {
+		parts = append(parts, "memory_mb "+formatMiB(limits.Memory))
+	}
+	if s.OutputMB != nil {
+		parts = append(parts, "output_mb "+formatMiB(limits.Output))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Limiter works out the limits of each command: those of the config, then
+// those of its mode, then those of the programs it runs, and last those the
+// `limit` builtin set for the next command
+type Limiter struct {
+	config *LimitsConfig
+
+	mu   sync.Mutex
+	next LimitSettings // Overrides for the commands of the next request
+}
+
+// NewLimiter checks the limits in config
+func NewLimiter(config *LimitsConfig) (*Limiter, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	for mode, settings := range config.Modes {
+		if err := settings.validate(); err != nil {
+			return nil, fmt.Errorf("mode %s: %v", mode, err)
+		}
+	}
+	for program, settings := range config.Commands {
+		if err := settings.validate(); err != nil {
+			return nil, fmt.Errorf("command %s: %v", program, err)
+		}
+	}
+	return &Limiter{config: config}, nil
+}
+
+// For returns the limits of cmd run in mode
+func (l *Limiter) For(mode string, cmd Command) Limits {
+	var limits Limits
+	l.config.apply(&limits)
+	l.config.Modes[mode].apply(&limits)
+	for _, c := range AnalyzeCommand(cmd).Commands {
+		l.config.Commands[filepath.Base(c.Name)].apply(&limits)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.next.apply(&limits)
+	return limits
+}
+
+// SetNext overrides one limit for the commands run for the next request
+func (l *Limiter) SetNext(key, value string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.next.Set(key, value)
+}
+
+// ClearNext drops the overrides set for the next request, once it has run
+func (l *Limiter) ClearNext() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.next = LimitSettings{}
+}
+
+// Describe lists the limits of commands in mode, for the `limit` builtin
+func (l *Limiter) Describe(mode string) string {
+	var limits Limits
+	l.config.apply(&limits)
+	l.config.Modes[mode].apply(&limits)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Limits in %s mode:\n", mode)
+	fmt.Fprintf(&b, "  timeout    %s\n", formatDuration(limits.Timeout))
+	fmt.Fprintf(&b, "  cpu        %s\n", formatDuration(limits.CPU))
+	fmt.Fprintf(&b, "  memory_mb  %s\n", formatMiB(limits.Memory))
+	fmt.Fprintf(&b, "  output_mb  %s\n", formatMiB(limits.Output))
+	if len(l.config.Commands) > 0 {
+		programs := make([]string, 0, len(l.config.Commands))
+		for program := range l.config.Commands {
+			programs = append(programs, program)
+		}
+		slices.Sort(programs)
+		fmt.Fprintf(&b, "Command lines running %s have limits of their own.\n", strings.Join(programs, ", "))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if next := l.next.Describe(); next != "" {
+		fmt.Fprintf(&b, "For the next command: %s\n", next)
+	}
+	return b.String()
+}
+
+// formatDuration formats a duration limit, "none" if it is zero
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "none"
+	}
+	return d.String()
+}
+
+// formatMiB formats a size limit in MiB, "none" if it is zero
+func formatMiB(n int64) string {
+	if n == 0 {
+		return "none"
+	}
+	return strconv.FormatInt(n>>20, 10)
+}
+
+// limitCommand wraps command so it runs in a subshell with hard CPU time and
+// address space limits, which neither it nor anything it starts can raise,
+// while the session shell keeps its own. Without those limits command is
+// returned as it is, so that `cd` and `export` in it still persist. The
+// soft CPU limit is a second before the hard one, so the command gets
+// SIGXCPU before it is killed.
+func limitCommand(command string, limits Limits) string {
+	var set []string
+	if limits.CPU > 0 {
+		seconds := cpuSeconds(limits.CPU)
+		set = append(set, fmt.Sprintf("ulimit -S -t %d", seconds), fmt.Sprintf("ulimit -H -t %d", seconds+1))
+	}
+	if limits.Memory > 0 {
+		kib := limits.Memory >> 10
+		set = append(set, fmt.Sprintf("ulimit -S -v %d", kib), fmt.Sprintf("ulimit -H -v %d", kib))
+	}
+	if len(set) == 0 {
+		return command
+	}
+	// The command still sees the status of the one before it in $?
+	return fmt.Sprintf("(__vibesh_last=$?; %s || exit 126; (exit $__vibesh_last); eval %s)",
+		strings.Join(set, " && "), shellQuote(command))
+}
+
+// subshellLosses lists what command does that only lasts when it runs in
+// the session shell itself, as limitCommand's subshell does not: changing
+// directory, setting exported variables or aliases, and starting jobs in
+// the background
+func subshellLosses(command string) []string {
+	file, err := syntax.NewParser().Parse(strings.NewReader(command), "")
+	if err != nil {
+		return nil
+	}
+	var losses []string
+	add := func(what string) {
+		if !slices.Contains(losses, what) {
+			losses = append(losses, what)
+		}
+	}
+	syntax.Walk(file, func(node syntax.Node) bool {
+		switch node := node.(type) {
+		case *syntax.Stmt:
+			if node.Background {
+				add("background jobs")
+			}
+		case *syntax.DeclClause:
+			if node.Variant.Value == "export" || node.Variant.Value == "readonly" {
+				add(node.Variant.Value)
+			}
+		case *syntax.CallExpr:
+			if len(node.Args) == 0 {
+				break
+			}
+			switch name := wordText(node.Args[0]); name {
+			case "cd", "pushd", "popd", "unset", "alias", "unalias":
+				add(name)
+			}
+		}
+		return true
+	})
+	return losses
+}
+
+// cpuSeconds rounds a CPU time limit up to whole seconds, the unit the
+// kernel counts in
+func cpuSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// limitExceeded says which limit stopped a command. It is also the cause a
+// command's context is cancelled with when vibesh stops it.
+type limitExceeded struct {
+	limit  string // Key of the limit, e.g. "timeout"
+	detail string // What happened, for the user and the model
+}
+
+func (e *limitExceeded) Error() string {
+	return e.detail
+}
+
+// outputLimit passes writes on until max bytes have gone through it, across
+// all the writers it wraps, then drops the rest and calls exceeded once
+type outputLimit struct {
+	mu       sync.Mutex
+	written  int64
+	max      int64
+	exceeded func()
+}
+
+// wrap returns a writer to w that counts towards the limit
+func (o *outputLimit) wrap(w io.Writer) io.Writer {
+	return &limitedWriter{limit: o, w: w}
+}
+
+type limitedWriter struct {
+	limit *outputLimit
+	w     io.Writer
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	o := l.limit
+	o.mu.Lock()
+	n := min(int64(len(p)), max(o.max-o.written, 0))
+	over := o.written <= o.max && o.written+int64(len(p)) > o.max
+	o.written += int64(len(p))
+	o.mu.Unlock()
+
+	// The rest is dropped but reported as written, so the command's output
+	// is still read to the end
+	if n > 0 {
+		l.w.Write(p[:n])
+	}
+	if over {
+		o.exceeded()
+	}
+	return len(p), nil
+}
+
+// outOfMemory matches the messages programs commonly fail with when an
+// allocation is refused
+var outOfMemory = regexp.MustCompile(`(?i)cannot allocate memory|out of memory|memory exhausted|MemoryError|bad_alloc|OutOfMemoryError|failed to allocate|memory allocation failed`)
+
+// limitHit works out which limit, if any, stopped a command that ran with
+// limits and exited with status. The timeout and output limits are enforced
+// by vibesh, which cancels ctx with a limitExceeded. The kernel enforces the
+// others: a process over its CPU time gets SIGXCPU, and one over its memory
+// has allocations refused, which can only be told from its output.
+func limitHit(ctx context.Context, limits Limits, status int, output string) *limitExceeded {
+	var exceeded *limitExceeded
+	if errors.As(context.Cause(ctx), &exceeded) {
+		return exceeded
+	}
+	if limits.CPU > 0 && status == 128+int(syscall.SIGXCPU) {
+		return &limitExceeded{limit: "cpu", detail: fmt.Sprintf("the command used more than its CPU time limit of %s", limits.CPU)}
+	}
+	if limits.Memory > 0 && status != 0 && outOfMemory.MatchString(output) {
+		return &limitExceeded{limit: "memory_mb", detail: fmt.Sprintf("the command seems to have run out of its memory limit of %d MiB", limits.Memory>>20)}
+	}
+	return nil
+}
+
+// reportLimit tells the user, and through the result the model, that a
+// limit stopped the command
+func reportLimit(stdio *IO, result *Result, exceeded *limitExceeded) {
+	result.Limit = exceeded.limit
+	fmt.Fprintf(stdio.Stderr, "\n\033[1;33mLimit reached: %s.\033[0m\n", exceeded.detail)
+	note := "vibesh: " + exceeded.detail + "\n"
+	result.Stderr += note
+	result.Output += note
+}
@@ -0,0 +1,23 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// setLimits sets the CPU time and address space limits of the sandboxed
+// command, which it cannot raise. The hard CPU limit is a second later, so
+// the command gets SIGXCPU before it is killed.
+func setLimits(limits Limits) error {
+	if limits.CPU > 0 {
+		seconds := uint64(cpuSeconds(limits.CPU))
+		if err := unix.Setrlimit(unix.RLIMIT_CPU, &unix.Rlimit{Cur: seconds, Max: seconds + 1}); err != nil {
+			return err
+		}
+	}
+	if limits.Memory > 0 {
+		if err := unix.Setrlimit(unix.RLIMIT_AS, &unix.Rlimit{Cur: uint64(limits.Memory), Max: uint64(limits.Memory)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputLimit(t *testing.T) {
+	var out, errOut bytes.Buffer
+	exceeded := 0
+	limit := &outputLimit{max: 10, exceeded: func() { exceeded++ }}
+	stdout, stderr := limit.wrap(&out), limit.wrap(&errOut)
+
+	for _, w := range []struct {
+		w    io.Writer
+		data string
+	}{
+		{stdout, "hello"},
+		{stderr, "wor"},
+		{stdout, "ld and more"},
+		{stderr, "dropped"},
+	} {
+		if n, err := w.w.Write([]byte(w.data)); n != len(w.data) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", w.data, n, err)
+		}
+	}
+	if got := out.String() + errOut.String(); len(got) != 10 {
+		t.Errorf("kept %q, want 10 bytes", got)
+	}
+	if out.String() != "hellold" || errOut.String() != "wor" {
+		t.Errorf("stdout %q, stderr %q", out.String(), errOut.String())
+	}
+	if exceeded != 1 {
+		t.Errorf("exceeded called %d times, want 1", exceeded)
+	}
+}
+
+func TestLimitSettingsSet(t *testing.T) {
+	tests := []struct {
+		key, value string
+		want       Limits
+		err        bool
+	}{
+		{"timeout", "10m", Limits{Timeout: 10 * time.Minute}, false},
+		{"cpu", "none", Limits{}, false},
+		{"memory_mb", "512", Limits{Memory: 512 << 20}, false},
+		{"output_mb", "0", Limits{}, false},
+		{"timeout", "-1s", Limits{}, true},
+		{"memory_mb", "lots", Limits{}, true},
+		{"disk", "1", Limits{}, true},
+	}
+	for _, tt := range tests {
+		var s LimitSettings
+		err := s.Set(tt.key, tt.value)
+		if (err != nil) != tt.err {
+			t.Errorf("Set(%s, %s): error %v", tt.key, tt.value, err)
+			continue
+		}
+		var got Limits
+		s.apply(&got)
+		if got != tt.want {
+			t.Errorf("Set(%s, %s): %+v, want %+v", tt.key, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestLimitCommand(t *testing.T) {
+	if got := limitCommand("cd /tmp", Limits{Timeout: time.Second}); got != "cd /tmp" {
+		t.Errorf("without CPU or memory limits: %q", got)
+	}
+
+	// The limits are hard, so the command cannot raise them, and $? is kept
+	command := limitCommand(`ulimit -S -v unlimited 2>/dev/null; echo "$? $(ulimit -H -t) $(ulimit -H -v)"`,
+		Limits{CPU: 1500 * time.Millisecond, Memory: 256 << 20})
+	out, err := exec.Command("sh", "-c", command).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(out)); !strings.HasSuffix(got, " 3 262144") || strings.HasPrefix(got, "0 ") {
+		t.Errorf("got %q, want the raise to fail and limits 3 and 262144", got)
+	}
+
+	out, err = exec.Command("sh", "-c", "false; "+limitCommand("echo $?", Limits{CPU: time.Second})).Output()
+	if err != nil || strings.TrimSpace(string(out)) != "1" {
+		t.Errorf("$? in the command: %q, %v", out, err)
+	}
+}
+
+func TestSubshellLosses(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"make -j8", nil},
+		{"cd build && make", []string{"cd"}},
+		{"export CC=clang; make", []string{"export"}},
+		{"sleep 60 & cd /tmp; cd -", []string{"background jobs", "cd"}},
+		{"(cd /tmp && ls)", []string{"cd"}},
+		{"alias ll='ls -l'; unset FOO", []string{"alias", "unset"}},
+		{"echo cd export", nil},
+		{"if then", nil},
+	}
+	for _, tt := range tests {
+		if got := subshellLosses(tt.command); !slices.Equal(got, tt.want) {
+			t.Errorf("subshellLosses(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestSessionNotesSubshell(t *testing.T) {
+	session, err := NewSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	var errOut bytes.Buffer
+	limits := Limits{CPU: time.Minute}
+	for _, command := range []string{"true", "cd /", "cd /tmp"} {
+		if _, err := session.Run(context.Background(), command, limits, io.Discard, &errOut); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := strings.Count(errOut.String(), "Note:"); n != 1 || !strings.Contains(errOut.String(), "so cd in them") {
+		t.Errorf("want one note about cd, got %q", errOut.String())
+	}
+}
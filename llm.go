@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrNoAPIKey is returned when a provider that needs a key has none
+var ErrNoAPIKey = errors.New("API key not set")
+
+// ChatMessage is one message of a conversation with a model
+type ChatMessage struct {
+	Role       string // "system", "user", "assistant" or "tool"
+	Content    string
+	ToolCalls  []ToolCall // Tools called by an assistant message
+	ToolCallID string     // For tool messages, the call this is the result of
+}
+
+// Chat message roles
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+	RoleTool      = "tool"
+)
+
+// ToolSpec describes a tool the model can call, with its parameters given
+// as a JSON schema. Strict schemas must list every property as required and
+// disallow additional properties, so providers can enforce them exactly.
+type ToolSpec struct {
+	Name        string
+	Description string
+	Parameters  map[string]interface{}
+	Strict      bool
+}
+
+// ToolChoiceAny requires the model to call one of the tools, whichever it likes
+const ToolChoiceAny = "*"
+
+// ToolCall is one call of a tool by the model
+type ToolCall struct {
+	ID        string
+	Name      string
+	Arguments string // JSON object of arguments
+}
+
+// ChatRequest is a provider-neutral chat completion request
+type ChatRequest struct {
+	Messages   []ChatMessage
+	Tools      []ToolSpec
+	ToolChoice string        // Name of the tool the model must call, ToolChoiceAny, or empty to let it choose
+	Settings   ModelSettings // Model and sampling options; zero values use the provider's defaults
+}
+
+// ChatResponse is a provider-neutral chat completion response
+type ChatResponse struct {
+	Content   string     // Plain text reply, if any
+	ToolCalls []ToolCall // Tools the model called, if any
+}
+
+// Message returns the response as an assistant message for the transcript
+func (r *ChatResponse) Message() ChatMessage {
+	return ChatMessage{Role: RoleAssistant, Content: r.Content, ToolCalls: r.ToolCalls}
+}
+
+// Provider is a model backend that can complete a chat
+type Provider interface {
+	// Name returns the provider's name from the config, for messages
+	Name() string
+	// Model returns the model used when the request does not name one
+	Model() string
+	Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error)
+}
+
+// NewProvider creates the provider described by cfg
+func NewProvider(name string, cfg ProviderConfig) (Provider, error) {
+	var provider Provider
+	var err error
+	switch cfg.Type {
+	case "", "openai":
+		provider, err = newOpenAIProvider(name, cfg)
+	case "anthropic":
+		provider, err = newAnthropicProvider(name, cfg)
+	case "ollama":
+		provider, err = newOllamaProvider(name, cfg)
+	default:
+		return nil, fmt.Errorf("provider %s: unknown type %q", name, cfg.Type)
+	}
+	// Avoid returning a typed nil inside a non-nil interface
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// postJSON sends body as JSON to url and decodes the JSON response into out
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// anthropicVersion is the Messages API version vibesh is written against
+const anthropicVersion = "2023-06-01"
+
+// anthropicProvider talks to Anthropic's Messages API
+type anthropicProvider struct {
+	name       string
+	client     *http.Client
+	baseURL    string
+	apiKey     string
+	authHeader string
+	model      string
+}
+
+func newAnthropicProvider(name string, cfg ProviderConfig) (*anthropicProvider, error) {
+	apiKey := cfg.apiKey()
+	if apiKey == "" {
+		return nil, ErrNoAPIKey
+	}
+
+	p := &anthropicProvider{
+		name:       name,
+		client:     &http.Client{},
+		baseURL:    "https://api.anthropic.com",
+		apiKey:     apiKey,
+		authHeader: "x-api-key",
+		model:      "claude-3-5-haiku-latest",
+	}
+	if cfg.BaseURL != "" {
+		p.baseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	}
+	if cfg.AuthHeader != "" {
+		p.authHeader = cfg.AuthHeader
+	}
+	if cfg.Model != "" {
+		p.model = cfg.Model
+	}
+	return p, nil
+}
+
+func (p *anthropicProvider) Name() string {
+	return p.name
+}
+
+func (p *anthropicProvider) Model() string {
+	return p.model
+}
+
+// anthropicMessage carries either a plain string or a list of content
+// blocks, which tool calls and their results require
+type anthropicMessage struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+}
+
+type anthropicBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   string          `json:"content,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"input_schema"`
+}
+
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	MaxTokens   int                `json:"max_tokens"`
+	Temperature *float32           `json:"temperature,omitempty"`
+	TopP        *float32           `json:"top_p,omitempty"`
+	System      string             `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	Tools       []anthropicTool    `json:"tools,omitempty"`
+	ToolChoice  interface{}        `json:"tool_choice,omitempty"`
+}
+
+type anthropicResponse struct {
+	Content []anthropicBlock `json:"content"`
+}
+
+func (p *anthropicProvider) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	// The Messages API requires max_tokens and has no seed parameter
+	request := anthropicRequest{
+		Model:       p.model,
+		MaxTokens:   1024,
+		Temperature: req.Settings.Temperature,
+		TopP:        req.Settings.TopP,
+	}
+	if req.Settings.Name != "" {
+		request.Model = req.Settings.Name
+	}
+	if req.Settings.MaxTokens > 0 {
+		request.MaxTokens = req.Settings.MaxTokens
+	}
+
+	// System prompts are a separate field rather than messages
+	var system []string
+	for _, msg := range req.Messages {
+		switch {
+		case msg.Role == RoleSystem:
+			system = append(system, msg.Content)
+		case msg.Role == RoleTool:
+			// Tool results are sent back as user messages
+			request.Messages = append(request.Messages, anthropicMessage{
+				Role: RoleUser,
+				Content: []anthropicBlock{{
+					Type:      "tool_result",
+					ToolUseID: msg.ToolCallID,
+					Content:   msg.Content,
+				}},
+			})
+		case len(msg.ToolCalls) > 0:
+			var blocks []anthropicBlock
+			if msg.Content != "" {
+				blocks = append(blocks, anthropicBlock{Type: "text", Text: msg.Content})
+			}
+			for _, call := range msg.ToolCalls {
+				input := json.RawMessage(call.Arguments)
+				if !json.Valid(input) {
+					input = json.RawMessage("{}")
+				}
+				blocks = append(blocks, anthropicBlock{Type: "tool_use", ID: call.ID, Name: call.Name, Input: input})
+			}
+			request.Messages = append(request.Messages, anthropicMessage{Role: msg.Role, Content: blocks})
+		default:
+			request.Messages = append(request.Messages, anthropicMessage{Role: msg.Role, Content: msg.Content})
+		}
+	}
+	request.System = strings.Join(system, "\n\n")
+
+	// Anthropic has no strict mode; schemas are followed but not enforced
+	for _, tool := range req.Tools {
+		request.Tools = append(request.Tools, anthropicTool{
+			Name:        tool.Name,
+			Description: tool.Description,
+			InputSchema: tool.Parameters,
+		})
+	}
+	if req.ToolChoice == ToolChoiceAny {
+		request.ToolChoice = map[string]string{"type": "any"}
+	} else if req.ToolChoice != "" {
+		request.ToolChoice = map[string]string{"type": "tool", "name": req.ToolChoice}
+	}
+
+	headers := map[string]string{
+		p.authHeader:        p.apiKey,
+		"anthropic-version": anthropicVersion,
+	}
+
+	var resp anthropicResponse
+	if err := postJSON(ctx, p.client, p.baseURL+"/v1/messages", headers, request, &resp); err != nil {
+		return nil, err
+	}
+
+	response := &ChatResponse{}
+	for _, block := range resp.Content {
+		switch block.Type {
+		case "text":
+			response.Content += block.Text
+		case "tool_use":
+			response.ToolCalls = append(response.ToolCalls, ToolCall{
+				ID:        block.ID,
+				Name:      block.Name,
+				Arguments: string(block.Input),
+			})
+		}
+	}
+	return response, nil
+}
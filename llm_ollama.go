@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ollamaProvider talks to Ollama's native /api/chat endpoint
+type ollamaProvider struct {
+	name    string
+	client  *http.Client
+	baseURL string
+	headers map[string]string
+	model   string
+}
+
+func newOllamaProvider(name string, cfg ProviderConfig) (*ollamaProvider, error) {
+	p := &ollamaProvider{
+		name:    name,
+		client:  &http.Client{},
+		baseURL: "http://localhost:11434",
+		headers: map[string]string{},
+		model:   "llama3.1",
+	}
+	if cfg.BaseURL != "" {
+		p.baseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	}
+	if cfg.Model != "" {
+		p.model = cfg.Model
+	}
+
+	// Ollama itself has no auth, but it is often run behind a proxy that does
+	if apiKey := cfg.apiKey(); apiKey != "" {
+		if cfg.AuthHeader != "" {
+			p.headers[cfg.AuthHeader] = apiKey
+		} else {
+			p.headers["Authorization"] = "Bearer " + apiKey
+		}
+	}
+	return p, nil
+}
+
+func (p *ollamaProvider) Name() string {
+	return p.name
+}
+
+func (p *ollamaProvider) Model() string {
+	return p.model
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string                 `json:"name"`
+		Description string                 `json:"description"`
+		Parameters  map[string]interface{} `json:"parameters"`
+	} `json:"function"`
+}
+
+type ollamaRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Tools    []ollamaTool    `json:"tools,omitempty"`
+	Stream   bool            `json:"stream"`
+	Format   interface{}     `json:"format,omitempty"`
+	Options  ollamaOptions   `json:"options"`
+}
+
+type ollamaOptions struct {
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        *float32 `json:"top_p,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"`
+}
+
+type ollamaResponse struct {
+	Message ollamaMessage `json:"message"`
+}
+
+func (p *ollamaProvider) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	request := ollamaRequest{
+		Model:  p.model,
+		Stream: false,
+		Options: ollamaOptions{
+			Temperature: req.Settings.Temperature,
+			TopP:        req.Settings.TopP,
+			Seed:        req.Settings.Seed,
+			NumPredict:  req.Settings.MaxTokens,
+		},
+	}
+	if req.Settings.Name != "" {
+		request.Model = req.Settings.Name
+	}
+
+	// Ollama cannot force a tool call, but structured outputs constrain the
+	// reply to the tool's parameter schema, which amounts to the same.
+	// Otherwise the tools are offered natively.
+	var forced *ToolSpec
+	for i := range req.Tools {
+		if req.Tools[i].Name == req.ToolChoice {
+			forced = &req.Tools[i]
+			request.Format = forced.Parameters
+		}
+	}
+	if forced == nil {
+		for _, spec := range req.Tools {
+			var tool ollamaTool
+			tool.Type = "function"
+			tool.Function.Name = spec.Name
+			tool.Function.Description = spec.Description
+			tool.Function.Parameters = spec.Parameters
+			request.Tools = append(request.Tools, tool)
+		}
+	}
+
+	for _, msg := range req.Messages {
+		message := ollamaMessage{Role: msg.Role, Content: msg.Content}
+		for _, call := range msg.ToolCalls {
+			// With structured outputs the model answers with the arguments as
+			// its content, so earlier calls are replayed the same way
+			if forced != nil {
+				message.Content = call.Arguments
+				break
+			}
+			var toolCall ollamaToolCall
+			toolCall.Function.Name = call.Name
+			toolCall.Function.Arguments = json.RawMessage(call.Arguments)
+			if !json.Valid(toolCall.Function.Arguments) {
+				toolCall.Function.Arguments = json.RawMessage("{}")
+			}
+			message.ToolCalls = append(message.ToolCalls, toolCall)
+		}
+		request.Messages = append(request.Messages, message)
+	}
+
+	var resp ollamaResponse
+	if err := postJSON(ctx, p.client, p.baseURL+"/api/chat", p.headers, request, &resp); err != nil {
+		return nil, err
+	}
+
+	if forced != nil {
+		return &ChatResponse{ToolCalls: []ToolCall{{
+			ID:        "call_" + forced.Name,
+			Name:      forced.Name,
+			Arguments: resp.Message.Content,
+		}}}, nil
+	}
+
+	// Ollama does not identify tool calls, so they are numbered here
+	response := &ChatResponse{Content: resp.Message.Content}
+	for i, call := range resp.Message.ToolCalls {
+		response.ToolCalls = append(response.ToolCalls, ToolCall{
+			ID:        fmt.Sprintf("call_%d", i),
+			Name:      call.Function.Name,
+			Arguments: string(call.Function.Arguments),
+		})
+	}
+	return response, nil
+}
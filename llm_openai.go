@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// openAIProvider talks to OpenAI or any OpenAI-compatible server such as
+// vLLM, llama.cpp server or Ollama's /v1 endpoint
+type openAIProvider struct {
+	name   string
+	client *openai.Client
+	model  string
+}
+
+func newOpenAIProvider(name string, cfg ProviderConfig) (*openAIProvider, error) {
+	apiKey := cfg.apiKey()
+	// Local servers usually need no key, but OpenAI itself always does
+	if apiKey == "" && cfg.BaseURL == "" {
+		return nil, ErrNoAPIKey
+	}
+
+	config := openai.DefaultConfig(apiKey)
+	if cfg.BaseURL != "" {
+		config.BaseURL = cfg.BaseURL
+	}
+	if cfg.Organization != "" {
+		config.OrgID = cfg.Organization
+	}
+	if cfg.AuthHeader != "" {
+		config.HTTPClient = &http.Client{
+			Transport: &authHeaderTransport{header: cfg.AuthHeader, value: apiKey},
+		}
+	}
+
+	model := cfg.Model
+	if model == "" {
+		model = openai.GPT4oMini
+	}
+
+	return &openAIProvider{
+		name:   name,
+		client: openai.NewClientWithConfig(config),
+		model:  model,
+	}, nil
+}
+
+func (p *openAIProvider) Name() string {
+	return p.name
+}
+
+func (p *openAIProvider) Model() string {
+	return p.model
+}
+
+func (p *openAIProvider) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	var messages []openai.ChatCompletionMessage
+	for _, msg := range req.Messages {
+		message := openai.ChatCompletionMessage{
+			Role:       msg.Role,
+			Content:    msg.Content,
+			ToolCallID: msg.ToolCallID,
+		}
+		for _, call := range msg.ToolCalls {
+			message.ToolCalls = append(message.ToolCalls, openai.ToolCall{
+				ID:   call.ID,
+				Type: openai.ToolTypeFunction,
+				Function: openai.FunctionCall{
+					Name:      call.Name,
+					Arguments: call.Arguments,
+				},
+			})
+		}
+		messages = append(messages, message)
+	}
+
+	request := openai.ChatCompletionRequest{
+		Model:     p.model,
+		Messages:  messages,
+		MaxTokens: req.Settings.MaxTokens,
+		Seed:      req.Settings.Seed,
+	}
+	if req.Settings.Name != "" {
+		request.Model = req.Settings.Name
+	}
+	if req.Settings.Temperature != nil {
+		request.Temperature = sendableFloat(*req.Settings.Temperature)
+	}
+	if req.Settings.TopP != nil {
+		request.TopP = sendableFloat(*req.Settings.TopP)
+	}
+	for _, tool := range req.Tools {
+		request.Tools = append(request.Tools, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+				Strict:      tool.Strict,
+			},
+		})
+	}
+	if req.ToolChoice == ToolChoiceAny {
+		request.ToolChoice = "required"
+	} else if req.ToolChoice != "" {
+		request.ToolChoice = openai.ToolChoice{
+			Type:     openai.ToolTypeFunction,
+			Function: openai.ToolFunction{Name: req.ToolChoice},
+		}
+	}
+
+	resp, err := p.client.CreateChatCompletion(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, errors.New("response contained no choices")
+	}
+
+	message := resp.Choices[0].Message
+	response := &ChatResponse{Content: message.Content}
+	for _, call := range message.ToolCalls {
+		response.ToolCalls = append(response.ToolCalls, ToolCall{
+			ID:        call.ID,
+			Name:      call.Function.Name,
+			Arguments: call.Function.Arguments,
+		})
+	}
+	return response, nil
+}
+
+// authHeaderTransport sends the API key in a custom header instead of the
+// usual "Authorization: Bearer" one
+type authHeaderTransport struct {
+	header string
+	value  string
+}
+
+func (t *authHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Del("Authorization")
+	req.Header.Set(t.header, t.value)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// sendableFloat keeps a setting of 0 from being dropped: the client omits
+// zero values, so the server would use its default instead. The smallest
+// float above zero is what the client's documentation suggests sending.
+func sendableFloat(v float32) float32 {
+	if v == 0 {
+		return math.SmallestNonzeroFloat32
+	}
+	return v
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// chatServer answers every request with reply and keeps the last request
+type chatServer struct {
+	*httptest.Server
+	path    string
+	header  http.Header
+	request []byte
+}
+
+func newChatServer(t *testing.T, status int, reply string) *chatServer {
+	t.Helper()
+	s := &chatServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.path = r.URL.Path
+		s.header = r.Header
+		s.request, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+		io.WriteString(w, reply)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// assertJSON fails unless got and want hold the same JSON value
+func assertJSON(t *testing.T, what string, got []byte, want string) {
+	t.Helper()
+	var gotValue, wantValue interface{}
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatalf("%s: %v in %s", what, err, got)
+	}
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Fatalf("%s: %v in the expected value", what, err)
+	}
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("%s:\n got %s\nwant %s", what, got, want)
+	}
+}
+
+// testConversation has a system prompt, a tool call with its result and a
+// follow-up, with the tool forced or not as choice says
+func testConversation(choice string) ChatRequest {
+	temperature := float32(0.5)
+	seed := 7
+	return ChatRequest{
+		Messages: []ChatMessage{
+			{Role: RoleSystem, Content: "Be brief."},
+			{Role: RoleUser, Content: "list files"},
+			{Role: RoleAssistant, Content: "Listing", ToolCalls: []ToolCall{{ID: "call_1", Name: "run", Arguments: `{"cmd":["ls"]}`}}},
+			{Role: RoleTool, Content: `{"exit_code":0}`, ToolCallID: "call_1"},
+			{Role: RoleUser, Content: "and hidden ones"},
+		},
+		Tools:      []ToolSpec{{Name: "run", Description: "Run a command", Parameters: map[string]interface{}{"type": "object"}}},
+		ToolChoice: choice,
+		Settings:   ModelSettings{Name: "big", Temperature: &temperature, Seed: &seed, MaxTokens: 200},
+	}
+}
+
+func TestAnthropicChat(t *testing.T) {
+	server := newChatServer(t, http.StatusOK,
+		`{"content":[{"type":"text","text":"Listing all"},{"type":"tool_use","id":"toolu_1","name":"run","input":{"cmd":["ls","-a"]}}]}`)
+	provider, err := NewProvider("claude", ProviderConfig{Type: "anthropic", BaseURL: server.URL + "/", APIKey: "sk-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := provider.Chat(context.Background(), testConversation("run"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.path != "/v1/messages" || server.header.Get("x-api-key") != "sk-test" || server.header.Get("anthropic-version") != anthropicVersion {
+		t.Errorf("sent to %s with headers %v", server.path, server.header)
+	}
+	assertJSON(t, "request", server.request, `{
+		"model": "big",
+		"max_tokens": 200,
+		"temperature": 0.5,
+		"system": "Be brief.",
+		"messages": [
+			{"role": "user", "content": "list files"},
+			{"role": "assistant", "content": [
+				{"type": "text", "text": "Listing"},
+				{"type": "tool_use", "id": "call_1", "name": "run", "input": {"cmd": ["ls"]}}
+			]},
+			{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "call_1", "content": "{\"exit_code\":0}"}]},
+			{"role": "user", "content": "and hidden ones"}
+		],
+		"tools": [{"name": "run", "description": "Run a command", "input_schema": {"type": "object"}}],
+		"tool_choice": {"type": "tool", "name": "run"}
+	}`)
+	want := &ChatResponse{Content: "Listing all", ToolCalls: []ToolCall{{ID: "toolu_1", Name: "run", Arguments: `{"cmd":["ls","-a"]}`}}}
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("response %+v, want %+v", resp, want)
+	}
+
+	// Defaults, another auth header and any tool
+	provider, _ = NewProvider("claude", ProviderConfig{Type: "anthropic", BaseURL: server.URL, APIKey: "sk-test", AuthHeader: "Authorization"})
+	req := ChatRequest{
+		Messages:   []ChatMessage{{Role: RoleAssistant, ToolCalls: []ToolCall{{ID: "1", Name: "run", Arguments: "not json"}}}},
+		Tools:      testConversation("").Tools,
+		ToolChoice: ToolChoiceAny,
+	}
+	if _, err := provider.Chat(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if server.header.Get("Authorization") != "sk-test" || server.header.Get("x-api-key") != "" {
+		t.Errorf("headers %v", server.header)
+	}
+	assertJSON(t, "request with defaults", server.request, `{
+		"model": "claude-3-5-haiku-latest",
+		"max_tokens": 1024,
+		"messages": [{"role": "assistant", "content": [{"type": "tool_use", "id": "1", "name": "run", "input": {}}]}],
+		"tools": [{"name": "run", "description": "Run a command", "input_schema": {"type": "object"}}],
+		"tool_choice": {"type": "any"}
+	}`)
+
+	if _, err := NewProvider("claude", ProviderConfig{Type: "anthropic", APIKeyEnv: "VIBESH_TEST_UNSET_KEY"}); err != ErrNoAPIKey {
+		t.Errorf("without a key: %v", err)
+	}
+}
+
+func TestOllamaChat(t *testing.T) {
+	// A forced tool is asked for with structured outputs
+	server := newChatServer(t, http.StatusOK, `{"message":{"role":"assistant","content":"{\"cmd\":[\"ls\",\"-a\"]}"}}`)
+	provider, err := NewProvider("local", ProviderConfig{Type: "ollama", BaseURL: server.URL, APIKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := provider.Chat(context.Background(), testConversation("run"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.path != "/api/chat" || server.header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("sent to %s with headers %v", server.path, server.header)
+	}
+	assertJSON(t, "forced request", server.request, `{
+		"model": "big",
+		"stream": false,
+		"format": {"type": "object"},
+		"options": {"temperature": 0.5, "seed": 7, "num_predict": 200},
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": "list files"},
+			{"role": "assistant", "content": "{\"cmd\":[\"ls\"]}"},
+			{"role": "tool", "content": "{\"exit_code\":0}"},
+			{"role": "user", "content": "and hidden ones"}
+		]
+	}`)
+	want := &ChatResponse{ToolCalls: []ToolCall{{ID: "call_run", Name: "run", Arguments: `{"cmd":["ls","-a"]}`}}}
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("forced response %+v, want %+v", resp, want)
+	}
+
+	// Otherwise the tools are offered natively
+	server = newChatServer(t, http.StatusOK,
+		`{"message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"run","arguments":{"cmd":["pwd"]}}}]}}`)
+	provider, _ = NewProvider("local", ProviderConfig{Type: "ollama", BaseURL: server.URL})
+	req := testConversation("")
+	req.Settings = ModelSettings{}
+	resp, err = provider.Chat(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.header.Get("Authorization") != "" {
+		t.Errorf("headers %v", server.header)
+	}
+	assertJSON(t, "request", server.request, `{
+		"model": "llama3.1",
+		"stream": false,
+		"options": {},
+		"tools": [{"type": "function", "function": {"name": "run", "description": "Run a command", "parameters": {"type": "object"}}}],
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": "list files"},
+			{"role": "assistant", "content": "Listing", "tool_calls": [{"function": {"name": "run", "arguments": {"cmd": ["ls"]}}}]},
+			{"role": "tool", "content": "{\"exit_code\":0}"},
+			{"role": "user", "content": "and hidden ones"}
+		]
+	}`)
+	want = &ChatResponse{ToolCalls: []ToolCall{{ID: "call_0", Name: "run", Arguments: `{"cmd":["pwd"]}`}}}
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("response %+v, want %+v", resp, want)
+	}
+}
+
+func TestChatErrorStatus(t *testing.T) {
+	server := newChatServer(t, http.StatusTooManyRequests, "slow down\n")
+	provider, _ := NewProvider("local", ProviderConfig{Type: "ollama", BaseURL: server.URL})
+	_, err := provider.Chat(context.Background(), ChatRequest{Messages: []ChatMessage{{Role: RoleUser, Content: "hi"}}})
+	if err == nil || !strings.Contains(err.Error(), "429") || !strings.HasSuffix(err.Error(), "slow down") {
+		t.Errorf("error %v", err)
+	}
+}
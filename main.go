@@ -3,35 +3,61 @@ package main
 import (
 	"bufio"
 	"context"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
-	"time"
 
-	"github.com/sashabaranov/go-openai"
+	"golang.org/x/term"
 )
 
-// CommandProcessor handles different ways of processing commands
+// CommandProcessor handles different ways of processing commands. Output is
+// streamed to stdio while the command runs; the returned Result keeps a
+// bounded copy of it.
 type CommandProcessor interface {
-	Process(command string, history []string) (string, error)
+	Process(ctx context.Context, command string, history []Turn, stdio *IO) (*Result, error)
 }
 
 // DirectShellProcessor executes commands directly in the shell
-type DirectShellProcessor struct{}
+type DirectShellProcessor struct {
+	assessor  *RiskAssessor
+	policy    *Policy
+	confirmer *Confirmer
+	sandbox   *Sandbox
+	session   *Session
+	audit     *AuditLog
+}
+
+func NewDirectShellProcessor(assessor *RiskAssessor, policy *Policy, confirmer *Confirmer, sandbox *Sandbox, session *Session, audit *AuditLog) *DirectShellProcessor {
+	return &DirectShellProcessor{assessor: assessor, policy: policy, confirmer: confirmer, sandbox: sandbox, session: session, audit: audit}
+}
 
-func (p *DirectShellProcessor) Process(command string, history []string) (string, error) {
-	cmd := exec.Command("sh", "-c", command)
-	output, err := cmd.CombinedOutput()
-	return string(output), err
+func (p *DirectShellProcessor) Process(ctx context.Context, command string, history []Turn, stdio *IO) (*Result, error) {
+	// Typed commands are only checked if the policy has rules for direct mode
+	audit := p.audit.Request("direct", command, "", nil)
+	confirmation := &Confirmation{Mode: "direct", Cmd: NewShellCommand(command), Answer: AuditAllowed}
+	if p.policy.Covers("direct") {
+		confirmation.Assessment = p.assessor.AssessLocal(confirmation.Cmd)
+		confirmation.Decision = p.policy.Decide("direct", confirmation.Assessment, sessionDir(p.session))
+		if confirmation.Decision.Mandatory() && !p.confirmer.Confirm(ctx, stdio, confirmation) {
+			audit.Confirmed(AIResponse{Shell: command}, confirmation, nil)
+			return &Result{}, nil
+		}
+	}
+	result, err := p.sandbox.Execute(ctx, "direct", confirmation.Assessment, NewShellCommand(confirmation.Cmd.Source()), stdio)
+	audit.Confirmed(AIResponse{Shell: command}, confirmation, result)
+	return result, err
 }
 
-// AIResponse represents the structured response from the AI
+// AIResponse represents one command proposed by the AI, a step of an AIPlan
 type AIResponse struct {
 	Reply     string   `json:"reply"`      // Friendly explanation of what the command will do
-	Cmd       []string `json:"cmd"`        // Array of command and arguments
+	Cmd       []string `json:"cmd"`        // Array of command and arguments, run without a shell
+	Shell     string   `json:"shell"`      // Shell source when a pipeline or redirection is needed, instead of Cmd
 	RiskScore int      `json:"risk_score"` // Risk score from 0-10
 	DoesRead  bool     `json:"does_read"`  // Whether the command reads from disk
 	DoesWrite bool     `json:"does_write"` // Whether the command writes to disk
@@ -39,229 +65,182 @@ type AIResponse struct {
 
 // AIProcessor represents a processor that uses AI to interpret commands
 type AIProcessor struct {
-	client *openai.Client
-	yolo   bool // Whether to execute commands without confirmation
+	provider       Provider       // Model backend, nil if none is configured
+	settings       *ModelSettings // Shared with the `model` builtin, which changes it at runtime
+	contextManager *ContextManager
+	assessor       *RiskAssessor
+	policy         *Policy
+	confirmer      *Confirmer
+	dryRun         *DryRun
+	sandbox        *Sandbox
+	session        *Session
+	audit          *AuditLog
+	mode           string // Mode the policy is applied for
+	yolo           bool   // Whether to execute commands without confirmation
 }
 
-func NewAIProcessor(apiKey string) *AIProcessor {
+func NewAIProcessor(provider Provider, settings *ModelSettings, contextManager *ContextManager, assessor *RiskAssessor, policy *Policy, confirmer *Confirmer, dryRun *DryRun, sandbox *Sandbox, session *Session, audit *AuditLog) *AIProcessor {
 	return &AIProcessor{
-		client: openai.NewClient(apiKey),
-		yolo:   false,
+		provider:       provider,
+		settings:       settings,
+		contextManager: contextManager,
+		assessor:       assessor,
+		policy:         policy,
+		confirmer:      confirmer,
+		dryRun:         dryRun,
+		sandbox:        sandbox,
+		session:        session,
+		audit:          audit,
+		mode:           "ai",
+		yolo:           false,
 	}
 }
 
 // NewAIYoloProcessor creates an AI processor that executes commands without confirmation
-func NewAIYoloProcessor(apiKey string) *AIProcessor {
+func NewAIYoloProcessor(provider Provider, settings *ModelSettings, contextManager *ContextManager, assessor *RiskAssessor, policy *Policy, confirmer *Confirmer, dryRun *DryRun, sandbox *Sandbox, session *Session, audit *AuditLog) *AIProcessor {
 	return &AIProcessor{
-		client: openai.NewClient(apiKey),
-		yolo:   true,
+		provider:       provider,
+		settings:       settings,
+		contextManager: contextManager,
+		assessor:       assessor,
+		policy:         policy,
+		confirmer:      confirmer,
+		dryRun:         dryRun,
+		sandbox:        sandbox,
+		session:        session,
+		audit:          audit,
+		mode:           "ai-yolo",
+		yolo:           true,
 	}
 }
 
-func (p *AIProcessor) Process(command string, history []string) (string, error) {
-	// Skip AI processing if the client is nil (no API key)
-	if p.client == nil {
-		return "[AI] API key not set. Please set OPENAI_API_KEY environment variable.", nil
-	}
-
-	// Create a context message history from the command history
-	var messages []openai.ChatCompletionMessage
-
-	// Get directory context
-	dirContext := getDirectoryContext()
-
-	// System message describing what we want - updated to prompt for JSON
-	systemPrompt := `You are ShellAI, an AI-powered natural-language shell assistant. When the user gives an instruction, you **do not** execute anything yourself. Instead:
+// aiSystemPrompt describes what we want - updated to prompt for JSON
+const aiSystemPrompt = `You are ShellAI, an AI-powered natural-language shell assistant. When the user gives an instruction, you **do not** execute anything yourself. Instead:
 
 1. Interpret the user's intent.
-2. Determine the single most appropriate shell command (as an executable plus arguments) to fulfill it.
-3. Evaluate:
+2. Determine the most appropriate shell command (as an executable plus arguments) to fulfill it. The arguments are passed to the executable exactly as given, with no shell quoting, globbing or expansion. Only if a command genuinely needs the shell (a pipeline, redirection, glob or variable), give shell source in "shell" instead and leave "cmd" empty.
+3. If the request needs several commands, break it into ordered steps rather than joining commands with "&&". Steps run one after another in the same shell and stop at the first failure. Use a single step when one command is enough.
+4. Evaluate for each step:
    - **risk_score**: integer 0–10 based on potential data loss or system impact
    - **does_read**: true if the command reads files or system state
    - **does_write**: true if it creates, modifies, or deletes files or data
-4. Respond **only** with a JSON object in this exact schema (no extra fields, no comments, no prose outside the JSON):
+5. Respond **only** by calling the generate_shell_plan tool with arguments in this exact schema (no extra fields):
 
 {
-  "reply": "string",         // One friendly sentence of what you will do
-  "cmd": ["string", "..."],  // Array: ["executable", "arg1", "arg2", …]
-  "risk_score": number,      // 0 (no risk) to 10 (extremely risky)
-  "does_read": boolean,      // true if it reads from disk, network, etc.
-  "does_write": boolean      // true if it writes/modifies/deletes data
+  "reply": "string",           // One friendly sentence of what you will do
+  "steps": [
+    {
+      "reply": "string",         // One friendly sentence of what this step does
+      "cmd": ["string", "..."],  // Array: ["executable", "arg1", "arg2", …], or [] when using "shell"
+      "shell": "string",         // Shell source when the shell is needed, otherwise ""
+      "risk_score": number,      // 0 (no risk) to 10 (extremely risky)
+      "does_read": boolean,      // true if it reads from disk, network, etc.
+      "does_write": boolean      // true if it writes/modifies/deletes data
+    }
+  ]
 }`
 
-	messages = append(messages, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleSystem,
-		Content: systemPrompt,
-	})
-
-	// Add directory context
-	messages = append(messages, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleSystem,
-		Content: "Directory context:\n" + dirContext,
-	})
-
-	// Add history for context
-	for _, cmd := range history {
-		messages = append(messages, openai.ChatCompletionMessage{
-			Role:    openai.ChatMessageRoleUser,
-			Content: cmd,
-		})
+func (p *AIProcessor) Process(ctx context.Context, command string, history []Turn, stdio *IO) (*Result, error) {
+	// Skip AI processing if there is no provider (e.g. no API key)
+	if p.provider == nil {
+		fmt.Fprintln(stdio.Stdout, "[AI] API key not set. Please set OPENAI_API_KEY environment variable or configure a provider.")
+		return &Result{}, nil
 	}
 
-	// Add the current command
-	messages = append(messages, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleUser,
-		Content: command,
-	})
-
-	// Setup JSON response format with function calling
-	functions := []openai.FunctionDefinition{
-		{
-			Name:        "generate_shell_command",
-			Description: "Generate a shell command based on user input",
-			Parameters: map[string]interface{}{
-				"type": "object",
-				"properties": map[string]interface{}{
-					"reply": map[string]interface{}{
-						"type":        "string",
-						"description": "One friendly sentence of what you will do",
-					},
-					"cmd": map[string]interface{}{
-						"type":        "array",
-						"description": "Array: [\"executable\", \"arg1\", \"arg2\", …]",
-						"items": map[string]interface{}{
-							"type": "string",
-						},
-					},
-					"risk_score": map[string]interface{}{
-						"type":        "integer",
-						"description": "0 (no risk) to 10 (extremely risky)",
-						"minimum":     0,
-						"maximum":     10,
-					},
-					"does_read": map[string]interface{}{
-						"type":        "boolean",
-						"description": "true if it reads from disk, network, etc.",
-					},
-					"does_write": map[string]interface{}{
-						"type":        "boolean",
-						"description": "true if it writes/modifies/deletes data",
-					},
-				},
-				"required": []string{"reply", "cmd", "risk_score", "does_read", "does_write"},
-			},
-		},
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	resp, err := p.client.CreateChatCompletion(
-		ctx,
-		openai.ChatCompletionRequest{
-			Model:       openai.GPT3Dot5Turbo,
-			Messages:    messages,
-			Functions:   functions,
-			FunctionCall: openai.FunctionCall{
-				Name: "generate_shell_command",
-			},
-		},
-	)
+	model := p.settings.ModelFor(p.provider)
+	messages, usage := p.contextManager.Build(aiSystemPrompt, command, history, model, p.settings)
+	reportContext(stdio, usage)
+	audit := p.audit.Request(p.mode, command, model, messages)
 
+	plan, err := requestAIPlan(ctx, p.provider, p.settings, messages)
 	if err != nil {
-		return "", fmt.Errorf("OpenAI API error: %v", err)
-	}
-
-	// Extract the function call response
-	functionCallResponse := resp.Choices[0].Message.FunctionCall
-
-	// Parse the JSON response from the function call
-	var aiResponse AIResponse
-	if err := json.Unmarshal([]byte(functionCallResponse.Arguments), &aiResponse); err != nil {
-		return "", fmt.Errorf("Failed to parse AI response as JSON: %v\nRaw response: %s", err, functionCallResponse.Arguments)
-	}
-
-	// Convert the command array to a shell command string
-	shellCmdString := strings.Join(aiResponse.Cmd, " ")
-
-	// Get risk color based on risk score
-	riskColor := getRiskColor(aiResponse.RiskScore)
-
-	// Determine if we should ask for confirmation based on risk score and YOLO mode
-	shouldConfirm := aiResponse.RiskScore >= 7 && !p.yolo
-
-	// Format result with risk information
-	formatTags := []string{
-		fmt.Sprintf("Risk: %s%d/10\033[0m", riskColor, aiResponse.RiskScore),
-		fmt.Sprintf("Read: %v", aiResponse.DoesRead),
-		fmt.Sprintf("Write: %v", aiResponse.DoesWrite),
+		return nil, err
 	}
 
-	// Build the output
-	var result strings.Builder
-
 	// Add mode prefix with YOLO warning if applicable
+	prefix := "[AI] "
 	if p.yolo {
-		result.WriteString("[AI YOLO] ")
-	} else {
-		result.WriteString("[AI] ")
+		prefix = "[AI YOLO] "
 	}
 
-	// Add the friendly explanation
-	result.WriteString(aiResponse.Reply)
-	result.WriteString("\n")
-
-	// Add the risk information
-	result.WriteString(strings.Join(formatTags, " | "))
-	result.WriteString("\n")
-
-	// Check if we need confirmation
-	if shouldConfirm {
-		result.WriteString(fmt.Sprintf("\033[1;31mWARNING: This command has a high risk score (%d/10).\033[0m\n", aiResponse.RiskScore))
-		result.WriteString(fmt.Sprintf("Command: %s\n\n", shellCmdString))
-		result.WriteString("Do you want to execute this command? (y/n): ")
-
-		// Print the current result and get user confirmation
-		fmt.Print(result.String())
-		reader := bufio.NewReader(os.Stdin)
-		confirm, _ := reader.ReadString('\n')
-		confirm = strings.TrimSpace(confirm)
-
-		// Reset the result for the final output
-		result.Reset()
-
-		if strings.ToLower(confirm) != "y" {
-			return "Command execution cancelled by user.", nil
-		}
+	// Plans of several steps are previewed before anything runs
+	if len(plan.Steps) > 1 {
+		return p.runPlan(ctx, command, plan, prefix, audit, stdio)
+	}
+	aiResponse := plan.Steps[0]
+
+	// Keep argv boundaries unless the model asked for the shell
+	cmd := aiResponse.Command()
+	shellCmdString := cmd.String()
+
+	// The policy decides whether to ask for confirmation, based on the risk
+	// score, its rules and YOLO mode
+	assessment := p.assessor.Assess(aiResponse, cmd, model)
+	decision := p.policy.Decide(p.mode, assessment, sessionDir(p.session))
+
+	// Show the friendly explanation and the risk information
+	fmt.Fprintf(stdio.Stdout, "%s%s\n", prefix, aiResponse.Reply)
+	printRisk(stdio.Stdout, assessment, cmd, "")
+
+	// In a dry run the command is only shown
+	if p.dryRun.On {
+		printDecision(stdio.Stdout, decision, assessment.Risk, "command", "")
+		fmt.Fprintf(stdio.Stdout, "Command: %s\n", shellCmdString)
+		step := &planStep{AIResponse: aiResponse, cmd: cmd, assessment: assessment, decision: decision}
+		p.dryRun.Suggest(&Suggestion{Request: command, Mode: p.mode, Reply: aiResponse.Reply, Steps: []*planStep{step}, Audit: audit}, stdio)
+		return &Result{Reply: aiResponse.Reply}, nil
+	}
 
-		// Rebuild the prefix for the final output
-		if p.yolo {
-			result.WriteString("[AI YOLO] ")
-		} else {
-			result.WriteString("[AI] ")
-		}
+	// Check if we need confirmation, or must not run it at all
+	confirmation := &Confirmation{Mode: p.mode, Cmd: cmd, Assessment: assessment, Decision: decision, Provider: p.provider, Settings: p.settings}
+	if !p.confirmer.Confirm(ctx, stdio, confirmation) {
+		audit.Confirmed(aiResponse, confirmation, nil)
+		return &Result{Reply: aiResponse.Reply}, nil
+	}
+	cmd, shellCmdString = confirmation.Cmd, confirmation.Cmd.String()
+	if decision.Action == PolicyConfirm {
+		fmt.Fprint(stdio.Stdout, prefix)
 	}
 
-	// Execute the command
 	if p.yolo {
-		result.WriteString(fmt.Sprintf("Running: %s\n\n", shellCmdString))
+		fmt.Fprintf(stdio.Stdout, "Running: %s\n\n", shellCmdString)
 	} else {
-		result.WriteString(fmt.Sprintf("Command: %s\n\n", shellCmdString))
+		fmt.Fprintf(stdio.Stdout, "Command: %s\n\n", shellCmdString)
 	}
 
-	// Execute the command
-	cmd := exec.Command("sh", "-c", shellCmdString)
-	shellOutput, shellErr := cmd.CombinedOutput()
+	// Execute the command, streaming its output
+	result, err := p.sandbox.Execute(ctx, p.mode, confirmation.Assessment, cmd, stdio)
+	reportExitStatus(stdio, result, err)
+	audit.Confirmed(aiResponse, confirmation, result)
+	result.Command = shellCmdString
+	result.Reply = aiResponse.Reply
 
-	// Add the command output
-	result.WriteString(string(shellOutput))
+	return result, nil
+}
 
-	// Add any error information
-	if shellErr != nil {
-		result.WriteString(fmt.Sprintf("\nError: %v", shellErr))
+// reportExitStatus tells the user when a generated command did not succeed
+func reportExitStatus(stdio *IO, result *Result, err error) {
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "\nError: %v\n", err)
+	} else if result.ExitCode != 0 {
+		fmt.Fprintf(stdio.Stderr, "\nError: exit status %d\n", result.ExitCode)
 	}
+}
 
-	return result.String(), nil
+// riskTags formats the risk information of a generated command
+func riskTags(a Assessment, cmd Command) string {
+	risk := fmt.Sprintf("Risk: %s%d/10\033[0m", getRiskColor(a.Risk), a.Risk)
+	if a.HasModel {
+		risk += fmt.Sprintf(" (AI %d, local %d)", a.ModelRisk, a.Local.Risk)
+	}
+	formatTags := []string{
+		risk,
+		fmt.Sprintf("Read: %v", a.Reads),
+		fmt.Sprintf("Write: %v", a.Writes),
+		fmt.Sprintf("Network: %v", a.Network),
+		fmt.Sprintf("Kind: %s", cmd.Kind),
+	}
+	return strings.Join(formatTags, " | ")
 }
 
 // getRiskColor returns ANSI color code based on the risk score
@@ -277,13 +256,23 @@ func getRiskColor(risk int) string {
 
 // RAGProcessor represents a processor that uses retrieval-augmented generation
 type RAGProcessor struct {
-	client *openai.Client
+	provider       Provider // Model backend for the AI fallback, nil if none is configured
+	settings       *ModelSettings
+	contextManager *ContextManager
+	assessor       *RiskAssessor
+	policy         *Policy
+	confirmer      *Confirmer
+	dryRun         *DryRun
+	sandbox        *Sandbox
+	session        *Session
 	// Simple in-memory knowledge base for command examples
 	knowledgeBase map[string]string
-	yolo          bool // Whether to execute commands without confirmation
+	audit         *AuditLog
+	mode          string // Mode the policy is applied for
+	yolo          bool   // Whether to execute commands without confirmation
 }
 
-func NewRAGProcessor(apiKey string) *RAGProcessor {
+func NewRAGProcessor(provider Provider, settings *ModelSettings, contextManager *ContextManager, assessor *RiskAssessor, policy *Policy, confirmer *Confirmer, dryRun *DryRun, sandbox *Sandbox, session *Session, audit *AuditLog) *RAGProcessor {
 	// Initialize with some sample commands
 	kb := map[string]string{
 		// General file system commands
@@ -335,59 +324,30 @@ func NewRAGProcessor(apiKey string) *RAGProcessor {
 	}
 
 	return &RAGProcessor{
-		client:        openai.NewClient(apiKey),
-		knowledgeBase: kb,
-		yolo:          false,
+		provider:       provider,
+		settings:       settings,
+		contextManager: contextManager,
+		assessor:       assessor,
+		policy:         policy,
+		confirmer:      confirmer,
+		dryRun:         dryRun,
+		sandbox:        sandbox,
+		session:        session,
+		knowledgeBase:  kb,
+		audit:          audit,
+		mode:           "rag",
+		yolo:           false,
 	}
 }
 
 // NewRAGYoloProcessor creates a RAG processor that executes commands without confirmation
-func NewRAGYoloProcessor(apiKey string) *RAGProcessor {
-	processor := NewRAGProcessor(apiKey)
+func NewRAGYoloProcessor(provider Provider, settings *ModelSettings, contextManager *ContextManager, assessor *RiskAssessor, policy *Policy, confirmer *Confirmer, dryRun *DryRun, sandbox *Sandbox, session *Session, audit *AuditLog) *RAGProcessor {
+	processor := NewRAGProcessor(provider, settings, contextManager, assessor, policy, confirmer, dryRun, sandbox, session, audit)
+	processor.mode = "rag-yolo"
 	processor.yolo = true
 	return processor
 }
 
-// Assign estimated risk scores to common RAG commands
-func getRAGCommandRisk(cmd string) (int, bool, bool) {
-	// Default values
-	risk := 3 // Medium-low risk by default
-	doesRead := true
-	doesWrite := false
-
-	// High-risk commands
-	if strings.HasPrefix(cmd, "rm -rf") {
-		risk = 9
-		doesWrite = true
-	} else if strings.HasPrefix(cmd, "chmod") || strings.HasPrefix(cmd, "chown") {
-		risk = 7
-		doesWrite = true
-	}
-
-	// Medium-risk commands
-	if strings.HasPrefix(cmd, "git push") || strings.HasPrefix(cmd, "git pull") {
-		risk = 5
-		doesWrite = true
-	} else if strings.HasPrefix(cmd, "mv") || strings.HasPrefix(cmd, "cp") {
-		risk = 5
-		doesWrite = true
-	} else if strings.HasPrefix(cmd, "mkdir") {
-		risk = 4
-		doesWrite = true
-	}
-
-	// Low-risk commands (read-only)
-	if strings.HasPrefix(cmd, "ls") || strings.HasPrefix(cmd, "find") ||
-	   strings.HasPrefix(cmd, "grep") || strings.HasPrefix(cmd, "df") ||
-	   strings.HasPrefix(cmd, "ps") || strings.HasPrefix(cmd, "uname") ||
-	   strings.HasPrefix(cmd, "git status") {
-		risk = 1
-		doesWrite = false
-	}
-
-	return risk, doesRead, doesWrite
-}
-
 func (p *RAGProcessor) findSimilarCommand(query string) (string, bool) {
 	// Simple implementation: check if any key contains words from the query
 	queryWords := strings.Fields(strings.ToLower(query))
@@ -416,104 +376,69 @@ func (p *RAGProcessor) findSimilarCommand(query string) (string, bool) {
 	return "", false
 }
 
-func (p *RAGProcessor) Process(command string, history []string) (string, error) {
+func (p *RAGProcessor) Process(ctx context.Context, command string, history []Turn, stdio *IO) (*Result, error) {
 	// Try to find a similar command in the knowledge base
 	if shellCmd, found := p.findSimilarCommand(command); found {
 		// Get risk assessment for this command
-		riskScore, doesRead, doesWrite := getRAGCommandRisk(shellCmd)
-
-		// Get risk color
-		riskColor := getRiskColor(riskScore)
+		// Knowledge base entries are shell source such as pipelines
+		cmd := NewShellCommand(shellCmd)
+		assessment := p.assessor.AssessLocal(cmd)
+		audit := p.audit.Request(p.mode, command, "", nil)
+		generated := AIResponse{Shell: shellCmd}
 
-		// Determine if we should ask for confirmation
-		shouldConfirm := riskScore >= 7 && !p.yolo
-
-		// Format result with risk information
-		formatTags := []string{
-			fmt.Sprintf("Risk: %s%d/10\033[0m", riskColor, riskScore),
-			fmt.Sprintf("Read: %v", doesRead),
-			fmt.Sprintf("Write: %v", doesWrite),
-		}
-
-		// Build the output
-		var result strings.Builder
+		// The policy decides whether to ask for confirmation
+		decision := p.policy.Decide(p.mode, assessment, sessionDir(p.session))
 
 		// Add mode prefix with YOLO warning if applicable
+		prefix := "[RAG] "
 		if p.yolo {
-			result.WriteString("[RAG YOLO] ")
-		} else {
-			result.WriteString("[RAG] ")
+			prefix = "[RAG YOLO] "
 		}
 
-		// Add matched information
-		result.WriteString(fmt.Sprintf("Matched '%s' to command: %s\n", command, shellCmd))
-
-		// Add the risk information
-		result.WriteString(strings.Join(formatTags, " | "))
-		result.WriteString("\n")
-
-		// Check if we need confirmation
-		if shouldConfirm {
-			result.WriteString(fmt.Sprintf("\033[1;31mWARNING: This command has a high risk score (%d/10).\033[0m\n", riskScore))
-			result.WriteString("Do you want to execute this command? (y/n): ")
-
-			// Print the current result and get user confirmation
-			fmt.Print(result.String())
-			reader := bufio.NewReader(os.Stdin)
-			confirm, _ := reader.ReadString('\n')
-			confirm = strings.TrimSpace(confirm)
-
-			// Reset the result for the final output
-			result.Reset()
-
-			if strings.ToLower(confirm) != "y" {
-				return "Command execution cancelled by user.", nil
-			}
-
-			// Rebuild the prefix for the final output
-			if p.yolo {
-				result.WriteString("[RAG YOLO] ")
-			} else {
-				result.WriteString("[RAG] ")
-			}
-			result.WriteString(fmt.Sprintf("Matched '%s' to command: %s\n", command, shellCmd))
+		// Show matched information and the risk information
+		reply := fmt.Sprintf("Matched '%s' to command: %s", command, shellCmd)
+		fmt.Fprintf(stdio.Stdout, "%s%s\n", prefix, reply)
+		printRisk(stdio.Stdout, assessment, cmd, "")
+
+		// In a dry run the command is only shown
+		if p.dryRun.On {
+			printDecision(stdio.Stdout, decision, assessment.Risk, "command", "")
+			step := &planStep{AIResponse: AIResponse{Reply: reply, Shell: shellCmd}, cmd: cmd, assessment: assessment, decision: decision}
+			p.dryRun.Suggest(&Suggestion{Request: command, Mode: p.mode, Reply: reply, Steps: []*planStep{step}, Audit: audit}, stdio)
+			return &Result{Reply: reply}, nil
 		}
 
-		// Execute the command
-		cmd := exec.Command("sh", "-c", shellCmd)
-		output, err := cmd.CombinedOutput()
-
-		// Add output information
-		result.WriteString("\nOutput:\n")
-		result.WriteString(string(output))
-
-		// Add error information if any
-		if err != nil {
-			result.WriteString(fmt.Sprintf("\nError: %v", err))
+		// Check if we need confirmation, or must not run it at all
+		confirmation := &Confirmation{Mode: p.mode, Cmd: cmd, Assessment: assessment, Decision: decision, Provider: p.provider, Settings: p.settings}
+		if !p.confirmer.Confirm(ctx, stdio, confirmation) {
+			audit.Confirmed(generated, confirmation, nil)
+			return &Result{Reply: reply}, nil
 		}
 
-		return result.String(), nil
+		// Execute the command, streaming its output
+		fmt.Fprintln(stdio.Stdout, "\nOutput:")
+		result, err := p.sandbox.Execute(ctx, p.mode, confirmation.Assessment, confirmation.Cmd, stdio)
+		reportExitStatus(stdio, result, err)
+		audit.Confirmed(generated, confirmation, result)
+		result.Reply = reply
+
+		return result, nil
 	}
 
-	// If not found in knowledge base and we have a client, fall back to AI
-	if p.client != nil {
-		aiProcessor := AIProcessor{client: p.client, yolo: p.yolo}
-		return aiProcessor.Process(command, history)
+	// If not found in knowledge base and we have a provider, fall back to AI
+	if p.provider != nil {
+		aiProcessor := AIProcessor{provider: p.provider, settings: p.settings, contextManager: p.contextManager, assessor: p.assessor, policy: p.policy, confirmer: p.confirmer, dryRun: p.dryRun, sandbox: p.sandbox, session: p.session, audit: p.audit, mode: p.mode, yolo: p.yolo}
+		return aiProcessor.Process(ctx, command, history, stdio)
 	}
 
-	return "[RAG] No matching command found and AI fallback not available.", nil
+	fmt.Fprintln(stdio.Stdout, "[RAG] No matching command found and AI fallback not available.")
+	return &Result{}, nil
 }
 
-// getDirectoryContext gets information about the current directory for context
-func getDirectoryContext() string {
-	// Get current working directory
-	cwd, err := os.Getwd()
-	if err != nil {
-		return "Error getting current directory"
-	}
-
-	// List files in the current directory
-	files, err := os.ReadDir(".")
+// getDirectoryContext gets information about the directory cwd for context
+func getDirectoryContext(cwd string) string {
+	// List files in the directory
+	files, err := os.ReadDir(cwd)
 	if err != nil {
 		return fmt.Sprintf("Current directory: %s\nError listing files", cwd)
 	}
@@ -549,8 +474,28 @@ func getDirectoryContext() string {
 	return fileList.String()
 }
 
-// processScriptFile reads and executes commands from a script file
-func processScriptFile(filename string, processor CommandProcessor) error {
+// errInterrupted stops a script or piped input after Ctrl-C
+var errInterrupted = errors.New("interrupted")
+
+// runLine processes one line of input in mode and records it in the
+// transcript, returning errInterrupted if the user pressed Ctrl-C while it ran
+func runLine(interrupts *Interrupts, transcript *Transcript, mode string, processor CommandProcessor, line string, stdio *IO) error {
+	ctx, done := interrupts.Begin()
+	defer done()
+
+	result, err := processor.Process(ctx, line, transcript.Turns(), stdio)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error executing command: %v\n", err)
+	}
+	transcript.Record(line, mode, result)
+	if ctx.Err() != nil {
+		return errInterrupted
+	}
+	return nil
+}
+
+// processScriptFile reads and executes commands from a script file in mode
+func processScriptFile(filename string, mode string, processor CommandProcessor, interrupts *Interrupts, stdio *IO) error {
 	file, err := os.Open(filename)
 	if err != nil {
 		return fmt.Errorf("failed to open script file: %v", err)
@@ -558,23 +503,20 @@ func processScriptFile(filename string, processor CommandProcessor) error {
 	defer file.Close()
 
 	scanner := bufio.NewScanner(file)
+	transcript := &Transcript{}
 
 	// Skip the first line if it's a shebang
 	if scanner.Scan() {
 		firstLine := scanner.Text()
 		if !strings.HasPrefix(firstLine, "#!") {
 			// If it's not a shebang, process it as a command
-			output, err := processor.Process(firstLine, nil)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error executing command: %v\n", err)
-			} else {
-				fmt.Println(output)
+			if err := runLine(interrupts, transcript, mode, processor, firstLine, stdio); err != nil {
+				return err
 			}
 		}
 	}
 
 	// Process the rest of the file
-	var history []string
 	for scanner.Scan() {
 		line := scanner.Text()
 		line = strings.TrimSpace(line)
@@ -584,15 +526,9 @@ func processScriptFile(filename string, processor CommandProcessor) error {
 			continue
 		}
 
-		// Add to history for context
-		history = append(history, line)
-
 		// Process the command
-		output, err := processor.Process(line, history[:len(history)-1])
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error executing command: %v\n", err)
-		} else {
-			fmt.Println(output)
+		if err := runLine(interrupts, transcript, mode, processor, line, stdio); err != nil {
+			return err
 		}
 	}
 
@@ -604,23 +540,133 @@ func processScriptFile(filename string, processor CommandProcessor) error {
 }
 
 func main() {
-	// Get OpenAI API key from environment
-	apiKey := os.Getenv("OPENAI_API_KEY")
+	// vibesh re-executes itself to set up the sandbox for a command
+	if len(os.Args) > 1 && os.Args[1] == sandboxInitArg {
+		sandboxInit()
+	}
+
+	// Load the config file, which chooses a model provider per mode
+	config, err := LoadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+	policy, err := LoadPolicy(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load policy: %v\n", err)
+		os.Exit(1)
+	}
+	limits, err := NewLimiter(&config.Limits)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid limits: %v\n", err)
+		os.Exit(1)
+	}
+	providers, err := newModeProviders(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up model providers: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Model settings come from the config, then the environment, then flags
+	settings := config.Model
+	if err := settings.ApplyEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid model setting: %v\n", err)
+		os.Exit(1)
+	}
+	for _, key := range modelSettingKeys {
+		name := strings.ReplaceAll(key, "_", "-")
+		if key == "name" {
+			name = "model"
+		}
+		flag.Func(name, "model setting: "+key, func(value string) error {
+			return settings.Set(key, value)
+		})
+	}
+	flag.IntVar(&config.Agent.MaxIterations, "max-iterations", config.Agent.MaxIterations,
+		"commands the agent may run for one request")
+	dryRunFlag := flag.Bool("dry-run", false, "show the commands AI, RAG and agent modes generate without running them")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [script_file]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	// A model named before any mode is chosen is the default provider's
+	settings.Scope(config.DefaultProvider)
+
+	// When running on a terminal, keystrokes are read in one place and
+	// commands get a pseudo-terminal so interactive programs work
+	var terminal *Terminal
+	var stdin io.Reader = os.Stdin
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		if terminal, err = NewTerminal(os.Stdin); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set up terminal: %v\n", err)
+			os.Exit(1)
+		}
+		stdin = terminal
+	}
 
-	// Create processors
-	aiProcessor := NewAIProcessor(apiKey)
-	aiYoloProcessor := NewAIYoloProcessor(apiKey)
-	ragProcessor := NewRAGProcessor(apiKey)
-	ragYoloProcessor := NewRAGYoloProcessor(apiKey)
-	directProcessor := &DirectShellProcessor{}
+	// Start the shell session shared by all processors
+	session, err := NewSession(terminal)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start shell session: %v\n", err)
+		os.Exit(1)
+	}
+	defer session.Close()
+
+	// The path guard expands variables as the session shell sees them
+	policy.guard.SetEnv(session.LookupEnv)
+
+	// Commands run in the sandbox where the config asks for it
+	snapshots := NewSnapshotStore(&config.Snapshots)
+	sandbox, err := NewSandbox(&config.Sandbox, limits, snapshots, policy.guard.Workspace(), session)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up sandbox: %v\n", err)
+		os.Exit(1)
+	}
+	defer sandbox.Close()
+
+	// Ctrl-C and Ctrl-Z go to the running command rather than vibesh
+	interrupts := NewInterrupts(session)
+
+	// Everything sent to a model is redacted first
+	redactor, err := NewRedactor(&config.Privacy, session)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid privacy settings: %v\n", err)
+		os.Exit(1)
+	}
+	for mode, provider := range providers {
+		if provider != nil {
+			providers[mode] = NewRedactingProvider(provider, redactor)
+		}
+	}
+
+	// Create processors, which record what they run in the audit log
+	auditLog := NewAuditLog(&config.Audit, redactor)
+	contextManager := NewContextManager(&config.Context, session)
+	assessor := NewRiskAssessor(&config.Risk, redactor)
+	confirmer := NewConfirmer(assessor, policy, session)
+	dryRun := NewDryRun(*dryRunFlag, assessor, policy, sandbox, session)
+	aiProcessor := NewAIProcessor(providers["ai"], &settings, contextManager, assessor, policy, confirmer, dryRun, sandbox, session, auditLog)
+	aiYoloProcessor := NewAIYoloProcessor(providers["ai-yolo"], &settings, contextManager, assessor, policy, confirmer, dryRun, sandbox, session, auditLog)
+	ragProcessor := NewRAGProcessor(providers["rag"], &settings, contextManager, assessor, policy, confirmer, dryRun, sandbox, session, auditLog)
+	ragYoloProcessor := NewRAGYoloProcessor(providers["rag-yolo"], &settings, contextManager, assessor, policy, confirmer, dryRun, sandbox, session, auditLog)
+	agentProcessor := NewAgentProcessor(providers["agent"], &settings, contextManager, assessor, policy, confirmer, dryRun, sandbox, &config.Agent, session, auditLog)
+	agentYoloProcessor := NewAgentYoloProcessor(providers["agent-yolo"], &settings, contextManager, assessor, policy, confirmer, dryRun, sandbox, &config.Agent, session, auditLog)
+	directProcessor := NewDirectShellProcessor(assessor, policy, confirmer, sandbox, session, auditLog)
+
+	// All output is streamed straight to the terminal
+	reader := bufio.NewReader(stdin)
+	stdio := &IO{Input: reader, Stdout: os.Stdout, Stderr: os.Stderr}
 
 	// Check if a script file is provided as an argument
-	if len(os.Args) > 1 {
-		scriptFile := os.Args[1]
+	if flag.NArg() > 0 {
+		scriptFile := flag.Arg(0)
 
 		// Determine which processor to use based on script extension or content
 		// For simplicity, we'll use the AI processor by default for scripts
-		err := processScriptFile(scriptFile, aiProcessor)
+		err := processScriptFile(scriptFile, "ai", aiProcessor, interrupts, stdio)
+		session.Close()
+		sandbox.Close()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Script execution failed: %v\n", err)
 			os.Exit(1)
@@ -631,21 +677,23 @@ func main() {
 	// No script file, start interactive mode
 	fmt.Println("Vibesh - AI-Enhanced Interactive Shell")
 	fmt.Println("Type 'exit' to quit, 'mode' to switch processing mode, 'help' for available commands")
-	fmt.Println("Modes: 'direct' (default), 'ai', 'rag', 'ai-yolo', 'rag-yolo'")
+	fmt.Println("Modes: 'direct' (default), 'ai', 'rag', 'agent', 'ai-yolo', 'rag-yolo', 'agent-yolo'")
 
-	if apiKey == "" {
+	if providers["ai"] == nil {
 		fmt.Println("Warning: OPENAI_API_KEY not set. AI and RAG modes will have limited functionality.")
 	}
 
-	reader := bufio.NewReader(os.Stdin)
-	var commandHistory []string
+	// Turns handled by the processors, which they use as context
+	transcript := &Transcript{}
 
 	processors := map[string]CommandProcessor{
-		"direct":   directProcessor,
-		"ai":       aiProcessor,
-		"rag":      ragProcessor,
-		"ai-yolo":  aiYoloProcessor,
-		"rag-yolo": ragYoloProcessor,
+		"direct":     directProcessor,
+		"ai":         aiProcessor,
+		"rag":        ragProcessor,
+		"agent":      agentProcessor,
+		"ai-yolo":    aiYoloProcessor,
+		"rag-yolo":   ragYoloProcessor,
+		"agent-yolo": agentYoloProcessor,
 	}
 
 	currentMode := "direct"
@@ -654,22 +702,26 @@ func main() {
 	stat, _ := os.Stdin.Stat()
 	if (stat.Mode() & os.ModeCharDevice) == 0 {
 		// Data is being piped in
-		scanner := bufio.NewScanner(os.Stdin)
-		for scanner.Scan() {
-			command := scanner.Text()
+		for {
+			line, err := reader.ReadString('\n')
+			if line == "" && err != nil {
+				break
+			}
+			command := strings.TrimSuffix(line, "\n")
 			processor := processors[currentMode]
-			output, err := processor.Process(command, commandHistory)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "Error executing command:", err)
-			} else {
-				fmt.Println(output)
+			if err := runLine(interrupts, transcript, currentMode, processor, command, stdio); err != nil {
+				session.Close()
+				sandbox.Close()
+				os.Exit(130)
 			}
-			commandHistory = append(commandHistory, command)
 		}
+		session.Close()
+		sandbox.Close()
 		os.Exit(0)
 	}
 
 	// Interactive mode
+	shadowNoted := map[string]bool{}
 	for {
 		// Set prompt color - use red for YOLO modes
 		promptColor := "\033[1;32m" // Green
@@ -677,7 +729,19 @@ func main() {
 			promptColor = "\033[1;31m" // Red for YOLO modes
 		}
 
-		fmt.Printf("%svibesh(%s)>\033[0m ", promptColor, currentMode)
+		// Show the active model in modes that use one
+		promptMode := currentMode
+		if provider := providers[currentMode]; provider != nil {
+			promptMode += ":" + settings.ModelFor(provider)
+		}
+
+		if dryRun.On {
+			promptMode += " dry-run"
+		}
+
+		prompt := fmt.Sprintf("%svibesh(%s)>\033[0m ", promptColor, promptMode)
+		fmt.Print(prompt)
+		interrupts.SetPrompt(prompt)
 
 		input, err := reader.ReadString('\n')
 		if err != nil {
@@ -695,9 +759,6 @@ func main() {
 			continue
 		}
 
-		// Add command to history
-		commandHistory = append(commandHistory, input)
-
 		// Handle special commands
 		if input == "exit" {
 			fmt.Println("Goodbye!")
@@ -710,12 +771,12 @@ func main() {
 		}
 
 		// Handle mode command with or without argument
-		if strings.HasPrefix(input, "mode") {
+		if input == "mode" || strings.HasPrefix(input, "mode ") {
 			parts := strings.Fields(input)
 
 			// Show current mode and available modes if no argument is provided
 			if len(parts) == 1 {
-				fmt.Printf("Current mode: %s\nAvailable modes: direct, ai, rag, ai-yolo, rag-yolo\n", currentMode)
+				fmt.Printf("Current mode: %s\nAvailable modes: %s\n", currentMode, availableModes)
 				fmt.Print("Select mode: ")
 				modeInput, err := reader.ReadString('\n')
 				if err != nil {
@@ -749,38 +810,268 @@ func main() {
 
 					fmt.Printf("Mode switched to: %s\n", currentMode)
 				} else {
-					fmt.Printf("Invalid mode: %s\nAvailable modes: direct, ai, rag, ai-yolo, rag-yolo\n", modeInput)
+					fmt.Printf("Invalid mode: %s\nAvailable modes: %s\n", modeInput, availableModes)
 				}
 			} else {
 				fmt.Println("Usage: mode [mode_name]")
-				fmt.Println("Available modes: direct, ai, rag, ai-yolo, rag-yolo")
+				fmt.Println("Available modes: " + availableModes)
 			}
 			continue
 		}
 
 		if input == "history" {
 			fmt.Println("Command history:")
-			for i, cmd := range commandHistory[:len(commandHistory)-1] {
-				fmt.Printf("%d: %s\n", i+1, cmd)
+			for i, turn := range transcript.Turns() {
+				fmt.Printf("%d: %s\n", i+1, describeTurn(turn))
 			}
 			continue
 		}
 
 		if input == "context" {
-			fmt.Println(getDirectoryContext())
+			fmt.Println(contextManager.Environment())
+			if usage, ok := contextManager.Last(); ok {
+				fmt.Printf("Context sent with the last request: %s\n", usage)
+			} else {
+				fmt.Println("No context has been sent to a model yet.")
+			}
+			continue
+		}
+
+		if input == "context --sent" {
+			// Preview the next request of the current mode, as redacted
+			provider := providers[currentMode]
+			if provider == nil {
+				fmt.Printf("Nothing is sent to a model in %s mode.\n", currentMode)
+				continue
+			}
+			prompt := aiSystemPrompt
+			if strings.HasPrefix(currentMode, "agent") {
+				prompt = agentSystemPrompt
+			}
+			messages, usage := contextManager.Preview(prompt, "<your next request>", transcript.Turns(), settings.ModelFor(provider), &settings)
+			printSentContext(redactor.Redact(messages))
+			fmt.Printf("\n%s\n", usage)
+			continue
+		}
+
+		if input == "dry-run" || strings.HasPrefix(input, "dry-run ") {
+			switch strings.TrimSpace(strings.TrimPrefix(input, "dry-run")) {
+			case "":
+				dryRun.On = !dryRun.On
+			case "on":
+				dryRun.On = true
+			case "off":
+				dryRun.On = false
+			default:
+				fmt.Println("Usage: dry-run [on|off]")
+				continue
+			}
+			if dryRun.On {
+				fmt.Println("Dry run on: AI, RAG and agent modes show commands without running them.")
+			} else {
+				fmt.Println("Dry run off: generated commands run as usual.")
+			}
+			continue
+		}
+
+		if input == "run" {
+			noteShadowed("run", currentMode, session, shadowNoted)
+			ctx, done := interrupts.Begin()
+			request, mode, result := dryRun.Run(ctx, stdio)
+			done()
+			limits.ClearNext()
+			if result != nil {
+				transcript.Record(request, mode, result)
+			}
+			continue
+		}
+
+		if fields := strings.Fields(input); fields[0] == "edit" && (len(fields) == 1 || len(fields) == 2 && isNumber(fields[1])) {
+			noteShadowed("edit", currentMode, session, shadowNoted)
+			dryRun.Edit(fields[1:], stdio)
+			continue
+		}
+
+		if fields := strings.Fields(input); fields[0] == "undo" && (len(fields) == 1 || len(fields) == 2 && isNumber(fields[1])) {
+			noteShadowed("undo", currentMode, session, shadowNoted)
+			n := 1
+			if len(fields) == 2 {
+				n, _ = strconv.Atoi(fields[1])
+			}
+			undoSnapshots(snapshots, max(n, 1), stdio)
+			continue
+		}
+
+		if input == "snapshots" {
+			noteShadowed("snapshots", currentMode, session, shadowNoted)
+			listSnapshots(snapshots, stdio)
+			continue
+		}
+
+		if input == "snapshots gc" {
+			noteShadowed("snapshots", currentMode, session, shadowNoted)
+			removedSnapshots, removedObjects, err := snapshots.GC()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to clean up snapshots: %v\n", err)
+				continue
+			}
+			fmt.Printf("Removed %d old snapshot(s) and %d unused stored file(s).\n", removedSnapshots, removedObjects)
+			continue
+		}
+
+		if input == "limit" || strings.HasPrefix(input, "limit ") {
+			noteShadowed("limit", currentMode, session, shadowNoted)
+			handleLimitCommand(strings.Fields(input)[1:], limits, currentMode)
+			continue
+		}
+
+		if input == "audit" || strings.HasPrefix(input, "audit ") {
+			noteShadowed("audit", currentMode, session, shadowNoted)
+			showAudit(auditLog, strings.Fields(input)[1:], stdio)
+			continue
+		}
+
+		if input == "model" || strings.HasPrefix(input, "model ") {
+			noteShadowed("model", currentMode, session, shadowNoted)
+			handleModelCommand(strings.Fields(input)[1:], &settings, providers[currentMode])
+			continue
+		}
+
+		// Job control always goes to the session, whatever the mode
+		if isJobBuiltin(input) {
+			ctx, done := interrupts.Begin()
+			session.Run(ctx, input, Limits{}, os.Stdout, os.Stderr)
+			done()
 			continue
 		}
 
 		// Process the command using the selected processor
 		processor := processors[currentMode]
-		output, err := processor.Process(input, commandHistory[:len(commandHistory)-1])
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error executing command:", err)
-			continue
+		runLine(interrupts, transcript, currentMode, processor, input, stdio)
+		limits.ClearNext()
+	}
+}
+
+// availableModes lists the processing modes for messages
+const availableModes = "direct, ai, rag, agent, ai-yolo, rag-yolo, agent-yolo"
+
+// newModeProviders creates the provider configured for each AI-backed mode.
+// Modes whose provider has no API key get nil, which the processors report.
+func newModeProviders(config *Config) (map[string]Provider, error) {
+	byName := map[string]Provider{}
+	providers := map[string]Provider{}
+
+	for _, mode := range []string{"ai", "ai-yolo", "rag", "rag-yolo", "agent", "agent-yolo"} {
+		name := config.ProviderFor(mode)
+		provider, ok := byName[name]
+		if !ok {
+			cfg, found := config.Providers[name]
+			if !found {
+				return nil, fmt.Errorf("mode %s uses unknown provider %q", mode, name)
+			}
+			var err error
+			provider, err = NewProvider(name, cfg)
+			if err != nil && err != ErrNoAPIKey {
+				return nil, err
+			}
+			byName[name] = provider
+		}
+		providers[mode] = provider
+	}
+	return providers, nil
+}
+
+// handleModelCommand shows or changes the model settings:
+//
+//	model                  show the current settings
+//	model NAME             switch the current mode's provider to model NAME
+//	                       ("default" for the provider's own)
+//	model SETTING VALUE    change a setting, e.g. `model temperature 0.2`
+func handleModelCommand(args []string, settings *ModelSettings, provider Provider) {
+	switch len(args) {
+	case 0:
+		fmt.Print(settings.Describe(provider))
+	case 1:
+		if slices.Contains(modelSettingKeys, args[0]) {
+			fmt.Printf("Usage: model %s <value>\n", args[0])
+			return
 		}
+		switchModel(args[0], settings, provider)
+	case 2:
+		if args[0] == "name" || args[0] == "model" {
+			switchModel(args[1], settings, provider)
+			return
+		}
+		if err := settings.Set(args[0], args[1]); err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("%s set to: %s\n", args[0], args[1])
+	default:
+		fmt.Println("Usage: model [name] | model <setting> <value>")
+		fmt.Printf("Settings: %s\n", strings.Join(modelSettingKeys, ", "))
+	}
+}
+
+// switchModel chooses the model used with provider, the current mode's
+func switchModel(name string, settings *ModelSettings, provider Provider) {
+	if provider == nil {
+		fmt.Println("No model provider is configured for this mode")
+		return
+	}
+	settings.UseModel(provider.Name(), name)
+	fmt.Printf("Model switched to: %s (provider %s)\n", settings.ModelFor(provider), provider.Name())
+}
+
+// handleLimitCommand shows the limits of commands in mode, or overrides one
+// for the commands run for the next request
+func handleLimitCommand(args []string, limits *Limiter, mode string) {
+	switch {
+	case len(args) == 0:
+		fmt.Print(limits.Describe(mode))
+	case len(args) == 1 && args[0] == "clear":
+		limits.ClearNext()
+		fmt.Println("Limits for the next command cleared.")
+	case len(args) == 2:
+		if err := limits.SetNext(args[0], args[1]); err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("%s set to %s for the next command.\n", args[0], args[1])
+	default:
+		fmt.Println("Usage: limit | limit <limit> <value|none> | limit clear")
+		fmt.Printf("Limits: %s\n", strings.Join(limitKeys, ", "))
+	}
+}
+
+// isNumber reports whether s is a decimal number, such as a step number
+func isNumber(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// noteShadowed tells the user, once per name, that the builtin name
+// hides an executable of the same name on the session's PATH and how to
+// run that instead. Only direct mode needs this: in the other modes the
+// input is a request, not a command line.
+func noteShadowed(name, mode string, session *Session, noted map[string]bool) {
+	if mode != "direct" || noted[name] {
+		return
+	}
+	path, _ := session.LookupEnv("PATH")
+	if program := lookPathIn(name, path); program != "" {
+		noted[name] = true
+		fmt.Fprintf(os.Stderr, "Note: %s is a vibesh builtin here; type `command %s` to run %s instead.\n", name, name, program)
+	}
+}
 
-		fmt.Println(output)
+// isJobBuiltin reports whether input is one of the job control builtins
+func isJobBuiltin(input string) bool {
+	switch strings.Fields(input)[0] {
+	case "jobs", "fg", "bg":
+		return true
 	}
+	return false
 }
 
 // printHelp displays help information based on the current mode
@@ -791,14 +1082,29 @@ func printHelp(mode string) {
 	fmt.Println("  exit     - Exit the shell")
 	fmt.Println("  mode [mode_name] - Switch processing mode. With no argument, it prompts for mode selection")
 	fmt.Println("  history  - Display command history")
-	fmt.Println("  context  - Show current directory context")
+	fmt.Println("  context  - Show the environment context and how much context the last request sent")
+	fmt.Println("  context --sent - Show exactly what the next request in this mode would send, after redaction")
+	fmt.Println("  model [name | setting value] - Show or change the model and its settings")
+	fmt.Println("  dry-run [on|off] - Show generated commands without running them")
+	fmt.Println("  run      - Run the last command suggested in a dry run")
+	fmt.Println("  edit [n] - Change the last command, or step n, suggested in a dry run")
+	fmt.Println("  undo [n] - Put back the files changed by the last n commands that wrote to them")
+	fmt.Println("  snapshots [gc] - List the snapshots undo can restore, or remove old ones")
+	fmt.Println("  limit [limit value | clear] - Show the limits of commands, or change one for the next command")
+	fmt.Println("  audit [n] [filters] | audit verify - Search the log of generated and executed commands, or check its hash chain")
+	fmt.Println("  jobs     - List background and stopped jobs")
+	fmt.Println("  fg [%n]  - Bring a job to the foreground")
+	fmt.Println("  bg [%n]  - Resume a stopped job in the background")
 	fmt.Println("  help     - Display this help message")
+	fmt.Println("Builtins take the place of programs with the same name; type `command <name>` to run the program.")
 	fmt.Println("\nModes:")
 	fmt.Println("  direct   - Commands are executed directly in the shell")
 	fmt.Println("  ai       - Natural language is converted to shell commands using AI")
 	fmt.Println("  rag      - Commands are matched against a knowledge base with AI fallback")
+	fmt.Println("  agent    - The AI runs commands and reads their output until the task is done")
 	fmt.Println("  ai-yolo  - Like AI mode but executes commands directly without confirmation")
 	fmt.Println("  rag-yolo - Like RAG mode but executes commands directly without confirmation")
+	fmt.Println("  agent-yolo - Like agent mode but executes commands directly without confirmation")
 
 	if strings.HasPrefix(mode, "rag") {
 		fmt.Println("\nPopular RAG Commands:")
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxCapturedOutput bounds how much command output is kept for history and AI context
+const maxCapturedOutput = 16 * 1024
+
+// IO holds the streams a processor writes to while it runs. Command output is
+// streamed here as it is produced rather than returned at the end.
+type IO struct {
+	Input  *bufio.Reader // Line input for prompts such as confirmations
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Result describes what a processor ran
+type Result struct {
+	Command  string // Shell command that was executed, empty if nothing ran
+	Reply    string // Explanation given by the AI or knowledge base, if any
+	ExitCode int    // Exit status of the command
+	Output   string // Bounded copy of stdout and stderr, interleaved as written
+	Stdout   string // Bounded copy of stdout alone
+	Stderr   string // Bounded copy of stderr alone; empty on a terminal, where both share one stream
+	Limit    string // Limit that stopped the command, e.g. "timeout", empty if none did
+
+	Duration   time.Duration // How long the command ran
+	OutputSize int64         // Bytes the command wrote to stdout and stderr, kept or not
+}
+
+// captureBuffer keeps the last max bytes written to it. It is safe for
+// concurrent use so stdout and stderr can share one buffer.
+type captureBuffer struct {
+	mu        sync.Mutex
+	buf       []byte
+	max       int
+	truncated bool
+}
+
+func newCaptureBuffer(max int) *captureBuffer {
+	return &captureBuffer{max: max}
+}
+
+func (c *captureBuffer) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.buf = append(c.buf, p...)
+	if len(c.buf) > c.max {
+		c.buf = append(c.buf[:0], c.buf[len(c.buf)-c.max:]...)
+		c.truncated = true
+	}
+	return len(p), nil
+}
+
+// String returns the captured output, marking where earlier output was dropped
+func (c *captureBuffer) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.truncated {
+		return "[... output truncated ...]\n" + string(c.buf)
+	}
+	return string(c.buf)
+}
+
+// byteCounter counts the bytes written to it, from any goroutine
+type byteCounter struct {
+	n atomic.Int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// execute runs command with runner, the session or the sandbox, within
+// limits, streaming its output to stdio while keeping a bounded copy for the
+// result
+func execute(ctx context.Context, runner Runner, command string, limits Limits, stdio *IO) (*Result, error) {
+	if _, ok := runner.(*Sandbox); ok {
+		fmt.Fprintln(stdio.Stdout, "\033[1;36mRunning in the sandbox.\033[0m")
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if limits.Timeout > 0 {
+		exceeded := &limitExceeded{limit: "timeout", detail: fmt.Sprintf("the command ran for longer than its timeout of %s", limits.Timeout)}
+		var stop context.CancelFunc
+		ctx, stop = context.WithTimeoutCause(ctx, limits.Timeout, exceeded)
+		defer stop()
+	}
+
+	capture := newCaptureBuffer(maxCapturedOutput)
+	stdout := newCaptureBuffer(maxCapturedOutput)
+	stderr := newCaptureBuffer(maxCapturedOutput)
+	outW := io.MultiWriter(stdio.Stdout, capture, stdout)
+	errW := io.MultiWriter(stdio.Stderr, capture, stderr)
+	if limits.Output > 0 {
+		exceeded := &limitExceeded{limit: "output_mb", detail: fmt.Sprintf("the command wrote more than its output limit of %d MiB", limits.Output>>20)}
+		output := &outputLimit{max: limits.Output, exceeded: func() { cancel(exceeded) }}
+		outW, errW = output.wrap(outW), output.wrap(errW)
+	}
+	size := &byteCounter{}
+	outW, errW = io.MultiWriter(size, outW), io.MultiWriter(size, errW)
+	start := time.Now()
+	status, err := runner.Run(ctx, command, limits, outW, errW)
+
+	result := &Result{
+		Command:    command,
+		ExitCode:   status,
+		Output:     capture.String(),
+		Stdout:     stdout.String(),
+		Stderr:     stderr.String(),
+		Duration:   time.Since(start),
+		OutputSize: size.n.Load(),
+	}
+	if exceeded := limitHit(ctx, limits, status, result.Output); exceeded != nil {
+		reportLimit(stdio, result, exceeded)
+	}
+	return result, err
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCaptureBuffer(t *testing.T) {
+	tests := []struct {
+		writes []string
+		max    int
+		want   string
+	}{
+		{nil, 5, ""},
+		{[]string{"abc", "de"}, 5, "abcde"},
+		{[]string{"abc", "def"}, 5, "[... output truncated ...]\nbcdef"},
+		{[]string{"abcdefgh"}, 5, "[... output truncated ...]\ndefgh"},
+		{[]string{"abcdefgh", "", "x"}, 5, "[... output truncated ...]\nefghx"},
+	}
+	for _, tt := range tests {
+		c := newCaptureBuffer(tt.max)
+		for _, s := range tt.writes {
+			if n, err := c.Write([]byte(s)); n != len(s) || err != nil {
+				t.Errorf("Write(%q) = %d, %v", s, n, err)
+			}
+		}
+		if got := c.String(); got != tt.want {
+			t.Errorf("%q within %d: %q, want %q", tt.writes, tt.max, got, tt.want)
+		}
+	}
+}
+
+// firstWrite records when it is first written to
+type firstWrite struct {
+	bytes.Buffer
+	once sync.Once
+	at   time.Time
+}
+
+func (w *firstWrite) Write(p []byte) (int, error) {
+	w.once.Do(func() { w.at = time.Now() })
+	return w.Buffer.Write(p)
+}
+
+func TestExecute(t *testing.T) {
+	session, err := NewSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	var stdout firstWrite
+	var stderr bytes.Buffer
+	stdio := &IO{Stdout: &stdout, Stderr: &stderr}
+	result, err := execute(context.Background(), session, "echo out; echo err >&2; sleep 0.3; (exit 3)", Limits{}, stdio)
+	finished := time.Now()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ExitCode != 3 || result.Stdout != "out\n" || result.Stderr != "err\n" || result.OutputSize != 8 {
+		t.Errorf("result %+v", result)
+	}
+	if !strings.Contains(result.Output, "out\n") || !strings.Contains(result.Output, "err\n") || len(result.Output) != 8 {
+		t.Errorf("combined output %q", result.Output)
+	}
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Errorf("streamed %q and %q", stdout.String(), stderr.String())
+	}
+	// Output is passed on as it is written, not when the command ends
+	if stdout.at.IsZero() || finished.Sub(stdout.at) < 200*time.Millisecond {
+		t.Errorf("first output %v before the command finished", finished.Sub(stdout.at))
+	}
+
+	// Only the end of long output is kept, but all of it is counted
+	stdio = &IO{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}
+	result, err = execute(context.Background(), session, "head -c 40000 /dev/zero | tr '\\0' x", Limits{}, stdio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OutputSize != 40000 || !strings.HasPrefix(result.Stdout, "[... output truncated ...]\n") || len(result.Stdout) > maxCapturedOutput+64 {
+		t.Errorf("long output: size %d, kept %d bytes", result.OutputSize, len(result.Stdout))
+	}
+
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// planStep is a step of a plan as reviewed by the user
+type planStep struct {
+	AIResponse
+	cmd        Command
+	assessment Assessment     // Risk of cmd
+	decision   PolicyDecision // What the policy says about cmd
+	skipped    bool           // Whether the user chose not to run the step
+	edited     bool           // Whether the user replaced the generated command
+}
+
+// runPlan previews a plan of several steps and lets the user approve all of
+// them, approve them one at a time, edit them or skip them. The steps then
+// run in order, and the plan stops at the first step that fails.
+func (p *AIProcessor) runPlan(ctx context.Context, request string, plan *AIPlan, prefix string, audit *AuditRequest, stdio *IO) (*Result, error) {
+	model := p.settings.ModelFor(p.provider)
+	dir := sessionDir(p.session)
+	steps := make([]*planStep, len(plan.Steps))
+	for i, step := range plan.Steps {
+		cmd := step.Command()
+		steps[i] = &planStep{AIResponse: step, cmd: cmd, assessment: p.assessor.Assess(step, cmd, model)}
+		steps[i].decision = p.policy.Decide(p.mode, steps[i].assessment, dir)
+	}
+
+	fmt.Fprintf(stdio.Stdout, "%s%s\n", prefix, plan.Reply)
+
+	// In a dry run the plan is only shown
+	if p.dryRun.On {
+		printPlan(stdio, steps)
+		p.dryRun.Suggest(&Suggestion{Request: request, Mode: p.mode, Reply: plan.Reply, Steps: steps, Audit: audit}, stdio)
+		return &Result{Reply: plan.Reply}, nil
+	}
+
+	// YOLO modes run the whole plan without asking
+	stepByStep := false
+	if p.yolo {
+		printPlan(stdio, steps)
+	} else {
+	review:
+		for {
+			printPlan(stdio, steps)
+			fmt.Fprint(stdio.Stdout, "Run this plan? [a]ll, [s]tep by step, [e]dit N, s[k]ip N, [n]o: ")
+
+			line, _ := stdio.Input.ReadString('\n')
+			fields := strings.Fields(strings.ToLower(line))
+			if len(fields) == 0 {
+				fields = []string{"n"}
+			}
+
+			switch fields[0] {
+			case "a", "all":
+				break review
+			case "s", "step":
+				stepByStep = true
+				break review
+			case "e", "edit":
+				if step := pickStep(stdio, steps, fields); step != nil {
+					p.editStep(stdio, step)
+				}
+			case "k", "skip":
+				if step := pickStep(stdio, steps, fields); step != nil {
+					step.skipped = !step.skipped
+				}
+			case "n", "no":
+				fmt.Fprintln(stdio.Stdout, "Plan cancelled by user.")
+				for _, step := range steps {
+					audit.Step(step, AuditDeclined, nil)
+				}
+				return &Result{Reply: plan.Reply}, nil
+			default:
+				fmt.Fprintf(stdio.Stdout, "Unknown choice %q.\n", fields[0])
+			}
+		}
+	}
+
+	result := executePlan(ctx, p.sandbox, audit, p.mode, steps, stepByStep, stdio)
+	result.Reply = plan.Reply
+	return result, nil
+}
+
+// executePlan runs the steps that were not skipped, stopping at the first
+// failure, each in the sandbox or previewed if the config says so for mode.
+// The result covers every step that ran. Every step is recorded in audit,
+// with the steps the plan did not get to as skipped.
+func executePlan(ctx context.Context, sandbox *Sandbox, audit *AuditRequest, mode string, steps []*planStep, stepByStep bool, stdio *IO) *Result {
+	capture := newCaptureBuffer(maxCapturedOutput)
+	var commands []string
+	exitCode := 0
+
+	next := 0
+	for i, step := range steps {
+		next = i + 1
+		if step.skipped {
+			fmt.Fprintf(stdio.Stdout, "\nStep %d/%d skipped.\n", i+1, len(steps))
+			audit.Step(step, AuditSkipped, nil)
+			continue
+		}
+		if ctx.Err() != nil {
+			next = i
+			break
+		}
+
+		// Later steps may depend on a denied one, so the plan stops there
+		if step.decision.Action == PolicyDeny {
+			fmt.Fprintf(stdio.Stdout, "\nStep %d/%d is denied by %s; plan stopped.\n", i+1, len(steps), step.decision.By)
+			audit.Step(step, AuditDenied, nil)
+			break
+		}
+
+		// Approving the plan does not cover steps the policy wants confirmed
+		decision := AuditApproved
+		if step.decision.Action == PolicyAllow {
+			decision = AuditAllowed
+		}
+		if stepByStep || step.decision.Mandatory() && step.decision.Action == PolicyConfirm {
+			fmt.Fprintf(stdio.Stdout, "\nStep %d/%d: %s\n", i+1, len(steps), step.cmd)
+			if step.decision.Mandatory() && step.decision.Action == PolicyConfirm {
+				fmt.Fprintf(stdio.Stdout, "\033[1;31mThis step needs confirmation by %s.\033[0m\n", step.decision.By)
+			}
+			fmt.Fprint(stdio.Stdout, "Run this step? (y/n/q): ")
+			answer, _ := stdio.Input.ReadString('\n')
+			answer = strings.ToLower(strings.TrimSpace(answer))
+			if answer == "q" {
+				fmt.Fprintln(stdio.Stdout, "Plan stopped by user.")
+				audit.Step(step, AuditDeclined, nil)
+				break
+			}
+			if answer != "y" {
+				fmt.Fprintln(stdio.Stdout, "Step skipped.")
+				audit.Step(step, AuditDeclined, nil)
+				continue
+			}
+			decision = AuditConfirmed
+			fmt.Fprintln(stdio.Stdout)
+		} else {
+			fmt.Fprintf(stdio.Stdout, "\nStep %d/%d: %s\n\n", i+1, len(steps), step.cmd)
+		}
+
+		// Execute the command, streaming its output
+		result, err := sandbox.Execute(ctx, mode, step.assessment, step.cmd, stdio)
+		reportExitStatus(stdio, result, err)
+		audit.Step(step, decision, result)
+
+		commands = append(commands, step.cmd.String())
+		capture.Write([]byte(result.Output))
+		exitCode = result.ExitCode
+
+		if err != nil || result.ExitCode != 0 {
+			if remaining := len(steps) - i - 1; remaining > 0 {
+				fmt.Fprintf(stdio.Stderr, "Step %d failed; %d remaining step(s) not run.\n", i+1, remaining)
+			}
+			break
+		}
+	}
+	for _, step := range steps[next:] {
+		audit.Step(step, AuditSkipped, nil)
+	}
+
+	return &Result{
+		Command:  strings.Join(commands, "\n"),
+		ExitCode: exitCode,
+		Output:   capture.String(),
+	}
+}
+
+// printPlan shows the steps of a plan with their risk information
+func printPlan(stdio *IO, steps []*planStep) {
+	fmt.Fprintf(stdio.Stdout, "\nPlan (%d steps):\n", len(steps))
+	for i, step := range steps {
+		status := ""
+		if step.skipped {
+			status = "[skipped] "
+		} else if step.edited {
+			status = "[edited] "
+		}
+		fmt.Fprintf(stdio.Stdout, "  %d. %s%s\n", i+1, status, step.Reply)
+		fmt.Fprintf(stdio.Stdout, "     $ %s\n", step.cmd)
+		printRisk(stdio.Stdout, step.assessment, step.cmd, "     ")
+		if !step.skipped {
+			printDecision(stdio.Stdout, step.decision, step.assessment.Risk, "step", "     ")
+		}
+	}
+	fmt.Fprintln(stdio.Stdout)
+}
+
+// printDecision warns about a command the policy denies or wants confirmed,
+// or that has a high risk score. what names the command, e.g. "step".
+func printDecision(w io.Writer, decision PolicyDecision, risk int, what, indent string) {
+	switch {
+	case decision.Action == PolicyDeny:
+		fmt.Fprintf(w, "%s\033[1;31mBLOCKED: This %s is denied by %s.\033[0m\n", indent, what, decision.By)
+	case decision.Mandatory() && decision.Action == PolicyConfirm:
+		fmt.Fprintf(w, "%s\033[1;31mWARNING: This %s needs confirmation by %s.\033[0m\n", indent, what, decision.By)
+	case risk >= 7:
+		fmt.Fprintf(w, "%s\033[1;31mWARNING: This %s has a high risk score (%d/10).\033[0m\n", indent, what, risk)
+	}
+}
+
+// pickStep returns the step numbered by the second field of a choice
+func pickStep(stdio *IO, steps []*planStep, fields []string) *planStep {
+	if len(fields) < 2 {
+		fmt.Fprintln(stdio.Stdout, "Give the step number, e.g. \"e 2\".")
+		return nil
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n < 1 || n > len(steps) {
+		fmt.Fprintf(stdio.Stdout, "No step %q; steps are numbered 1 to %d.\n", fields[1], len(steps))
+		return nil
+	}
+	return steps[n-1]
+}
+
+// editStep replaces the command of a step with one typed by the user. The
+// model's risk assessment no longer applies, so the new command is assessed
+// locally.
+func (p *AIProcessor) editStep(stdio *IO, step *planStep) {
+	fmt.Fprintf(stdio.Stdout, "Current: %s\n", step.cmd)
+	fmt.Fprint(stdio.Stdout, "New command (empty to keep): ")
+
+	line, _ := stdio.Input.ReadString('\n')
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+
+	step.cmd = NewShellCommand(line)
+	step.assessment = p.assessor.AssessLocal(step.cmd)
+	step.decision = p.policy.Decide(p.mode, step.assessment, sessionDir(p.session))
+	step.edited = true
+	step.skipped = false
+}
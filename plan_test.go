@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRunPlan(t *testing.T) {
+	tests := []struct {
+		steps  []string
+		input  string
+		files  []string // Files the plan leaves in the directory
+		output string   // Substring of what is shown
+	}{
+		{[]string{"touch a", "touch b"}, "a\n", []string{"a", "b"}, "Step 2/2: touch b"},
+		{[]string{"touch a", "touch b"}, "n\n", nil, "Plan cancelled"},
+		{[]string{"touch a", "touch b"}, "\n", nil, "Plan cancelled"},
+		{[]string{"touch a", "touch b"}, "k 1\na\n", []string{"b"}, "Step 1/2 skipped"},
+		{[]string{"touch a", "touch b"}, "k 1\nk 1\na\n", []string{"a", "b"}, "1. [skipped]"},
+		{[]string{"touch a", "touch b"}, "e 2\ntouch c\na\n", []string{"a", "c"}, "2. [edited]"},
+		{[]string{"touch a", "touch b"}, "e 2\n\na\n", []string{"a", "b"}, "Current: touch b"},
+		{[]string{"touch a", "touch b"}, "k 2\ne 2\ntouch c\na\n", []string{"a", "c"}, "Step 2/2: touch c"},
+		{[]string{"touch a", "touch b"}, "e\nn\n", nil, "Give the step number"},
+		{[]string{"touch a", "touch b"}, "k 3\nn\n", nil, `No step "3"`},
+		{[]string{"touch a", "touch b"}, "x\nn\n", nil, `Unknown choice "x"`},
+		{[]string{"touch a", "touch b"}, "s\ny\nn\n", []string{"a"}, "Run this step?"},
+		{[]string{"touch a", "touch b"}, "s\ny\nq\n", []string{"a"}, "Plan stopped by user"},
+		{[]string{"false", "touch b"}, "a\n", nil, "Step 1 failed; 1 remaining step(s) not run"},
+	}
+	for _, tt := range tests {
+		d, dir := newTestDryRun(t)
+		d.On = false
+		p := &AIProcessor{provider: &scriptedProvider{}, settings: &ModelSettings{}, assessor: d.assessor, policy: d.policy,
+			dryRun: d, sandbox: d.sandbox, session: d.session, mode: "ai"}
+
+		plan := &AIPlan{Reply: "test plan"}
+		for _, command := range tt.steps {
+			plan.Steps = append(plan.Steps, AIResponse{Shell: command})
+		}
+		var out syncBuffer
+		stdio := &IO{Input: bufio.NewReader(strings.NewReader(tt.input)), Stdout: &out, Stderr: &out}
+		audit := NewAuditLog(&AuditConfig{Disabled: true}, nil).Request("ai", "test", "", nil)
+		if _, err := p.runPlan(context.Background(), "test", plan, "", audit, stdio); err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []string
+		for _, entry := range entries {
+			files = append(files, entry.Name())
+		}
+		if !slices.Equal(files, tt.files) {
+			t.Errorf("%q with %q: files %q, want %q", tt.steps, tt.input, files, tt.files)
+		}
+		if !strings.Contains(out.String(), tt.output) {
+			t.Errorf("%q with %q: output does not contain %q:\n%s", tt.steps, tt.input, tt.output, out.String())
+		}
+	}
+}
+
+func TestRunPlanDryRun(t *testing.T) {
+	d, dir := newTestDryRun(t)
+	p := &AIProcessor{provider: &scriptedProvider{}, settings: &ModelSettings{}, assessor: d.assessor, policy: d.policy,
+		dryRun: d, sandbox: d.sandbox, session: d.session, mode: "ai"}
+
+	plan := &AIPlan{Reply: "test plan", Steps: []AIResponse{{Cmd: []string{"touch", "a b"}}}}
+	var out syncBuffer
+	stdio := &IO{Input: bufio.NewReader(strings.NewReader("")), Stdout: &out, Stderr: &out}
+	audit := NewAuditLog(&AuditConfig{Disabled: true}, nil).Request("ai", "test", "", nil)
+	if _, err := p.runPlan(context.Background(), "test", plan, "", audit, stdio); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a b")); err == nil {
+		t.Error("dry run ran the plan")
+	}
+	if d.last == nil || len(d.last.Steps) != 1 || d.last.Steps[0].cmd.String() != "touch 'a b'" {
+		t.Errorf("suggestion %+v", d.last)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfirmRisk is the risk at which commands are confirmed when the
+// policy does not say otherwise
+const defaultConfirmRisk = 7
+
+// criticalRisk is the local risk at which a command is always confirmed
+// outside YOLO modes, however the user answered for commands like it
+const criticalRisk = 9
+
+// PolicyAction is what a policy does with a command
+type PolicyAction string
+
+const (
+	PolicyAllow   PolicyAction = "allow"   // Run without confirmation
+	PolicyConfirm PolicyAction = "confirm" // Ask first, even in YOLO modes
+	PolicyDeny    PolicyAction = "deny"    // Never run, in any mode
+)
+
+// Policy decides which generated commands run, which are confirmed first and
+// which are refused. It is read from policy.yaml next to the config file, or
+// the file named by policy_file in the config.
+type Policy struct {
+	// ConfirmRisk is the risk at which commands no rule matches are confirmed
+	// in non-YOLO modes
+	ConfirmRisk int          `yaml:"confirm_risk"`
+	Rules       []PolicyRule `yaml:"rules"`
+
+	guard   *PathGuard
+	allowed map[string]bool // Patterns of commands the user allowed for the session
+}
+
+// PolicyRule applies an action to the commands it matches. Every criterion
+// given must match; a rule without criteria matches every command.
+type PolicyRule struct {
+	Name   string       `yaml:"name"`   // Shown when the rule applies
+	Action PolicyAction `yaml:"action"` // allow, confirm or deny
+	Reason string       `yaml:"reason"` // Why, shown when the rule applies
+	// Modes the rule applies in, e.g. ["ai", "ai-yolo"]. Without modes it
+	// applies in every mode but direct, which must be named to be covered.
+	Modes []string `yaml:"modes"`
+
+	Commands []string `yaml:"commands"` // Executable names, as globs, e.g. ["rm", "mkfs.*"]
+	Args     string   `yaml:"args"`     // Regular expression matched against the arguments, joined by spaces
+	Paths    []string `yaml:"paths"`    // Paths read or written, as globs; a match covers everything below it
+	MinRisk  int      `yaml:"min_risk"` // Lowest risk matched
+	MaxRisk  *int     `yaml:"max_risk"` // Highest risk matched
+
+	args *regexp.Regexp
+}
+
+// PolicyDecision is what the policy decided for a command
+type PolicyDecision struct {
+	Action PolicyAction
+	By     string // What decided, for the user; "" if only the risk score did
+}
+
+// Mandatory reports whether a rule or the path guard made the decision, so
+// it holds in YOLO modes and for plans approved as a whole
+func (d PolicyDecision) Mandatory() bool {
+	return d.By != ""
+}
+
+// describe names the rule for the user
+func (r *PolicyRule) describe() string {
+	text := "the policy"
+	if r.Name != "" {
+		text = fmt.Sprintf("policy rule %q", r.Name)
+	}
+	if r.Reason != "" {
+		text += ": " + r.Reason
+	}
+	return text
+}
+
+// policyPath returns the location of the policy file
+func policyPath(config *Config) (string, error) {
+	if config.PolicyFile != "" {
+		return config.PolicyFile, nil
+	}
+	path, err := configPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(path), "policy.yaml"), nil
+}
+
+// LoadPolicy reads the policy file and sets up the path guard. A missing
+// file gives the default policy, which confirms high-risk commands outside
+// YOLO modes.
+func LoadPolicy(config *Config) (*Policy, error) {
+	guard, err := NewPathGuard(&config.Guard)
+	if err != nil {
+		return nil, err
+	}
+	policy := &Policy{guard: guard}
+
+	path, err := policyPath(config)
+	if err == nil {
+		data, readErr := os.ReadFile(path)
+		if readErr == nil {
+			if err := yaml.Unmarshal(data, policy); err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+			}
+		} else if !errors.Is(readErr, os.ErrNotExist) || config.PolicyFile != "" {
+			return nil, fmt.Errorf("failed to read %s: %v", path, readErr)
+		}
+	}
+
+	if policy.ConfirmRisk <= 0 {
+		policy.ConfirmRisk = defaultConfirmRisk
+	}
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		switch rule.Action {
+		case PolicyAllow, PolicyConfirm, PolicyDeny:
+		default:
+			return nil, fmt.Errorf("rule %d in %s: action must be allow, confirm or deny, not %q", i+1, path, rule.Action)
+		}
+		if rule.Args != "" {
+			re, err := regexp.Compile(rule.Args)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d in %s: invalid args pattern %q: %v", i+1, path, rule.Args, err)
+			}
+			rule.args = re
+		}
+		for _, pattern := range append(slices.Clone(rule.Commands), rule.Paths...) {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %d in %s: invalid pattern %q: %v", i+1, path, pattern, err)
+			}
+		}
+	}
+	return policy, nil
+}
+
+// Covers reports whether any rule or the path guard applies in mode, so
+// modes such as direct only analyse commands when the policy asks for it
+func (p *Policy) Covers(mode string) bool {
+	return p.guards(mode) || slices.ContainsFunc(p.Rules, func(rule PolicyRule) bool { return rule.appliesIn(mode) })
+}
+
+// guards reports whether the path guard applies in mode
+func (p *Policy) guards(mode string) bool {
+	return mode != "direct" || p.guard.config.Direct
+}
+
+// Decide applies the policy to a command assessed as a in mode. dir is the
+// working directory relative paths are resolved against. The path guard or
+// the rules, whichever is stricter, decide; see decideByRules.
+func (p *Policy) Decide(mode string, a Assessment, dir string) PolicyDecision {
+	decision := p.decideByRules(mode, a, dir)
+	if !p.guards(mode) || decision.Action == PolicyDeny {
+		return decision
+	}
+	guarded := p.guard.Check(a, dir)
+	if severity(guarded.Action) > severity(decision.Action) ||
+		guarded.Action == PolicyConfirm && !decision.Mandatory() {
+		return guarded
+	}
+	return decision
+}
+
+// decideByRules applies the rules to a command. A deny rule wins over any
+// other, and a confirm rule over an allow rule; without a matching rule,
+// commands at ConfirmRisk or above are confirmed outside YOLO modes.
+func (p *Policy) decideByRules(mode string, a Assessment, dir string) PolicyDecision {
+	var confirm, allow *PolicyRule
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.appliesIn(mode) || !rule.matches(a, dir) {
+			continue
+		}
+		switch rule.Action {
+		case PolicyDeny:
+			return PolicyDecision{Action: PolicyDeny, By: rule.describe()}
+		case PolicyConfirm:
+			if confirm == nil {
+				confirm = rule
+			}
+		case PolicyAllow:
+			if allow == nil {
+				allow = rule
+			}
+		}
+	}
+
+	switch {
+	case confirm != nil:
+		return PolicyDecision{Action: PolicyConfirm, By: confirm.describe()}
+	case allow != nil:
+		return PolicyDecision{Action: PolicyAllow, By: allow.describe()}
+	case a.Risk >= p.ConfirmRisk && !strings.HasSuffix(mode, "-yolo") && !p.allowedForSession(a):
+		return PolicyDecision{Action: PolicyConfirm}
+	}
+	return PolicyDecision{Action: PolicyAllow}
+}
+
+// AllowForSession stops commands of pattern, as given by commandPattern,
+// being confirmed for their risk score alone until vibesh exits
+func (p *Policy) AllowForSession(pattern string) {
+	if p.allowed == nil {
+		p.allowed = map[string]bool{}
+	}
+	p.allowed[pattern] = true
+}
+
+// allowedForSession reports whether the user allowed commands like the one
+// assessed as a for the session. Critical commands never are.
+func (p *Policy) allowedForSession(a Assessment) bool {
+	return a.Local.Risk < criticalRisk && p.allowed[commandPattern(a.Local)]
+}
+
+func (r *PolicyRule) appliesIn(mode string) bool {
+	if len(r.Modes) == 0 {
+		return mode != "direct"
+	}
+	return slices.Contains(r.Modes, mode)
+}
+
+// matches reports whether the rule's criteria all hold for a command. The
+// criteria about executables must hold for one simple command in it.
+func (r *PolicyRule) matches(a Assessment, dir string) bool {
+	if a.Risk < r.MinRisk || r.MaxRisk != nil && a.Risk > *r.MaxRisk {
+		return false
+	}
+	if len(r.Commands) == 0 && r.args == nil && len(r.Paths) == 0 {
+		return true
+	}
+	for _, cmd := range a.Local.Commands {
+		if r.matchesCommand(cmd, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *PolicyRule) matchesCommand(cmd SimpleCommand, dir string) bool {
+	if len(r.Commands) > 0 && !slices.ContainsFunc(r.Commands, func(pattern string) bool {
+		ok, _ := filepath.Match(pattern, cmd.Name)
+		return ok
+	}) {
+		return false
+	}
+	if r.args != nil && !r.args.MatchString(strings.Join(cmd.Args, " ")) {
+		return false
+	}
+	if len(r.Paths) == 0 {
+		return true
+	}
+	// Writes are already resolved against any cd, operands are not
+	paths := slices.Clone(cmd.Writes)
+	for _, operand := range commandOperands(cmd.Args) {
+		if cmd.Dir != "" && !filepath.IsAbs(operand) && !strings.HasPrefix(operand, "~") {
+			operand = filepath.Join(cmd.Dir, operand)
+		}
+		paths = append(paths, operand)
+	}
+	for _, path := range paths {
+		path = expandPath(path, dir)
+		for _, pattern := range r.Paths {
+			if underPattern(path, expandPath(pattern, "")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expandPath expands a leading ~ and makes a relative path absolute against
+// dir, if dir is given
+func expandPath(path, dir string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[1:])
+		}
+	}
+	if dir != "" && !filepath.IsAbs(path) && !strings.HasPrefix(path, "$") {
+		path = filepath.Join(dir, path)
+	}
+	return filepath.Clean(path)
+}
+
+// underPattern reports whether path or one of the directories above it
+// matches pattern
+func underPattern(path, pattern string) bool {
+	for {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return false
+		}
+		path = parent
+	}
+}
+
+// sessionDir returns the working directory of the session, or vibesh's own
+// if the shell cannot be asked
+func sessionDir(session *Session) string {
+	if state, err := session.State(); err == nil {
+		return state.Dir
+	}
+	dir, _ := os.Getwd()
+	return dir
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPolicy = `
+confirm_risk: 6
+rules:
+  - name: protect-etc
+    action: deny
+    paths: ["/etc"]
+    reason: system configuration is managed by Ansible
+  - name: no-force-push-main
+    action: deny
+    commands: [git]
+    args: '^push\b.*(--force|-f)\b.*\bmain\b'
+  - name: careful-yolo
+    action: confirm
+    modes: [ai-yolo]
+    min_risk: 5
+  - name: read-only-tools
+    action: allow
+    modes: [ai]
+    commands: [kubectl]
+    args: '^(get|describe|logs)\b'
+  - name: no-curl-in-direct
+    action: confirm
+    modes: [direct]
+    commands: [curl]
+`
+
+// loadTestPolicy loads policy as the policy file, with a guard that leaves
+// writes in /work alone
+func loadTestPolicy(t *testing.T, policy string) (*Policy, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadPolicy(&Config{
+		PolicyFile: path,
+		Guard: GuardConfig{
+			Workspace:          "/work",
+			Writable:           defaultWritablePaths,
+			OnOutsideWorkspace: PolicyConfirm,
+			OnProtected:        PolicyConfirm,
+		},
+	})
+}
+
+func TestPolicyDecide(t *testing.T) {
+	policy, err := loadTestPolicy(t, testPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assessor := NewRiskAssessor(&RiskConfig{}, nil)
+
+	tests := []struct {
+		mode, src string
+		want      PolicyAction
+		by        string // Substring of who decided; empty if only the risk score did
+	}{
+		{"ai", "ls -la", PolicyAllow, ""},
+		{"ai", "cat /etc/hosts", PolicyDeny, "protect-etc"},
+		{"ai", "cd /etc && cat hosts", PolicyDeny, "protect-etc"},
+		{"ai", "echo 1 > /etc/motd", PolicyDeny, "managed by Ansible"},
+		{"ai-yolo", "sudo tee /etc/hosts", PolicyDeny, "protect-etc"},
+		{"ai", "git push --force origin main", PolicyDeny, "no-force-push-main"},
+		{"ai", "git push origin main", PolicyAllow, ""},
+		{"ai", "kubectl get pods", PolicyAllow, "read-only-tools"},
+		{"ai", "kubectl delete pod x", PolicyConfirm, ""},
+		{"ai", "rm -rf build", PolicyConfirm, ""},
+		{"ai-yolo", "rm -rf build", PolicyConfirm, "careful-yolo"},
+		{"agent-yolo", "rm -rf build", PolicyAllow, ""},
+		{"ai", "rm -rf /opt/app", PolicyConfirm, "path guard"},
+		{"ai", "touch ../x", PolicyConfirm, "path guard"},
+		{"direct", "touch ../x", PolicyAllow, ""},
+		{"direct", "curl example.com", PolicyConfirm, "no-curl-in-direct"},
+		{"ai", "curl example.com", PolicyAllow, ""},
+	}
+	for _, tt := range tests {
+		decision := policy.Decide(tt.mode, assessor.AssessLocal(NewShellCommand(tt.src)), "/work")
+		if decision.Action != tt.want || !strings.Contains(decision.By, tt.by) || (tt.by == "") != (decision.By == "") {
+			t.Errorf("%s: %q: got %s by %q, want %s by %q", tt.mode, tt.src, decision.Action, decision.By, tt.want, tt.by)
+		}
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		err    string // Substring of the error; empty when valid
+	}{
+		{"", ""},
+		{"rules: [{action: allow}]", ""},
+		{"rules: [{action: maybe}]", "action must be allow, confirm or deny"},
+		{"rules: [{action: deny, args: '('}]", "invalid args pattern"},
+		{"rules: [{action: deny, commands: ['[']}]", "invalid pattern"},
+		{"rules: [{action: deny, paths: ['/a[']}]", "invalid pattern"},
+		{"rules: {action: deny}", "failed to parse"},
+	}
+	for _, tt := range tests {
+		policy, err := loadTestPolicy(t, tt.policy)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%q: unexpected error %v", tt.policy, err)
+		case tt.err == "" && policy.ConfirmRisk != defaultConfirmRisk:
+			t.Errorf("%q: confirm_risk %d, want %d", tt.policy, policy.ConfirmRisk, defaultConfirmRisk)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%q: got error %v, want %q", tt.policy, err, tt.err)
+		}
+	}
+
+	if _, err := LoadPolicy(&Config{PolicyFile: filepath.Join(t.TempDir(), "missing.yaml"), Guard: GuardConfig{
+		Workspace: "/work", OnOutsideWorkspace: PolicyConfirm, OnProtected: PolicyConfirm,
+	}}); err == nil {
+		t.Error("a missing policy_file was accepted")
+	}
+}
+
+func TestUnderPattern(t *testing.T) {
+	tests := []struct {
+		path, pattern string
+		want          bool
+	}{
+		{"/etc", "/etc", true},
+		{"/etc/ssh/sshd_config", "/etc", true},
+		{"/etcetera", "/etc", false},
+		{"/home/me/.ssh/id_rsa", "/home/me/.*", true},
+		{"/home/me/src", "/home/me/.*", false},
+		{"/", "/etc", false},
+	}
+	for _, tt := range tests {
+		if got := underPattern(tt.path, tt.pattern); got != tt.want {
+			t.Errorf("underPattern(%q, %q) = %v", tt.path, tt.pattern, got)
+		}
+	}
+}
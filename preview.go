@@ -0,0 +1,651 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	maxDiffFileSize  = 1 << 20   // Larger files are reported without a diff
+	maxDiffCells     = 4_000_000 // Bounds the lines of one file times the lines of the other
+	maxDiffLines     = 400       // Diff lines shown for one preview
+	diffContextLines = 3
+)
+
+// ChangeKind is what a previewed command did to a file
+type ChangeKind string
+
+const (
+	ChangeCreated  ChangeKind = "created"
+	ChangeModified ChangeKind = "modified"
+	ChangeDeleted  ChangeKind = "deleted"
+)
+
+// Change is a file or directory a previewed command created, modified or
+// deleted
+type Change struct {
+	Kind ChangeKind
+	Path string // Relative to the previewed directory; directories end in /
+}
+
+// previewRunner runs a command in the sandbox with a fresh overlay over a
+// directory, for previewing
+type previewRunner struct {
+	sandbox *Sandbox
+	state   ShellState
+	overlay string // Made by makeOverlayDir
+	root    string // Directory given the overlay
+}
+
+func (r previewRunner) Run(ctx context.Context, command string, limits Limits, stdout, stderr io.Writer) (int, error) {
+	return r.sandbox.run(ctx, command, r.state, r.overlay, r.root, limits, stdout, stderr)
+}
+
+// previews reports whether a command assessed as a is previewed in mode:
+// one that writes, at or above the preview risk, that the sandbox does not
+// run anyway
+func (s *Sandbox) previews(mode string, a Assessment) bool {
+	preview := s.config.Preview
+	return preview.MinRisk > 0 && a.Writes && a.Risk >= preview.MinRisk &&
+		slices.Contains(preview.Modes, mode) && !s.Applies(mode, a.Risk)
+}
+
+// Execute runs a command assessed as a in mode the way the config says: in
+// the sandbox, previewed and then applied if the user agrees, or in the
+// session. Outside the sandbox, what the command writes is snapshotted first.
+// Wherever it runs, it is held to the limits for mode.
+func (s *Sandbox) Execute(ctx context.Context, mode string, a Assessment, cmd Command, stdio *IO) (*Result, error) {
+	limits := s.limits.For(mode, cmd)
+	switch {
+	case s.Applies(mode, a.Risk):
+		return execute(ctx, s, cmd.Source(), limits, stdio)
+	case s.previews(mode, a):
+		return s.preview(ctx, cmd, limits, stdio)
+	}
+	var snapshot *Snapshot
+	if a.Writes {
+		roots, err := snapshotRoots(a, sessionDir(s.session), s.workspace)
+		if err != nil {
+			warnNoSnapshot(stdio, err)
+		} else {
+			snapshot = s.snapshot(cmd, roots, stdio)
+		}
+	}
+	result, err := execute(ctx, s.session, cmd.Source(), limits, stdio)
+	s.finishSnapshot(snapshot, stdio)
+	return result, err
+}
+
+// snapshot records roots before cmd changes them, for `undo`, and returns
+// the snapshot, if one was taken. Failing to is reported but does not stop
+// the command.
+func (s *Sandbox) snapshot(cmd Command, roots []string, stdio *IO) *Snapshot {
+	snapshot, err := s.snapshots.Take(cmd.String(), roots)
+	if err != nil {
+		warnNoSnapshot(stdio, err)
+	}
+	return snapshot
+}
+
+// finishSnapshot records that the command snapshot was taken for is done,
+// so `undo` knows which new files it made
+func (s *Sandbox) finishSnapshot(snapshot *Snapshot, stdio *IO) {
+	if snapshot == nil {
+		return
+	}
+	if err := s.snapshots.Finish(snapshot); err != nil {
+		fmt.Fprintf(stdio.Stderr, "\033[1;33mWARNING: Undoing this command will not remove the files it created: %v\033[0m\n", err)
+	}
+}
+
+// warnNoSnapshot says why a command cannot be undone
+func warnNoSnapshot(stdio *IO, err error) {
+	fmt.Fprintf(stdio.Stderr, "\033[1;33mWARNING: No snapshot was taken, so this command cannot be undone: %v\033[0m\n", err)
+}
+
+// preview runs cmd in the sandbox on an overlay over the workspace, or
+// the working directory if it is outside the workspace, shows the changes it
+// made there and copies them to the real files if the user agrees
+func (s *Sandbox) preview(ctx context.Context, cmd Command, limits Limits, stdio *IO) (*Result, error) {
+	command := cmd.Source()
+	state, err := s.session.State()
+	if err != nil {
+		return &Result{Command: command, ExitCode: -1}, err
+	}
+	root := state.Dir
+	if underPattern(root, s.workspace) {
+		root = s.workspace
+	}
+	overlay, err := makeOverlayDir()
+	if err != nil {
+		return &Result{Command: command, ExitCode: -1}, fmt.Errorf("failed to prepare the preview: %v", err)
+	}
+	defer removeOverlayDir(overlay)
+	upper := filepath.Join(overlay, "upper")
+
+	fmt.Fprintf(stdio.Stdout, "\033[1;36mPreviewing on a copy of %s; nothing changes until you apply it.\033[0m\n", root)
+	result, err := execute(ctx, previewRunner{sandbox: s, state: state, overlay: overlay, root: root}, command, limits, stdio)
+	// A command stopped part way is not applied
+	if err != nil || ctx.Err() != nil || result.Limit != "" {
+		return result, err
+	}
+
+	changes, err := overlayChanges(upper, root)
+	if err != nil {
+		return result, fmt.Errorf("failed to read the preview: %v", err)
+	}
+	if len(changes) == 0 {
+		fmt.Fprintf(stdio.Stdout, "\nThe command changed nothing in %s.\n", root)
+		return result, nil
+	}
+	printChanges(stdio.Stdout, changes, upper, root)
+
+	fmt.Fprintf(stdio.Stdout, "Apply these changes to %s? [y/n]: ", root)
+	answer, _ := stdio.Input.ReadString('\n')
+	if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+		fmt.Fprintln(stdio.Stdout, "Changes discarded.")
+		// Tell the model, in the agent modes, that the command had no effect
+		note := "vibesh: the user discarded the changes this command made to files\n"
+		result.Stderr += note
+		result.Output += note
+		return result, nil
+	}
+	paths := make([]string, len(changes))
+	for i, change := range changes {
+		paths[i] = filepath.Join(root, change.Path)
+	}
+	snapshot := s.snapshot(cmd, topPaths(paths), stdio)
+	err = applyOverlay(upper, root)
+	s.finishSnapshot(snapshot, stdio)
+	if err != nil {
+		return result, fmt.Errorf("failed to apply the changes: %v", err)
+	}
+	fmt.Fprintln(stdio.Stdout, "Changes applied.")
+	return result, nil
+}
+
+// overlayChanges compares the upper directory of an overlay with the lower
+// directory it covered
+func overlayChanges(upper, lower string) ([]Change, error) {
+	var changes []Change
+	err := filepath.WalkDir(upper, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(upper, path)
+		if rel == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(lower, rel)
+		lowerInfo, lowerErr := os.Lstat(target)
+		exists := lowerErr == nil
+
+		switch {
+		case isWhiteout(info):
+			if exists {
+				changes = append(changes, deletedTree(target, rel)...)
+			}
+		case d.IsDir():
+			switch {
+			case exists && lowerInfo.IsDir() && isOpaque(path):
+				// The directory was replaced, so what is not in it now was deleted
+				entries, err := os.ReadDir(target)
+				if err != nil {
+					return err
+				}
+				for _, entry := range entries {
+					if _, err := os.Lstat(filepath.Join(path, entry.Name())); errors.Is(err, fs.ErrNotExist) {
+						changes = append(changes, deletedTree(filepath.Join(target, entry.Name()), filepath.Join(rel, entry.Name()))...)
+					}
+				}
+			case exists && lowerInfo.IsDir():
+				if lowerInfo.Mode().Perm() != info.Mode().Perm() {
+					changes = append(changes, Change{Kind: ChangeModified, Path: rel + "/"})
+				}
+			default:
+				if exists {
+					changes = append(changes, Change{Kind: ChangeDeleted, Path: rel})
+				}
+				changes = append(changes, Change{Kind: ChangeCreated, Path: rel + "/"})
+			}
+		default:
+			switch {
+			case !exists:
+				changes = append(changes, Change{Kind: ChangeCreated, Path: rel})
+			case lowerInfo.IsDir():
+				changes = append(changes, deletedTree(target, rel)...)
+				changes = append(changes, Change{Kind: ChangeCreated, Path: rel})
+			case fileChanged(path, target, info, lowerInfo):
+				changes = append(changes, Change{Kind: ChangeModified, Path: rel})
+			}
+		}
+		return nil
+	})
+	slices.SortStableFunc(changes, func(a, b Change) int { return strings.Compare(a.Path, b.Path) })
+	return changes, err
+}
+
+// deletedTree lists path, shown as rel, and everything below it as deleted
+func deletedTree(path, rel string) []Change {
+	var changes []Change
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		sub, _ := filepath.Rel(path, p)
+		name := filepath.Join(rel, sub)
+		if d.IsDir() {
+			name += "/"
+		}
+		changes = append(changes, Change{Kind: ChangeDeleted, Path: name})
+		return nil
+	})
+	return changes
+}
+
+// applyOverlay copies the changes in the upper directory of an overlay to
+// the lower directory: deleted files are removed, replaced directories
+// emptied first, and new and changed files copied with their permissions
+func applyOverlay(upper, lower string) error {
+	return filepath.WalkDir(upper, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(upper, path)
+		if rel == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(lower, rel)
+		lowerInfo, lowerErr := os.Lstat(target)
+
+		switch {
+		case isWhiteout(info):
+			return os.RemoveAll(target)
+		case d.IsDir():
+			if lowerErr == nil && (!lowerInfo.IsDir() || isOpaque(path)) {
+				if err := os.RemoveAll(target); err != nil {
+					return err
+				}
+				lowerErr = fs.ErrNotExist
+			}
+			if lowerErr != nil {
+				return os.Mkdir(target, info.Mode().Perm())
+			}
+			return os.Chmod(target, info.Mode().Perm())
+		}
+
+		if lowerErr == nil {
+			if !lowerInfo.IsDir() && !fileChanged(path, target, info, lowerInfo) {
+				return nil
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		}
+		return fmt.Errorf("cannot apply %s: unsupported file type %s", rel, info.Mode().Type())
+	})
+}
+
+// isWhiteout reports whether an overlay file marks a deleted file
+func isWhiteout(info fs.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode()&fs.ModeCharDevice != 0 && stat.Rdev == 0
+}
+
+// isOpaque reports whether an overlay directory hides the lower one, as it
+// does when a directory is deleted and made again
+func isOpaque(path string) bool {
+	value := make([]byte, 1)
+	n, err := unix.Lgetxattr(path, "user.overlay.opaque", value)
+	return err == nil && n == 1 && value[0] == 'y'
+}
+
+// fileChanged reports whether two non-directories differ in type,
+// permissions or contents
+func fileChanged(a, b string, aInfo, bInfo fs.FileInfo) bool {
+	if aInfo.Mode() != bInfo.Mode() {
+		return true
+	}
+	if aInfo.Mode()&fs.ModeSymlink != 0 {
+		aLink, _ := os.Readlink(a)
+		bLink, _ := os.Readlink(b)
+		return aLink != bLink
+	}
+	if aInfo.Size() != bInfo.Size() {
+		return true
+	}
+	same, err := sameContents(a, b)
+	return err != nil || !same
+}
+
+// sameContents reports whether two files have the same contents
+func sameContents(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA, bufB := make([]byte, 64*1024), make([]byte, 64*1024)
+	for {
+		n, errA := io.ReadFull(fa, bufA)
+		m, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:n], bufB[:m]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// copyFile copies src to a new file dst with permissions perm
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// The umask may have narrowed the permissions
+	return os.Chmod(dst, perm)
+}
+
+// printChanges lists the changes a previewed command made, then the diffs
+// of the text files it created or modified
+func printChanges(w io.Writer, changes []Change, upper, lower string) {
+	fmt.Fprintf(w, "\nChanges to %s:\n", lower)
+	for _, change := range changes {
+		color := "\033[1;33m"
+		switch change.Kind {
+		case ChangeCreated:
+			color = "\033[1;32m"
+		case ChangeDeleted:
+			color = "\033[1;31m"
+		}
+		fmt.Fprintf(w, "  %s%-8s\033[0m  %s\n", color, change.Kind, change.Path)
+	}
+	fmt.Fprintln(w)
+
+	budget := maxDiffLines
+	for _, change := range changes {
+		if change.Kind == ChangeDeleted || strings.HasSuffix(change.Path, "/") {
+			continue
+		}
+		if budget <= 0 {
+			fmt.Fprintln(w, "... (more diffs not shown)")
+			fmt.Fprintln(w)
+			return
+		}
+		before := ""
+		if change.Kind == ChangeModified {
+			before = filepath.Join(lower, change.Path)
+		}
+		budget -= printFileDiff(w, change.Path, before, filepath.Join(upper, change.Path), budget)
+	}
+}
+
+// printFileDiff shows the difference between the files before and after,
+// named path, as a unified diff of at most limit lines; before is "" for a
+// new file. It returns the number of lines shown.
+func printFileDiff(w io.Writer, path, before, after string, limit int) int {
+	info, err := os.Lstat(after)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	if before != "" {
+		if same, _ := sameContents(before, after); same {
+			oldInfo, _ := os.Lstat(before)
+			fmt.Fprintf(w, "%s: mode changed from %v to %v\n\n", path, oldInfo.Mode().Perm(), info.Mode().Perm())
+			return 1
+		}
+	}
+	var old, cur []byte
+	if before != "" {
+		if old, err = readText(before); err != nil {
+			fmt.Fprintf(w, "%s: %v\n\n", path, err)
+			return 1
+		}
+	}
+	if cur, err = readText(after); err != nil {
+		fmt.Fprintf(w, "%s: %v\n\n", path, err)
+		return 1
+	}
+
+	hunks := diffHunks(splitLines(string(old)), splitLines(string(cur)))
+	if hunks == nil {
+		fmt.Fprintf(w, "%s: too many lines to diff\n\n", path)
+		return 1
+	}
+	from := "a/" + path
+	if before == "" {
+		from = "/dev/null"
+	}
+	fmt.Fprintf(w, "\033[1m--- %s\n+++ b/%s\033[0m\n", from, path)
+	shown := 2
+	for _, line := range hunks {
+		if shown >= limit {
+			fmt.Fprintln(w, "... (diff truncated)")
+			shown++
+			break
+		}
+		switch line[0] {
+		case '@':
+			fmt.Fprintf(w, "\033[36m%s\033[0m\n", line)
+		case '-':
+			fmt.Fprintf(w, "\033[31m%s\033[0m\n", line)
+		case '+':
+			fmt.Fprintf(w, "\033[32m%s\033[0m\n", line)
+		default:
+			fmt.Fprintln(w, line)
+		}
+		shown++
+	}
+	fmt.Fprintln(w)
+	return shown
+}
+
+// readText reads a file that is small enough to diff and looks like text
+func readText(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > maxDiffFileSize {
+		return nil, errors.New("too large to diff")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(data) {
+		return nil, errors.New("binary file")
+	}
+	return data, nil
+}
+
+// splitLines splits text into lines without their newlines
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffOp is one line of an edit script: ' ' kept, '-' removed or '+' added
+type diffOp struct {
+	kind byte
+	text string
+}
+
+// diffHunks returns the unified diff of two texts, as lines with hunk
+// headers, or nil if they are too long to compare
+func diffHunks(a, b []string) []string {
+	ops := diffLines(a, b)
+	if ops == nil {
+		return nil
+	}
+
+	// Lines of a and of b before each op, for the hunk headers
+	aPos, bPos := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		aPos[i+1], bPos[i+1] = aPos[i], bPos[i]
+		if op.kind != '+' {
+			aPos[i+1]++
+		}
+		if op.kind != '-' {
+			bPos[i+1]++
+		}
+	}
+
+	lines := []string{}
+	for i := 0; i < len(ops); {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+		// Changes separated by a few kept lines share a hunk
+		start, end := max(0, i-diffContextLines), i
+		for {
+			for end < len(ops) && ops[end].kind != ' ' {
+				end++
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next < len(ops) && next-end <= 2*diffContextLines {
+				end = next
+				continue
+			}
+			end = min(len(ops), end+diffContextLines)
+			break
+		}
+
+		aCount, bCount := aPos[end]-aPos[start], bPos[end]-bPos[start]
+		aStart, bStart := aPos[start], bPos[start]
+		if aCount > 0 {
+			aStart++
+		}
+		if bCount > 0 {
+			bStart++
+		}
+		lines = append(lines, fmt.Sprintf("@@ -%d,%d +%d,%d @@", aStart, aCount, bStart, bCount))
+		for _, op := range ops[start:end] {
+			lines = append(lines, string(op.kind)+op.text)
+		}
+		i = end
+	}
+	return lines
+}
+
+// diffLines returns an edit script turning a into b, from their longest
+// common subsequence of lines, or nil if they are too long to compare
+func diffLines(a, b []string) []diffOp {
+	// Lines the two share at the start and end need no comparing
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(midA)*len(midB) > maxDiffCells {
+		return nil
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// midA[i:] and midB[j:]
+	lcs := make([][]int32, len(midA)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(midB)+1)
+	}
+	for i := len(midA) - 1; i >= 0; i-- {
+		for j := len(midB) - 1; j >= 0; j-- {
+			if midA[i] == midB[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	i, j := 0, 0
+	for i < len(midA) || j < len(midB) {
+		switch {
+		case i < len(midA) && j < len(midB) && midA[i] == midB[j]:
+			ops = append(ops, diffOp{' ', midA[i]})
+			i++
+			j++
+		case j < len(midB) && (i == len(midA) || lcs[i][j+1] > lcs[i+1][j]):
+			ops = append(ops, diffOp{'+', midB[j]})
+			j++
+		default:
+			ops = append(ops, diffOp{'-', midA[i]})
+			i++
+		}
+	}
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// writeTree creates files, keyed by path relative to dir; a path ending in
+// / is a directory
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// whiteout marks path deleted, as overlayfs does
+func whiteout(t *testing.T, path string) {
+	t.Helper()
+	if err := unix.Mknod(path, unix.S_IFCHR, 0); err != nil {
+		t.Skipf("cannot make a whiteout: %v", err)
+	}
+}
+
+func TestOverlayChanges(t *testing.T) {
+	upper, lower := t.TempDir(), t.TempDir()
+	writeTree(t, lower, map[string]string{
+		"same.txt":      "same",
+		"edited.txt":    "before",
+		"removed.txt":   "gone",
+		"old/a.txt":     "a",
+		"old/sub/b.txt": "b",
+		"dir/":          "",
+		"file":          "becomes a directory",
+	})
+	writeTree(t, upper, map[string]string{
+		"same.txt":   "same",
+		"edited.txt": "after",
+		"new/c.txt":  "c",
+		"dir/d.txt":  "d",
+		"file/e.txt": "e",
+	})
+	whiteout(t, filepath.Join(upper, "removed.txt"))
+	whiteout(t, filepath.Join(upper, "old"))
+	whiteout(t, filepath.Join(upper, "never-existed"))
+
+	changes, err := overlayChanges(upper, lower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{ChangeCreated, "dir/d.txt"},
+		{ChangeModified, "edited.txt"},
+		{ChangeDeleted, "file"},
+		{ChangeCreated, "file/"},
+		{ChangeCreated, "file/e.txt"},
+		{ChangeCreated, "new/"},
+		{ChangeCreated, "new/c.txt"},
+		{ChangeDeleted, "old/"},
+		{ChangeDeleted, "old/a.txt"},
+		{ChangeDeleted, "old/sub/"},
+		{ChangeDeleted, "old/sub/b.txt"},
+		{ChangeDeleted, "removed.txt"},
+	}
+	if !slices.Equal(changes, want) {
+		t.Errorf("changes:\n got %v\nwant %v", changes, want)
+	}
+
+	if err := applyOverlay(upper, lower); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{
+		"same.txt": "same", "edited.txt": "after", "new/c.txt": "c", "dir/d.txt": "d", "file/e.txt": "e",
+	} {
+		if data, err := os.ReadFile(filepath.Join(lower, name)); err != nil || string(data) != contents {
+			t.Errorf("%s after applying: %q, %v", name, data, err)
+		}
+	}
+	for _, name := range []string{"removed.txt", "old", "never-existed"} {
+		if _, err := os.Lstat(filepath.Join(lower, name)); !os.IsNotExist(err) {
+			t.Errorf("%s still exists after applying", name)
+		}
+	}
+}
+
+func TestOverlayModeChanges(t *testing.T) {
+	upper, lower := t.TempDir(), t.TempDir()
+	writeTree(t, lower, map[string]string{"run.sh": "echo", "bin/": ""})
+	writeTree(t, upper, map[string]string{"run.sh": "echo", "bin/": ""})
+	if err := os.Chmod(filepath.Join(upper, "run.sh"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(upper, "bin"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := overlayChanges(upper, lower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{{ChangeModified, "bin/"}, {ChangeModified, "run.sh"}}
+	if !slices.Equal(changes, want) {
+		t.Errorf("changes: got %v, want %v", changes, want)
+	}
+}
+
+func TestDiffHunks(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []string
+	}{
+		{"same", "a\nb\n", "a\nb\n", []string{}},
+		{"new file", "", "a\nb\n", []string{"@@ -0,0 +1,2 @@", "+a", "+b"}},
+		{"deleted lines", "a\nb\n", "", []string{"@@ -1,2 +0,0 @@", "-a", "-b"}},
+		{"changed line", "1\n2\n3\n4\n5\n6\n7\n8\n9\n", "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			[]string{"@@ -2,7 +2,7 @@", " 2", " 3", " 4", "-5", "+five", " 6", " 7", " 8"}},
+		{"separate hunks", "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n", "x\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ny\n",
+			[]string{"@@ -1,4 +1,4 @@", "-1", "+x", " 2", " 3", " 4", "@@ -9,4 +9,4 @@", " 9", " 10", " 11", "-12", "+y"}},
+		{"joined hunks", "1\n2\n3\n4\n5\n", "x\n2\n3\n4\ny\n",
+			[]string{"@@ -1,5 +1,5 @@", "-1", "+x", " 2", " 3", " 4", "-5", "+y"}},
+	}
+	for _, tt := range tests {
+		if got := diffHunks(splitLines(tt.a), splitLines(tt.b)); !slices.Equal(got, tt.want) {
+			t.Errorf("%s:\n got %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxResponseAttempts bounds how often the model is asked again after
+// returning a response that fails validation
+const maxResponseAttempts = 3
+
+// maxPlanSteps bounds the number of steps in one plan
+const maxPlanSteps = 20
+
+// stepSchema describes one step of a plan
+var stepSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"reply": map[string]interface{}{
+			"type":        "string",
+			"description": "One friendly sentence of what this step does",
+		},
+		"cmd": map[string]interface{}{
+			"type":        "array",
+			"description": "Array: [\"executable\", \"arg1\", \"arg2\", …], passed to the executable exactly as given. Empty when shell is used",
+			"items": map[string]interface{}{
+				"type": "string",
+			},
+		},
+		"shell": map[string]interface{}{
+			"type":        "string",
+			"description": "Shell source, only when a pipeline, redirection, glob or variable is needed. Empty when cmd is used",
+		},
+		"risk_score": map[string]interface{}{
+			"type":        "integer",
+			"description": "0 (no risk) to 10 (extremely risky)",
+		},
+		"does_read": map[string]interface{}{
+			"type":        "boolean",
+			"description": "true if it reads from disk, network, etc.",
+		},
+		"does_write": map[string]interface{}{
+			"type":        "boolean",
+			"description": "true if it writes/modifies/deletes data",
+		},
+	},
+	"required":             []string{"reply", "cmd", "shell", "risk_score", "does_read", "does_write"},
+	"additionalProperties": false,
+}
+
+// planTool is the tool the model must call to propose commands. The schema
+// is strict: every property is required and no others are allowed.
+var planTool = ToolSpec{
+	Name:        "generate_shell_plan",
+	Description: "Generate the shell commands that carry out the user's request, as ordered steps",
+	Strict:      true,
+	Parameters: map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"reply": map[string]interface{}{
+				"type":        "string",
+				"description": "One friendly sentence of what you will do overall",
+			},
+			"steps": map[string]interface{}{
+				"type":        "array",
+				"description": "Commands to run in order; one step when one command is enough",
+				"items":       stepSchema,
+			},
+		},
+		"required":             []string{"reply", "steps"},
+		"additionalProperties": false,
+	},
+}
+
+// AIPlan is an ordered list of commands proposed by the AI
+type AIPlan struct {
+	Reply string       `json:"reply"` // Friendly explanation of the plan as a whole
+	Steps []AIResponse `json:"steps"` // Commands to run in order
+}
+
+// Validate checks the parts of a plan the schema cannot express
+func (p *AIPlan) Validate() error {
+	if len(p.Steps) == 0 {
+		return errors.New("steps must contain at least one step")
+	}
+	if len(p.Steps) > maxPlanSteps {
+		return fmt.Errorf("steps must contain at most %d steps, got %d", maxPlanSteps, len(p.Steps))
+	}
+	for i := range p.Steps {
+		if err := p.Steps[i].Validate(); err != nil {
+			return fmt.Errorf("step %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the parts of a response the schema cannot express
+func (r *AIResponse) Validate() error {
+	hasShell := strings.TrimSpace(r.Shell) != ""
+	switch {
+	case len(r.Cmd) > 0 && hasShell:
+		return errors.New("give either cmd or shell, not both")
+	case len(r.Cmd) == 0 && !hasShell:
+		return errors.New("cmd must contain at least the executable, or shell must be given")
+	case len(r.Cmd) > 0 && strings.TrimSpace(r.Cmd[0]) == "":
+		return errors.New("cmd must start with the executable")
+	}
+	if r.RiskScore < 0 || r.RiskScore > 10 {
+		return fmt.Errorf("risk_score must be between 0 and 10, got %d", r.RiskScore)
+	}
+	return nil
+}
+
+// Command returns the command to run, keeping argv boundaries unless the
+// model asked for the shell
+func (r *AIResponse) Command() Command {
+	if strings.TrimSpace(r.Shell) != "" {
+		return NewShellCommand(r.Shell)
+	}
+	return NewArgvCommand(r.Cmd...)
+}
+
+// validator is a tool call's arguments that can check themselves
+type validator interface {
+	Validate() error
+}
+
+// decodeArguments decodes the arguments of a tool call into v, rejecting
+// unknown fields, and validates them
+func decodeArguments(arguments string, v validator) error {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(arguments)))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid JSON arguments: %v", err)
+	}
+	return v.Validate()
+}
+
+// requestAIPlan asks the model for a plan
+func requestAIPlan(ctx context.Context, provider Provider, settings *ModelSettings, messages []ChatMessage) (*AIPlan, error) {
+	var plan AIPlan
+	// runCommandTool is offered only because history replays calls of it
+	_, _, err := requestToolCall(ctx, provider, settings, messages, []ToolSpec{planTool, runCommandTool}, planTool.Name,
+		func(call ToolCall) error {
+			plan = AIPlan{}
+			return decodeArguments(call.Arguments, &plan)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// requestToolCall asks the model to call one of tools, as chosen by choice,
+// and returns the conversation extended with its reply along with the first
+// call, which parse accepted. A reply that calls no tool, or a call parse
+// rejects, is sent back with the error so the model can correct itself, up
+// to maxResponseAttempts times. Any other calls in the reply are left for the
+// caller to answer.
+func requestToolCall(ctx context.Context, provider Provider, settings *ModelSettings, messages []ChatMessage,
+	tools []ToolSpec, choice string, parse func(ToolCall) error) ([]ChatMessage, ToolCall, error) {
+	var lastErr error
+	for attempt := 1; attempt <= maxResponseAttempts; attempt++ {
+		// The timeout covers only the API call, not the command that follows
+		reqCtx, cancel := context.WithTimeout(ctx, settings.RequestTimeout())
+		resp, err := provider.Chat(reqCtx, ChatRequest{
+			Messages:   messages,
+			Tools:      tools,
+			ToolChoice: choice,
+			Settings:   settings.For(provider),
+		})
+		cancel()
+		if err != nil {
+			return nil, ToolCall{}, fmt.Errorf("%s API error: %v", provider.Name(), err)
+		}
+
+		messages = append(messages, resp.Message())
+
+		if len(resp.ToolCalls) == 0 {
+			lastErr = fmt.Errorf("model replied without calling a tool: %q", resp.Content)
+			messages = append(messages, ChatMessage{
+				Role:    RoleUser,
+				Content: "Respond by calling one of the tools.",
+			})
+			continue
+		}
+
+		call := resp.ToolCalls[0]
+		err = fmt.Errorf("unknown tool %q", call.Name)
+		for _, tool := range tools {
+			if tool.Name == call.Name {
+				err = parse(call)
+			}
+		}
+		if err == nil {
+			return messages, call, nil
+		}
+		lastErr = fmt.Errorf("%v\nRaw response: %s", err, call.Arguments)
+
+		// Every tool call must be answered before the model can try again
+		for _, c := range resp.ToolCalls {
+			result := "Not run."
+			if c.ID == call.ID {
+				result = "Invalid arguments: " + err.Error() + ". Call the tool again with corrected arguments."
+			}
+			messages = append(messages, ChatMessage{Role: RoleTool, Content: result, ToolCallID: c.ID})
+		}
+	}
+	return nil, ToolCall{}, fmt.Errorf("failed to get a valid AI response after %d attempts: %v", maxResponseAttempts, lastErr)
+}
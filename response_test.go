@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDecodePlan(t *testing.T) {
+	tests := []struct {
+		name      string
+		arguments string
+		err       string // Substring of the error; empty when valid
+	}{
+		{"argv", `{"reply":"r","steps":[{"reply":"s","cmd":["ls","-la"],"shell":"","risk_score":0,"does_read":true,"does_write":false}]}`, ""},
+		{"shell", `{"reply":"r","steps":[{"reply":"s","cmd":[],"shell":"ls | wc -l","risk_score":1,"does_read":true,"does_write":false}]}`, ""},
+		{"no steps", `{"reply":"r","steps":[]}`, "at least one step"},
+		{"unknown field", `{"reply":"r","steps":[],"extra":1}`, "unknown field"},
+		{"unknown step field", `{"reply":"r","steps":[{"cmd":["ls"],"sudo":true}]}`, "unknown field"},
+		{"not json", `ls -la`, "invalid JSON"},
+		{"both", `{"reply":"r","steps":[{"cmd":["ls"],"shell":"ls"}]}`, "step 1: give either cmd or shell"},
+		{"neither", `{"reply":"r","steps":[{"cmd":[],"shell":"  "}]}`, "cmd must contain"},
+		{"empty executable", `{"reply":"r","steps":[{"cmd":[" ","x"]}]}`, "must start with the executable"},
+		{"risk too high", `{"reply":"r","steps":[{"cmd":["ls"],"risk_score":11}]}`, "risk_score must be between"},
+		{"risk negative", `{"reply":"r","steps":[{"cmd":["ls"]},{"cmd":["ls"],"risk_score":-1}]}`, "step 2: risk_score"},
+		{"too many steps", `{"reply":"r","steps":[` + strings.Repeat(`{"cmd":["ls"]},`, maxPlanSteps) + `{"cmd":["ls"]}]}`, "at most"},
+	}
+	for _, tt := range tests {
+		var plan AIPlan
+		err := decodeArguments(tt.arguments, &plan)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestAIResponseCommand(t *testing.T) {
+	tests := []struct {
+		response AIResponse
+		text     string
+		shell    bool
+	}{
+		{AIResponse{Cmd: []string{"echo", "a b"}}, "echo 'a b'", false},
+		{AIResponse{Shell: "echo $HOME"}, "echo $HOME", true},
+	}
+	for _, tt := range tests {
+		command := tt.response.Command()
+		if command.String() != tt.text || (command.Kind == ShellCommand) != tt.shell {
+			t.Errorf("%+v: got %q, %v", tt.response, command.String(), command.Kind)
+		}
+	}
+}
+
+// scriptedProvider replies with the given responses in turn
+type scriptedProvider struct {
+	responses []*ChatResponse
+	requests  []ChatRequest
+}
+
+func (p *scriptedProvider) Name() string  { return "scripted" }
+func (p *scriptedProvider) Model() string { return "test" }
+
+func (p *scriptedProvider) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	p.requests = append(p.requests, req)
+	resp := p.responses[0]
+	p.responses = p.responses[1:]
+	return resp, nil
+}
+
+func TestRequestAIPlanRetries(t *testing.T) {
+	valid := ToolCall{ID: "2", Name: planTool.Name, Arguments: `{"reply":"r","steps":[{"cmd":["ls"]}]}`}
+	provider := &scriptedProvider{responses: []*ChatResponse{
+		{Content: "I would run ls"},
+		{ToolCalls: []ToolCall{{ID: "1", Name: planTool.Name, Arguments: `{"reply":"r","steps":[]}`}}},
+		{ToolCalls: []ToolCall{valid}},
+	}}
+	plan, err := requestAIPlan(context.Background(), provider, &ModelSettings{}, []ChatMessage{{Role: RoleUser, Content: "list"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Steps) != 1 || plan.Steps[0].Cmd[0] != "ls" {
+		t.Errorf("plan %+v", plan)
+	}
+	// The rejected call is answered with the error before the model tries again
+	last := provider.requests[2].Messages
+	if answer := last[len(last)-1]; answer.Role != RoleTool || answer.ToolCallID != "1" || !strings.Contains(answer.Content, "at least one step") {
+		t.Errorf("rejected call answered with %+v", answer)
+	}
+
+	provider = &scriptedProvider{responses: []*ChatResponse{{Content: "no"}, {Content: "no"}, {Content: "no"}}}
+	if _, err := requestAIPlan(context.Background(), provider, &ModelSettings{}, nil); err == nil || !strings.HasPrefix(err.Error(), "failed to get a valid AI response") {
+		t.Errorf("got %v after %d attempts", err, maxResponseAttempts)
+	}
+}
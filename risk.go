@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// maxAnalysisDepth bounds how deeply code passed to `sh -c` or `eval` is
+// analysed in turn
+const maxAnalysisDepth = 4
+
+// Analysis is the risk of a command as assessed locally, without the model
+type Analysis struct {
+	Risk     int             // 0 (no risk) to 10 (extremely risky)
+	Reads    bool            // Whether it reads files or system state
+	Writes   bool            // Whether it creates, modifies or deletes data
+	Network  bool            // Whether it talks to other machines
+	Commands []SimpleCommand // Every simple command found, in order
+	Reasons  []string        // Why the risk is what it is, riskiest first
+}
+
+// SimpleCommand is one executable run by a command, with any wrappers such
+// as sudo or env stripped
+type SimpleCommand struct {
+	Name     string   // Executable, e.g. "rm"
+	Args     []string // Arguments as written, with variables unexpanded
+	Elevated bool     // Whether it runs through sudo or doas
+	Dir      string   // Directory set by a preceding cd, "" for the current one
+	Writes   []string // Paths it writes, deletes or redirects output into, resolved against any preceding cd
+}
+
+// finding is one reason for a command's risk
+type finding struct {
+	risk   int
+	reason string
+}
+
+// analyser accumulates the analysis of one command line
+type analyser struct {
+	analysis Analysis
+	findings []finding
+	dir      string   // Directory set by the latest literal cd, "" for the current one
+	redirect []string // Output targets of the statement whose command is next
+}
+
+// AnalyzeCommand assesses the risk of cmd by parsing it and checking every
+// simple command, redirection and pipeline against commandRules
+func AnalyzeCommand(cmd Command) Analysis {
+	a := &analyser{}
+	if cmd.Kind == ArgvCommand {
+		// No shell is involved, so nothing is expanded
+		a.call(cmd.Argv, false, 0)
+	} else {
+		a.source(cmd.Shell, 0)
+	}
+	return a.finish()
+}
+
+// source parses shell source and analyses every node of it
+func (a *analyser) source(src string, depth int) {
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+	if err != nil {
+		// The shell will probably reject it too, but it cannot be vouched for
+		a.add(5, fmt.Sprintf("could not be parsed (%v)", err))
+		return
+	}
+
+	syntax.Walk(file, func(node syntax.Node) bool {
+		switch node := node.(type) {
+		case *syntax.Stmt:
+			a.redirect = nil
+			for _, redirect := range node.Redirs {
+				if path := a.redirection(redirect); path != "" {
+					// Visited next, unless the statement is a compound command
+					if _, ok := node.Cmd.(*syntax.CallExpr); ok {
+						a.redirect = append(a.redirect, path)
+					}
+				}
+			}
+		case *syntax.CallExpr:
+			words := make([]string, len(node.Args))
+			for i, word := range node.Args {
+				words[i] = wordText(word)
+			}
+			a.call(words, true, depth)
+		case *syntax.BinaryCmd:
+			if node.Op == syntax.Pipe || node.Op == syntax.PipeAll {
+				a.pipe(node)
+			}
+		case *syntax.FuncDecl:
+			if callsItself(node) {
+				a.add(10, fmt.Sprintf("function %s calls itself, as a fork bomb does", node.Name.Value))
+			}
+		}
+		return true
+	})
+}
+
+// call analyses one simple command. expanded says whether the shell expands
+// its words, so globs and variables in them are live.
+func (a *analyser) call(words []string, expanded bool, depth int) {
+	if len(words) == 0 {
+		return
+	}
+
+	words, elevated := unwrap(words)
+	if len(words) == 0 {
+		if elevated {
+			a.add(6, "starts a root shell")
+		}
+		return
+	}
+
+	name := filepath.Base(words[0])
+	args := words[1:]
+	cmd := SimpleCommand{Name: name, Args: args, Elevated: elevated, Dir: a.dir, Writes: a.redirect}
+	a.redirect = nil
+	operands := commandOperands(args)
+
+	start := len(a.findings)
+	a.rule(&cmd, operands, expanded)
+
+	switch {
+	case name == "cd":
+		a.cd(operands)
+	case shellInterpreters[name] && hasOption(args, "-c"):
+		// Analyse the code the shell is asked to run
+		if code := optionValue(args, "-c"); code != "" && depth < maxAnalysisDepth {
+			a.source(code, depth+1)
+		} else {
+			a.add(unknownCommandRisk, fmt.Sprintf("%s runs code that cannot be analysed", name))
+		}
+	case name == "eval" && depth < maxAnalysisDepth:
+		a.source(strings.Join(args, " "), depth+1)
+	case name == "find":
+		// find -exec runs a command of its own on every file it finds
+		for i, arg := range args {
+			if arg == "-exec" || arg == "-execdir" || arg == "-ok" {
+				end := i + 1
+				for end < len(args) && args[end] != ";" && args[end] != `\;` && args[end] != "+" {
+					end++
+				}
+				a.call(args[i+1:end], false, depth)
+				// Deleting what it finds puts everything under its roots at stake
+				if inner, _ := unwrap(args[i+1 : end]); len(inner) > 0 && commandRules[filepath.Base(inner[0])].destructive {
+					for _, root := range writeTargets(targetFindRoots, operands) {
+						a.target(&cmd, root, true, expanded)
+					}
+				}
+			}
+		}
+	}
+
+	if elevated {
+		risk := 0
+		for _, f := range a.findings[start:] {
+			risk = max(risk, f.risk)
+		}
+		a.add(min(10, max(risk+1, 5)), fmt.Sprintf("runs %s with elevated privileges", name))
+	}
+	a.analysis.Commands = append(a.analysis.Commands, cmd)
+}
+
+// unwrap strips wrappers such as `sudo` and `env FOO=1` from a command,
+// reporting whether one of them runs it as root
+func unwrap(words []string) ([]string, bool) {
+	elevated := false
+	for len(words) > 0 {
+		name := filepath.Base(words[0])
+		skip, ok := commandWrappers[name]
+		if !ok {
+			break
+		}
+		if elevatingWrappers[name] {
+			elevated = true
+		}
+		words = words[1:]
+		for len(words) > 0 && (strings.HasPrefix(words[0], "-") || name == "env" && strings.Contains(words[0], "=")) {
+			if slices.Contains(wrapperValueOptions[name], words[0]) && len(words) > 1 {
+				words = words[1:]
+			}
+			words = words[1:]
+		}
+		words = words[min(skip, len(words)):]
+	}
+	return words, elevated
+}
+
+// rule applies the rule database to a simple command
+func (a *analyser) rule(cmd *SimpleCommand, operands []string, expanded bool) {
+	rule, ok := commandRules[cmd.Name]
+	if !ok {
+		// e.g. mkfs.ext4 is covered by mkfs
+		if prefix, _, found := strings.Cut(cmd.Name, "."); found {
+			rule, ok = commandRules[prefix]
+		}
+	}
+	if !ok {
+		if shellInterpreters[cmd.Name] && hasOption(cmd.Args, "-c") {
+			// The code it runs is analysed instead
+		} else if codeInterpreters[cmd.Name] || shellInterpreters[cmd.Name] {
+			a.add(unknownCommandRisk, fmt.Sprintf("%s runs a program that cannot be analysed", cmd.Name))
+		} else {
+			a.add(unknownCommandRisk, fmt.Sprintf("%s is not in the rule database", cmd.Name))
+		}
+		return
+	}
+
+	risk, reason := rule.risk, "runs "+cmd.Name
+	reads, writes, network, destructive, targets := rule.reads, rule.writes, rule.network, rule.destructive, rule.targets
+	for _, arg := range rule.args {
+		if arg.sub != "" && (len(operands) == 0 || operands[0] != arg.sub) {
+			continue
+		}
+		if arg.flag != "" && !hasOption(cmd.Args, arg.flag) {
+			continue
+		}
+		if arg.risk > risk {
+			risk, reason = arg.risk, fmt.Sprintf("%s %s", cmd.Name, arg.reason)
+		}
+		writes = writes || arg.writes
+		network = network || arg.network
+		destructive = destructive || arg.destructive
+		if arg.targets != targetNone {
+			targets = arg.targets
+		}
+	}
+	a.add(risk, reason)
+	a.analysis.Reads = a.analysis.Reads || reads
+	a.analysis.Writes = a.analysis.Writes || writes
+	a.analysis.Network = a.analysis.Network || network
+
+	// dd names what it writes in an operand of its own
+	if cmd.Name == "dd" {
+		for _, arg := range cmd.Args {
+			if target, ok := strings.CutPrefix(arg, "of="); ok {
+				a.target(cmd, target, destructive, expanded)
+			}
+		}
+	}
+	for _, target := range writeTargets(targets, operands) {
+		a.target(cmd, target, destructive, expanded)
+	}
+}
+
+// target records a path a command writes and scores where it is
+func (a *analyser) target(cmd *SimpleCommand, path string, destructive, expanded bool) {
+	path = a.resolve(path)
+	scope := classifyPath(path, expanded)
+	if scope == scopeDiscard {
+		return
+	}
+	cmd.Writes = append(cmd.Writes, path)
+
+	switch {
+	case scope == scopeDevice:
+		a.add(10, fmt.Sprintf("%s writes to the disk device %s", cmd.Name, path))
+	case scope == scopeRoot && destructive:
+		a.add(10, fmt.Sprintf("%s acts on the root directory", cmd.Name))
+	case scope == scopeHome && destructive:
+		a.add(10, fmt.Sprintf("%s acts on the home directory", cmd.Name))
+	case scope == scopeSystem:
+		a.add(9, fmt.Sprintf("%s writes to the system path %s", cmd.Name, path))
+	case scope == scopeWorkingDir && destructive:
+		a.add(8, fmt.Sprintf("%s acts on everything in the current directory", cmd.Name))
+
+	case expanded && destructive && strings.Contains(path, "$"):
+		a.add(8, fmt.Sprintf("%s acts on %s, which depends on a variable that may be empty", cmd.Name, path))
+	}
+}
+
+// redirection scores a redirection of a statement's input or output,
+// returning the path output is written to, if any
+func (a *analyser) redirection(r *syntax.Redirect) string {
+	if r.Word == nil {
+		return ""
+	}
+	switch r.Op {
+	case syntax.RdrIn:
+		a.analysis.Reads = true
+	case syntax.RdrOut, syntax.AppOut, syntax.ClbOut, syntax.RdrAll, syntax.AppAll, syntax.RdrInOut:
+		path := a.resolve(wordText(r.Word))
+		switch scope := classifyPath(path, true); scope {
+		case scopeDiscard:
+			return ""
+		case scopeDevice:
+			a.add(10, fmt.Sprintf("redirects output onto the disk device %s", path))
+		case scopeSystem, scopeRoot, scopeHome:
+			a.add(9, fmt.Sprintf("redirects output into %s", path))
+		default:
+			a.add(4, fmt.Sprintf("redirects output into %s", path))
+		}
+		a.analysis.Writes = true
+		return path
+	}
+	return ""
+}
+
+// pipe flags pipelines that feed their input to an interpreter as code
+func (a *analyser) pipe(node *syntax.BinaryCmd) {
+	call, ok := node.Y.Cmd.(*syntax.CallExpr)
+	if !ok || len(call.Args) == 0 {
+		return
+	}
+	words := make([]string, len(call.Args))
+	for i, word := range call.Args {
+		words[i] = wordText(word)
+	}
+	words, _ = unwrap(words)
+	if len(words) == 0 {
+		return
+	}
+	name := filepath.Base(words[0])
+	if !shellInterpreters[name] && !codeInterpreters[name] {
+		return
+	}
+	for _, word := range words[1:] {
+		// Anything but options means the program comes from elsewhere
+		if word != "-" && !strings.HasPrefix(word, "-") {
+			return
+		}
+	}
+
+	downloads := false
+	syntax.Walk(node.X, func(n syntax.Node) bool {
+		if call, ok := n.(*syntax.CallExpr); ok && len(call.Args) > 0 {
+			if rule, known := commandRules[filepath.Base(wordText(call.Args[0]))]; known && rule.network {
+				downloads = true
+			}
+		}
+		return true
+	})
+	if downloads {
+		a.add(9, fmt.Sprintf("pipes code downloaded from the network into %s", name))
+	} else {
+		a.add(7, fmt.Sprintf("pipes generated code into %s", name))
+	}
+}
+
+// cd tracks the directory later relative paths are resolved against
+func (a *analyser) cd(operands []string) {
+	switch {
+	case len(operands) == 0:
+		a.dir = "~"
+	case operands[0] == "-" || strings.Contains(operands[0], "$"):
+		a.dir = ""
+	default:
+		a.dir = a.resolve(operands[0])
+	}
+}
+
+// resolve makes path relative to the directory of the latest cd
+func (a *analyser) resolve(path string) string {
+	if a.dir == "" || filepath.IsAbs(path) || strings.HasPrefix(path, "~") || strings.HasPrefix(path, "$") {
+		return path
+	}
+	return filepath.Join(a.dir, path)
+}
+
+// add records a reason for the risk of the command
+func (a *analyser) add(risk int, reason string) {
+	a.findings = append(a.findings, finding{risk: risk, reason: reason})
+}
+
+// risk returns the highest risk found so far
+func (a *analyser) risk() int {
+	risk := 0
+	for _, f := range a.findings {
+		risk = max(risk, f.risk)
+	}
+	return risk
+}
+
+// finish computes the overall risk and lists the reasons for it
+func (a *analyser) finish() Analysis {
+	a.analysis.Risk = a.risk()
+
+	sort.SliceStable(a.findings, func(i, j int) bool { return a.findings[i].risk > a.findings[j].risk })
+	seen := map[string]bool{}
+	for _, f := range a.findings {
+		// Reasons for trivial risks only add noise
+		if f.risk < 3 || seen[f.reason] {
+			continue
+		}
+		seen[f.reason] = true
+		a.analysis.Reasons = append(a.analysis.Reasons, fmt.Sprintf("%s (%d)", f.reason, f.risk))
+	}
+	return a.analysis
+}
+
+// pathScope classifies where a path points
+type pathScope int
+
+const (
+	scopeOther      pathScope = iota
+	scopeDiscard              // /dev/null and the standard streams
+	scopeDevice               // A disk device
+	scopeRoot                 // The root directory, or everything in it
+	scopeHome                 // The home directory, or everything in it
+	scopeSystem               // Under a directory the system depends on
+	scopeWorkingDir           // The current directory, or everything in it
+)
+
+// systemDirs are directories whose contents the system depends on
+var systemDirs = []string{
+	"/etc", "/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/boot", "/var",
+	"/opt", "/sys", "/proc", "/System", "/Library", "/Applications", "/private",
+}
+
+// classifyPath classifies path. expanded says whether the shell expands it,
+// so that "~" is the home directory and "dir/*" means everything in dir.
+func classifyPath(path string, expanded bool) pathScope {
+	if expanded {
+		for _, glob := range []string{"/*", "/.*"} {
+			if dir, ok := strings.CutSuffix(path, glob); ok {
+				path = dir + "/"
+				break
+			}
+		}
+		if path == "*" || path == ".*" {
+			path = "."
+		}
+		switch path {
+		case "~", "~/", "$HOME", "$HOME/", "${HOME}", "${HOME}/":
+			return scopeHome
+		}
+	}
+	if len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+	}
+
+	switch path {
+	case "/dev/null", "/dev/stdout", "/dev/stderr", "/dev/tty":
+		return scopeDiscard
+	case "/":
+		return scopeRoot
+	case ".", "./", "..":
+		return scopeWorkingDir
+	}
+	if strings.HasPrefix(path, "/dev/fd/") {
+		return scopeDiscard
+	}
+	for _, prefix := range []string{"/dev/sd", "/dev/hd", "/dev/nvme", "/dev/disk", "/dev/mmcblk", "/dev/vd", "/dev/xvd"} {
+		if strings.HasPrefix(path, prefix) {
+			return scopeDevice
+		}
+	}
+	for _, dir := range systemDirs {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return scopeSystem
+		}
+	}
+	return scopeOther
+}
+
+// commandOperands returns the arguments that are not options. Everything
+// after "--" is an operand.
+func commandOperands(args []string) []string {
+	var operands []string
+	for i, arg := range args {
+		if arg == "--" {
+			return append(operands, args[i+1:]...)
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			operands = append(operands, arg)
+		}
+	}
+	return operands
+}
+
+// writeTargets picks the operands a command writes
+func writeTargets(kind targetKind, operands []string) []string {
+	switch {
+	case len(operands) == 0:
+		return nil
+	case kind == targetAll:
+		return operands
+	case kind == targetAfterFirst:
+		return operands[1:]
+	case kind == targetLast && len(operands) > 1:
+		return operands[len(operands)-1:]
+	case kind == targetFindRoots:
+		var roots []string
+		for _, operand := range operands {
+			if operand == "(" || operand == "!" {
+				break
+			}
+			roots = append(roots, operand)
+		}
+		if len(roots) == 0 {
+			return []string{"."}
+		}
+		return roots
+	}
+	return nil
+}
+
+// hasOption reports whether args include option. An option beginning with
+// "--", or longer than one letter like find's "-delete", must match a whole
+// argument (up to any "=value"); a one-letter option also matches inside
+// combined options such as "-rf". An option without a dash matches any
+// argument equal to it.
+func hasOption(args []string, option string) bool {
+	short := len(option) == 2 && option[0] == '-' && option[1] != '-'
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		}
+		switch {
+		case arg == option || strings.HasPrefix(arg, option+"=") && strings.HasPrefix(option, "--"):
+			return true
+		case short && len(arg) > 2 && arg[0] == '-' && arg[1] != '-' && strings.Contains(arg[1:], option[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// optionValue returns the argument following option
+func optionValue(args []string, option string) string {
+	for i, arg := range args {
+		if (arg == option || strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") && strings.HasSuffix(arg, option[1:])) && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// wordText returns a word as the shell would see it before expansion:
+// quotes and escapes are removed, so `\rm` and `r\m` are seen as rm, while
+// variables and substitutions keep their source
+func wordText(word *syntax.Word) string {
+	var b strings.Builder
+	for _, part := range word.Parts {
+		switch part := part.(type) {
+		case *syntax.Lit:
+			b.WriteString(unescape(part.Value, ""))
+		case *syntax.SglQuoted:
+			b.WriteString(part.Value)
+		case *syntax.DblQuoted:
+			for _, inner := range part.Parts {
+				if lit, ok := inner.(*syntax.Lit); ok {
+					b.WriteString(unescape(lit.Value, "$`\"\\\n"))
+				} else {
+					b.WriteString(nodeSource(inner))
+				}
+			}
+		default:
+			b.WriteString(nodeSource(part))
+		}
+	}
+	return b.String()
+}
+
+// unescape removes the backslashes the shell would from a literal. Outside
+// quotes, special is empty and a backslash escapes any character; inside
+// double quotes it only escapes the characters in special. An escaped
+// newline is removed altogether.
+func unescape(lit, special string) string {
+	if !strings.Contains(lit, "\\") {
+		return lit
+	}
+	var b strings.Builder
+	for i := 0; i < len(lit); i++ {
+		if lit[i] == '\\' && i+1 < len(lit) && (special == "" || strings.IndexByte(special, lit[i+1]) >= 0) {
+			i++
+			if lit[i] == '\n' {
+				continue
+			}
+		}
+		b.WriteByte(lit[i])
+	}
+	return b.String()
+}
+
+// nodeSource prints a node back as shell source
+func nodeSource(node syntax.Node) string {
+	var buf bytes.Buffer
+	syntax.NewPrinter().Print(&buf, node)
+	return buf.String()
+}
+
+// callsItself reports whether a function calls itself, as in :(){ :|:& };:
+func callsItself(decl *syntax.FuncDecl) bool {
+	found := false
+	syntax.Walk(decl.Body, func(node syntax.Node) bool {
+		if call, ok := node.(*syntax.CallExpr); ok && len(call.Args) > 0 && wordText(call.Args[0]) == decl.Name.Value {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
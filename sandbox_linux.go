@@ -0,0 +1,217 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// sandboxDeniedSyscalls fail with EPERM in the sandbox. They would let a
+// command change its mounts or namespaces, load kernel code, or inspect
+// other processes.
+var sandboxDeniedSyscalls = []uint32{
+	unix.SYS_MOUNT, unix.SYS_UMOUNT2, unix.SYS_PIVOT_ROOT, unix.SYS_CHROOT,
+	unix.SYS_MOUNT_SETATTR, unix.SYS_OPEN_TREE, unix.SYS_MOVE_MOUNT,
+	unix.SYS_FSOPEN, unix.SYS_FSCONFIG, unix.SYS_FSMOUNT, unix.SYS_FSPICK,
+	unix.SYS_UNSHARE, unix.SYS_SETNS,
+	unix.SYS_PTRACE, unix.SYS_PROCESS_VM_READV, unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_KEXEC_LOAD, unix.SYS_KEXEC_FILE_LOAD,
+	unix.SYS_INIT_MODULE, unix.SYS_FINIT_MODULE, unix.SYS_DELETE_MODULE,
+	unix.SYS_BPF, unix.SYS_PERF_EVENT_OPEN, unix.SYS_USERFAULTFD,
+	unix.SYS_KEYCTL, unix.SYS_ADD_KEY, unix.SYS_REQUEST_KEY,
+	unix.SYS_OPEN_BY_HANDLE_AT, unix.SYS_REBOOT, unix.SYS_SWAPON, unix.SYS_SWAPOFF,
+	unix.SYS_ACCT, unix.SYS_SETTIMEOFDAY, unix.SYS_CLOCK_SETTIME,
+}
+
+// sandboxTmpfs are directories given an empty tmpfs, so commands have
+// somewhere to write scratch files and cannot reach the host's sockets
+var sandboxTmpfs = []string{"/tmp", "/run", "/dev/shm"}
+
+// sandboxSupported reports why the sandbox cannot be used on this system
+func sandboxSupported() error {
+	if _, err := os.Stat("/proc/self/ns/user"); err != nil {
+		return fmt.Errorf("the sandbox needs user namespaces: %v", err)
+	}
+	if seccompArch() == 0 {
+		return fmt.Errorf("the sandbox does not support %s", runtime.GOARCH)
+	}
+	return nil
+}
+
+// sandboxCommand returns the re-executed vibesh that sets up the sandbox in
+// new namespaces and then runs the command. It keeps CAP_SYS_ADMIN in its
+// user namespace to mount, and drops it before running the command.
+func sandboxCommand(ctx context.Context, config *SandboxConfig) (*exec.Cmd, error) {
+	flags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+		syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+	if !config.Network {
+		flags |= syscall.CLONE_NEWNET
+	}
+
+	cmd := exec.CommandContext(ctx, "/proc/self/exe", sandboxInitArg)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  uintptr(flags),
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}},
+		AmbientCaps: []uintptr{unix.CAP_SYS_ADMIN},
+		Pdeathsig:   syscall.SIGKILL,
+		// Without a controlling terminal, commands cannot push keystrokes
+		// into vibesh's
+		Setsid: true,
+	}
+	return cmd, nil
+}
+
+// sandboxInit runs in the re-executed vibesh, inside the new namespaces. It
+// builds the new root, drops its privileges and replaces itself with the
+// command; it only returns by exiting.
+func sandboxInit() {
+	// The seccomp filter and no_new_privs apply to the thread that sets them
+	runtime.LockOSThread()
+
+	spec, err := readSandboxSpec()
+	if err != nil {
+		sandboxFail("%v", err)
+	}
+	if err := sandboxMounts(spec); err != nil {
+		sandboxFail("%v", err)
+	}
+	if err := os.Chdir(spec.Dir); err != nil {
+		sandboxFail("%v", err)
+	}
+	unix.Sethostname([]byte("vibesh-sandbox"))
+
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		sandboxFail("failed to drop capabilities: %v", err)
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		sandboxFail("failed to set no_new_privs: %v", err)
+	}
+	if err := installSeccomp(); err != nil {
+		sandboxFail("failed to install the seccomp filter: %v", err)
+	}
+	if err := setLimits(spec.Limits); err != nil {
+		sandboxFail("failed to set limits: %v", err)
+	}
+
+	// The command runs in a second shell, since the kernel does not send
+	// SIGXCPU to process 1 of a pid namespace; the trailing exit keeps the
+	// first from exec'ing it
+	err = unix.Exec("/bin/sh", []string{"sh", "-c", `/bin/sh -c "$1"; exit`, "sh", spec.Command}, os.Environ())
+	sandboxFail("failed to run the command: %v", err)
+}
+
+// sandboxMounts makes the new root: the host's root, read-only, with empty
+// scratch directories, an overlay over the workspace and a /proc for the new
+// pid namespace. The host's root is then detached.
+func sandboxMounts(spec sandboxSpec) error {
+	root := spec.Root
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %v", err)
+	}
+	if err := unix.Mount("/", root, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind the root: %v", err)
+	}
+	attr := &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY}
+	if err := unix.MountSetattr(-1, root, unix.AT_RECURSIVE, attr); err != nil {
+		return fmt.Errorf("failed to make the root read-only: %v", err)
+	}
+
+	for _, dir := range sandboxTmpfs {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		if err := unix.Mount("tmpfs", root+dir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("failed to mount %s: %v", dir, err)
+		}
+	}
+
+	// A workspace under a scratch directory needs its mount point again
+	target := filepath.Join(root, spec.Workspace)
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return err
+	}
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,userxattr", spec.Workspace, spec.Upper, spec.Work)
+	if err := unix.Mount("overlay", target, "overlay", 0, options); err != nil {
+		return fmt.Errorf("failed to mount the workspace overlay: %v", err)
+	}
+
+	if err := unix.Mount("proc", root+"/proc", "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("failed to mount /proc: %v", err)
+	}
+
+	oldRoot := filepath.Join(root, "tmp", ".vibesh-old-root")
+	if err := os.Mkdir(oldRoot, 0o700); err != nil {
+		return err
+	}
+	if err := unix.PivotRoot(root, oldRoot); err != nil {
+		return fmt.Errorf("failed to switch to the new root: %v", err)
+	}
+	if err := unix.Unmount("/tmp/.vibesh-old-root", unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to detach the host root: %v", err)
+	}
+	return os.Remove("/tmp/.vibesh-old-root")
+}
+
+// installSeccomp loads seccompFilter into the running process
+func installSeccomp() error {
+	filter := seccompFilter()
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	return unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)), 0, 0)
+}
+
+// seccompFilter returns a BPF program that makes sandboxDeniedSyscalls fail,
+// and kills the process on syscalls made for another architecture
+func seccompFilter() []unix.SockFilter {
+	const (
+		ldNr   = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+		jeq    = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		jge    = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+		ret    = unix.BPF_RET | unix.BPF_K
+		offNr  = 0 // Offsets in struct seccomp_data
+		offArc = 4
+	)
+	deny := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM))
+
+	filter := []unix.SockFilter{
+		{Code: ldNr, K: offArc},
+		{Code: jeq, K: seccompArch(), Jt: 1},
+		{Code: ret, K: unix.SECCOMP_RET_KILL_PROCESS},
+		{Code: ldNr, K: offNr},
+	}
+	// x32 syscalls on amd64 have their own numbers, so none are allowed
+	if runtime.GOARCH == "amd64" {
+		filter = append(filter, unix.SockFilter{Code: jge, K: 0x40000000, Jt: uint8(len(sandboxDeniedSyscalls) + 1)})
+	}
+	for i, nr := range sandboxDeniedSyscalls {
+		filter = append(filter, unix.SockFilter{Code: jeq, K: nr, Jt: uint8(len(sandboxDeniedSyscalls) - i)})
+	}
+	filter = append(filter,
+		unix.SockFilter{Code: ret, K: unix.SECCOMP_RET_ALLOW},
+		unix.SockFilter{Code: ret, K: deny},
+	)
+	return filter
+}
+
+// seccompArch returns the audit architecture of the running binary, or 0 if
+// the sandbox does not know it
+func seccompArch() uint32 {
+	switch runtime.GOARCH {
+	case "amd64":
+		return unix.AUDIT_ARCH_X86_64
+	case "arm64":
+		return unix.AUDIT_ARCH_AARCH64
+	case "riscv64":
+		return unix.AUDIT_ARCH_RISCV64
+	}
+	return 0
+}
@@ -0,0 +1,90 @@
+//go:build linux
+
+package main
+
+import (
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// runFilter interprets the instructions seccompFilter uses for a syscall
+// nr made with the audit architecture arch, and returns the action
+func runFilter(t *testing.T, filter []unix.SockFilter, arch, nr uint32) uint32 {
+	t.Helper()
+	var acc uint32
+	for pc := 0; pc < len(filter); pc++ {
+		ins := filter[pc]
+		switch ins.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			switch ins.K {
+			case 0:
+				acc = nr
+			case 4:
+				acc = arch
+			default:
+				t.Fatalf("instruction %d loads offset %d", pc, ins.K)
+			}
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
+			if acc == ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+			if acc >= ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case unix.BPF_RET | unix.BPF_K:
+			return ins.K
+		default:
+			t.Fatalf("instruction %d has unknown code %#x", pc, ins.Code)
+		}
+	}
+	t.Fatal("the filter ran off its end")
+	return 0
+}
+
+func TestSeccompFilter(t *testing.T) {
+	arch := seccompArch()
+	if arch == 0 {
+		t.Skipf("no seccomp filter for %s", runtime.GOARCH)
+	}
+	deny := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM))
+
+	type filterTest struct {
+		name string
+		arch uint32
+		nr   uint32
+		want uint32
+	}
+	tests := []filterTest{
+		{"read", arch, unix.SYS_READ, unix.SECCOMP_RET_ALLOW},
+		{"execve", arch, unix.SYS_EXECVE, unix.SECCOMP_RET_ALLOW},
+		{"mount", arch, unix.SYS_MOUNT, deny},
+		{"ptrace", arch, unix.SYS_PTRACE, deny},
+		{"last denied", arch, sandboxDeniedSyscalls[len(sandboxDeniedSyscalls)-1], deny},
+		{"other architecture", unix.AUDIT_ARCH_I386, unix.SYS_READ, unix.SECCOMP_RET_KILL_PROCESS},
+	}
+	if runtime.GOARCH == "amd64" {
+		tests = append(tests, filterTest{"x32 read", arch, 0x40000000 | unix.SYS_READ, deny})
+	}
+
+	filter := seccompFilter()
+	if len(filter) > 255 {
+		t.Fatalf("%d instructions; jumps cannot reach past 255", len(filter))
+	}
+	for _, tt := range tests {
+		if got := runFilter(t, filter, tt.arch, tt.nr); got != tt.want {
+			t.Errorf("%s: action %#x, want %#x", tt.name, got, tt.want)
+		}
+	}
+	for _, nr := range sandboxDeniedSyscalls {
+		if got := runFilter(t, filter, arch, nr); got != deny {
+			t.Errorf("syscall %d: action %#x, want %#x", nr, got, deny)
+		}
+	}
+}
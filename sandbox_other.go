@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+)
+
+var errSandboxUnsupported = errors.New("the sandbox needs Linux namespaces, which this system does not have")
+
+func sandboxSupported() error {
+	return errSandboxUnsupported
+}
+
+func sandboxCommand(ctx context.Context, config *SandboxConfig) (*exec.Cmd, error) {
+	return nil, errSandboxUnsupported
+}
+
+func sandboxInit() {
+	sandboxFail("%v", errSandboxUnsupported)
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// ErrSessionEnded is returned when the child shell exits while running a command
+var ErrSessionEnded = errors.New("shell session ended")
+
+// ptyFD is the descriptor the session shell sees its pseudo-terminal on
+const ptyFD = 3
+
+// Session is a long-lived child shell shared by every processor, so the
+// working directory, environment, aliases and functions survive between
+// commands. Each command is written to the shell's stdin and its stdout and
+// stderr are streamed back up to a sentinel line; the one on stdout also
+// carries the exit status.
+//
+// When vibesh runs on a terminal, the shell is given a pseudo-terminal as its
+// controlling terminal and commands run attached to it, so interactive and
+// full-screen programs behave as they would in bash. Output then arrives on
+// the pty rather than the pipes, and stdout and stderr are no longer separate.
+// The shell also has job control enabled there, so Ctrl-Z, `&`, `jobs`, `fg`
+// and `bg` work as usual.
+type Session struct {
+	mu         sync.Mutex
+	cmd        *exec.Cmd
+	stdin      io.WriteCloser
+	stdout     *bufio.Reader
+	stderr     *bufio.Reader
+	marker     string // Random sentinel that delimits the output of each command
+	lastStatus int    // Exit status of the previous command, restored as $?
+
+	sigMu sync.Mutex // Guards shell and ptyFD for Signal
+	shell int        // Pid of the shell, 0 when it is not running
+	ptyFd int        // Descriptor of pty, for looking up the foreground job
+
+	terminal *Terminal     // User's terminal, nil when not interactive
+	pty      *os.File      // Master side of the shell's pseudo-terminal
+	ptyOut   *bufio.Reader // Buffered reader over pty
+	ptyState *term.State   // Pty settings restored after each command
+	winch    chan os.Signal
+
+	subshellNoted bool // Whether Run has said what a limited command loses
+}
+
+// NewSession starts a new child shell. If terminal is not nil, commands are
+// run on a pseudo-terminal and keystrokes are forwarded to them.
+func NewSession(terminal *Terminal) (*Session, error) {
+	s := &Session{terminal: terminal}
+	if err := s.start(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// start launches the child shell and wires up its pipes
+func (s *Session) start() error {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate session marker: %v", err)
+	}
+
+	cmd := exec.Command("sh")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create shell stdin: %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create shell stdout: %v", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create shell stderr: %v", err)
+	}
+
+	var tty *os.File
+	if s.terminal != nil {
+		master, slave, err := pty.Open()
+		if err != nil {
+			return fmt.Errorf("failed to open pseudo-terminal: %v", err)
+		}
+		tty = slave
+		s.pty = master
+		s.ptyOut = bufio.NewReader(master)
+
+		// The shell keeps its control pipes on 0-2 and gets the pty on
+		// ptyFD as its controlling terminal, so /dev/tty works for commands.
+		cmd.ExtraFiles = []*os.File{slave}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: ptyFD}
+
+		s.ptyFd = int(master.Fd())
+		pty.InheritSize(s.terminal.File(), master)
+		if s.ptyState, err = term.GetState(s.ptyFd); err != nil {
+			master.Close()
+			slave.Close()
+			return fmt.Errorf("failed to read pseudo-terminal state: %v", err)
+		}
+	} else {
+		// Keep terminal signals meant for vibesh away from the shell;
+		// Signal forwards them deliberately
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+
+	if err := cmd.Start(); err != nil {
+		if tty != nil {
+			tty.Close()
+			s.pty.Close()
+			s.pty = nil
+		}
+		return fmt.Errorf("failed to start shell: %v", err)
+	}
+	if tty != nil {
+		// The shell holds its own copy of the slave
+		tty.Close()
+		s.watchWindowSize()
+	}
+
+	s.cmd = cmd
+	s.stdin = stdin
+	s.stdout = bufio.NewReader(stdout)
+	s.stderr = bufio.NewReader(stderr)
+	s.marker = "__VIBESH_" + hex.EncodeToString(nonce) + "__"
+	s.lastStatus = 0
+
+	s.sigMu.Lock()
+	s.shell = cmd.Process.Pid
+	s.sigMu.Unlock()
+
+	// Trapping SIGINT (rather than ignoring it) lets the shell survive Ctrl-C
+	// while its children still get the default action. __vibesh_status is
+	// used to hand the previous command's status back to the next one.
+	init := "trap : INT\n__vibesh_status() { return \"$1\"; }\n"
+	if s.pty != nil {
+		init += "set -m\n"
+	}
+	if _, err := io.WriteString(stdin, init); err != nil {
+		cmd.Process.Kill()
+		s.reset()
+		return fmt.Errorf("failed to initialise shell: %v", err)
+	}
+	return nil
+}
+
+// watchWindowSize propagates resizes of the user's terminal to the pty
+func (s *Session) watchWindowSize() {
+	s.winch = make(chan os.Signal, 1)
+	signal.Notify(s.winch, syscall.SIGWINCH)
+
+	go func(winch chan os.Signal, master *os.File) {
+		for range winch {
+			pty.InheritSize(s.terminal.File(), master)
+		}
+	}(s.winch, s.pty)
+}
+
+// Run executes a command line in the session within limits, streaming its
+// output to stdout and stderr as it is produced, and returns its exit status.
+// If the shell has exited (e.g. after `exit`), a new one is started first.
+// When ctx is cancelled the command is sent SIGINT; unless it was cancelled
+// by an interrupt, the command is killed if that does not stop it.
+func (s *Session) Run(ctx context.Context, command string, limits Limits, stdout, stderr io.Writer) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cmd == nil {
+		if err := s.start(); err != nil {
+			return -1, err
+		}
+	}
+
+	if wrapped := limitCommand(command, limits); wrapped != command {
+		if losses := subshellLosses(command); len(losses) > 0 && !s.subshellNoted {
+			s.subshellNoted = true
+			fmt.Fprintf(stderr, "Note: with CPU or memory limits set, commands run in a subshell, so %s in them do not carry over to the next command.\n",
+				strings.Join(losses, ", "))
+		}
+		command = wrapped
+	}
+
+	finished := make(chan struct{})
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		select {
+		case <-ctx.Done():
+			s.Signal(syscall.SIGINT)
+		case <-finished:
+			return
+		}
+		if errors.Is(context.Cause(ctx), context.Canceled) {
+			return
+		}
+		select {
+		case <-time.After(killDelay):
+			s.kill()
+		case <-finished:
+		}
+	}()
+	defer func() {
+		close(finished)
+		<-watcherDone
+	}()
+
+	var status int
+	var err error
+	if s.pty != nil {
+		status, err = s.runOnPTY(command, stdout, stderr)
+	} else {
+		status, err = s.runOnPipes(command, stdout, stderr)
+	}
+	if err == nil {
+		s.lastStatus = status
+	}
+	return status, err
+}
+
+// ShellState is what the session shell knows about itself that vibesh's own
+// process does not, since `cd` and `export` only change the shell
+type ShellState struct {
+	Dir        string // Working directory
+	Path       string // Value of $PATH
+	LastStatus int    // Exit status of the previous command
+}
+
+// State queries the shell's working directory and $PATH. Only builtins run,
+// on the control pipes, so the terminal is left alone and $? is unchanged.
+func (s *Session) State() (ShellState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cmd == nil {
+		if err := s.start(); err != nil {
+			return ShellState{}, err
+		}
+	}
+
+	var out bytes.Buffer
+	if _, err := s.runOnPipes(`pwd; printf '%s\n' "$PATH"`, &out, io.Discard); err != nil {
+		return ShellState{}, err
+	}
+	lines := strings.SplitN(out.String(), "\n", 3)
+	if len(lines) < 3 {
+		return ShellState{}, fmt.Errorf("malformed shell state %q", out.String())
+	}
+	return ShellState{Dir: lines[0], Path: lines[1], LastStatus: s.lastStatus}, nil
+}
+
+// LookupEnv returns the value of the shell variable name, which `export`
+// and assignments in the session may have changed from vibesh's own
+// environment, and whether it is set
+func (s *Session) LookupEnv(name string) (string, bool) {
+	if !shellName.MatchString(name) {
+		return "", false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cmd == nil {
+		if err := s.start(); err != nil {
+			return "", false
+		}
+	}
+
+	var out bytes.Buffer
+	if _, err := s.runOnPipes(fmt.Sprintf(`printf '%%s\n%%s' "${%[1]s+set}" "${%[1]s-}"`, name), &out, io.Discard); err != nil {
+		return "", false
+	}
+	set, value, _ := strings.Cut(out.String(), "\n")
+	return value, set == "set"
+}
+
+// shellName matches the name of a shell variable
+var shellName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// runOnPipes runs a command with stdout and stderr on the shell's pipes
+func (s *Session) runOnPipes(command string, stdout, stderr io.Writer) (int, error) {
+	// `command eval` keeps syntax errors from terminating the shell, and
+	// stdin is detached so commands cannot consume the control pipe. The
+	// stdout marker is printed first so it still sees the command's status.
+	script := fmt.Sprintf("__vibesh_status %d; command eval %s </dev/null\nprintf '%%s:%%d\\n' '%[3]s' \"$?\"\nprintf '%%s:0\\n' '%[3]s' >&2\n",
+		s.lastStatus, shellQuote(command), s.marker)
+	if _, err := io.WriteString(s.stdin, script); err != nil {
+		s.reset()
+		return -1, ErrSessionEnded
+	}
+
+	stderrDone := make(chan error, 1)
+	go func() {
+		_, err := readUntilMarker(s.stderr, stderr, s.marker)
+		stderrDone <- err
+	}()
+
+	status, err := readUntilMarker(s.stdout, stdout, s.marker)
+	if errErr := <-stderrDone; err == nil {
+		err = errErr
+	}
+	if err != nil {
+		s.reset()
+		return -1, ErrSessionEnded
+	}
+	return status, nil
+}
+
+// runOnPTY runs a command with all three standard streams on the session's
+// pseudo-terminal while the user's terminal is in raw mode
+func (s *Session) runOnPTY(command string, stdout, stderr io.Writer) (int, error) {
+	detach, err := s.terminal.Attach(s.pty)
+	if err != nil {
+		return -1, fmt.Errorf("failed to attach terminal: %v", err)
+	}
+	defer detach()
+
+	// The status is reported on the pty after the command so it arrives
+	// behind all of the command's output. The pipe markers flush any
+	// messages the shell itself printed.
+	script := fmt.Sprintf("__vibesh_status %d; command eval %s <&%[4]d >&%[4]d 2>&%[4]d\nprintf '%%s:%%d\\n' '%[3]s' \"$?\" >&%[4]d\nprintf '%%s:0\\n' '%[3]s'\nprintf '%%s:0\\n' '%[3]s' >&2\n",
+		s.lastStatus, shellQuote(command), s.marker, ptyFD)
+	if _, err := io.WriteString(s.stdin, script); err != nil {
+		s.reset()
+		return -1, ErrSessionEnded
+	}
+
+	done := make(chan error, 2)
+	go func() {
+		_, err := readUntilMarker(s.stdout, stdout, s.marker)
+		done <- err
+	}()
+	go func() {
+		_, err := readUntilMarker(s.stderr, stderr, s.marker)
+		done <- err
+	}()
+
+	status, err := readUntilMarker(s.ptyOut, stdout, s.marker)
+	for i := 0; i < 2; i++ {
+		if pipeErr := <-done; err == nil {
+			err = pipeErr
+		}
+	}
+	if err != nil {
+		s.reset()
+		return -1, ErrSessionEnded
+	}
+
+	// Undo whatever modes a full-screen program left the pty in
+	term.Restore(s.ptyFd, s.ptyState)
+	return status, nil
+}
+
+// Signal delivers sig to the session's foreground job, if there is one. With
+// a pseudo-terminal that is the terminal's foreground process group; without
+// one there is no job control, so only SIGINT is forwarded, to the shell's
+// whole process group (the shell itself traps it).
+func (s *Session) Signal(sig syscall.Signal) error {
+	s.sigMu.Lock()
+	defer s.sigMu.Unlock()
+
+	if s.shell == 0 {
+		return nil
+	}
+
+	if s.ptyFd != 0 {
+		pgrp, err := unix.IoctlGetInt(s.ptyFd, unix.TIOCGPGRP)
+		if err != nil {
+			return err
+		}
+		if pgrp == s.shell {
+			// The shell itself is in the foreground, so no job is running
+			return nil
+		}
+		return syscall.Kill(-pgrp, sig)
+	}
+
+	if sig != syscall.SIGINT {
+		return nil
+	}
+	return syscall.Kill(-s.shell, sig)
+}
+
+// kill sends SIGKILL to the session's foreground job. Without a
+// pseudo-terminal, commands share the shell's process group, so the shell is
+// killed too and the next command starts a new one.
+func (s *Session) kill() {
+	s.sigMu.Lock()
+	shell, onPTY := s.shell, s.ptyFd != 0
+	s.sigMu.Unlock()
+
+	if onPTY {
+		s.Signal(syscall.SIGKILL)
+	} else if shell != 0 {
+		syscall.Kill(-shell, syscall.SIGKILL)
+	}
+}
+
+// Close terminates the child shell
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cmd == nil {
+		return nil
+	}
+	s.stdin.Close()
+	err := s.cmd.Wait()
+	s.release()
+	return err
+}
+
+// reset discards a shell that has exited so the next Run starts a fresh one
+func (s *Session) reset() {
+	s.stdin.Close()
+	s.cmd.Wait()
+	s.release()
+}
+
+// release frees what start allocated once the shell has exited
+func (s *Session) release() {
+	s.sigMu.Lock()
+	s.shell = 0
+	s.ptyFd = 0
+	s.sigMu.Unlock()
+
+	if s.pty != nil {
+		signal.Stop(s.winch)
+		close(s.winch)
+		s.pty.Close()
+		s.pty = nil
+	}
+	s.cmd = nil
+}
+
+// readUntilMarker copies r to w until the marker is found, then parses the
+// exit status that follows it. Bytes that might be the start of the marker
+// are held back so partial lines are still forwarded promptly.
+func readUntilMarker(r *bufio.Reader, w io.Writer, marker string) (int, error) {
+	var pending []byte
+	buf := make([]byte, 4096)
+
+	for {
+		n, err := r.Read(buf)
+		pending = append(pending, buf[:n]...)
+
+		if i := bytes.Index(pending, []byte(marker)); i >= 0 {
+			w.Write(pending[:i])
+			rest := pending[i+len(marker):]
+			// The status line may not have arrived in full yet
+			for !bytes.Contains(rest, []byte("\n")) {
+				line, err := r.ReadBytes('\n')
+				rest = append(rest, line...)
+				if err != nil {
+					return -1, err
+				}
+			}
+			line := string(rest[:bytes.IndexByte(rest, '\n')])
+			line = strings.TrimPrefix(strings.TrimSuffix(line, "\r"), ":")
+			status, convErr := strconv.Atoi(line)
+			if convErr != nil {
+				return -1, fmt.Errorf("malformed exit status %q", line)
+			}
+			// Anything after the status line belongs to no command; drop it
+			return status, nil
+		}
+
+		// Flush everything except a possible partial marker at the end
+		keep := partialSuffix(pending, marker)
+		w.Write(pending[:len(pending)-keep])
+		pending = append(pending[:0], pending[len(pending)-keep:]...)
+
+		if err != nil {
+			return -1, err
+		}
+	}
+}
+
+// partialSuffix returns the length of the longest suffix of b that is a
+// prefix of marker
+func partialSuffix(b []byte, marker string) int {
+	max := len(marker) - 1
+	if max > len(b) {
+		max = len(b)
+	}
+	for n := max; n > 0; n-- {
+		if bytes.HasSuffix(b, []byte(marker[:n])) {
+			return n
+		}
+	}
+	return 0
+}
+
+// shellQuote quotes s as a single word for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+// syncBuffer is a bytes.Buffer that a command's stdout and stderr can
+// share, as the session copies them from separate goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *syncBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+func TestReadUntilMarker(t *testing.T) {
+	const marker = "__M_1234__"
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		status int
+		err    bool
+	}{
+		{"plain", "hello\n" + marker + ":0\n", "hello\n", 0, false},
+		{"status", "oops\n" + marker + ":127\n", "oops\n", 127, false},
+		{"no newline before marker", "partial" + marker + ":3\n", "partial", 3, false},
+		{"carriage return", "x\r\n" + marker + ":1\r\n", "x\r\n", 1, false},
+		{"marker-like prefix", "__M_12\n" + marker + ":0\n", "__M_12\n", 0, false},
+		{"trailing output dropped", "a\n" + marker + ":0\nleftover", "a\n", 0, false},
+		{"malformed status", marker + ":x\n", "", -1, true},
+		{"no marker", "never ends", "never ends", -1, true},
+		{"no status line", "a" + marker + ":0", "a", -1, true},
+	}
+	for _, tt := range tests {
+		// Byte by byte, the marker arrives split across reads
+		for _, reader := range []io.Reader{strings.NewReader(tt.input), iotest.OneByteReader(strings.NewReader(tt.input))} {
+			var out bytes.Buffer
+			status, err := readUntilMarker(bufio.NewReader(reader), &out, marker)
+			if (err != nil) != tt.err || status != tt.status || out.String() != tt.output {
+				t.Errorf("%s: got %q, %d, %v; want %q, %d, error %v", tt.name, out.String(), status, err, tt.output, tt.status, tt.err)
+			}
+		}
+	}
+}
+
+func TestSessionKeepsState(t *testing.T) {
+	session, err := NewSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	run := func(command string) (string, int) {
+		t.Helper()
+		var out bytes.Buffer
+		status, err := session.Run(context.Background(), command, Limits{}, &out, io.Discard)
+		if err != nil {
+			t.Fatalf("%s: %v", command, err)
+		}
+		return out.String(), status
+	}
+
+	run("cd /tmp && export VIBESH_TEST=1")
+	if out, _ := run(`printf '%s %s' "$PWD" "$VIBESH_TEST"`); out != "/tmp 1" {
+		t.Errorf("state not kept: %q", out)
+	}
+	if _, status := run("false"); status != 1 {
+		t.Errorf("status %d, want 1", status)
+	}
+	if out, _ := run("echo $?"); out != "1\n" {
+		t.Errorf("$? after false: %q", out)
+	}
+	if _, err := session.Run(context.Background(), "exit 3", Limits{}, io.Discard, io.Discard); !errors.Is(err, ErrSessionEnded) {
+		t.Errorf("exit 3: %v, want ErrSessionEnded", err)
+	}
+	// A new shell is started after exit
+	if out, _ := run("echo back"); out != "back\n" {
+		t.Errorf("after exit: %q", out)
+	}
+	if lookup, ok := session.LookupEnv("HOME"); !ok || lookup == "" {
+		t.Errorf("LookupEnv(HOME) = %q, %v", lookup, ok)
+	}
+	if _, ok := session.LookupEnv("VIBESH_UNSET_VARIABLE"); ok {
+		t.Error("unset variable reported as set")
+	}
+	if _, ok := session.LookupEnv("x; rm -rf /"); ok {
+		t.Error("invalid name looked up")
+	}
+}
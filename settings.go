@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultRequestTimeout bounds a model request when no timeout is configured
+const defaultRequestTimeout = 30 * time.Second
+
+// ModelSettings controls how models are called. They are layered: the
+// `model` section of the config file, then VIBESH_* environment variables,
+// then command-line flags, and finally the `model` builtin at runtime. Unset
+// values fall back to the provider's defaults. A model name only applies to
+// the provider it was chosen for, since other providers would not know it.
+type ModelSettings struct {
+	Name        string        `yaml:"name"`        // Model to use with the default provider instead of its own default
+	Temperature *float32      `yaml:"temperature"` // Sampling temperature
+	TopP        *float32      `yaml:"top_p"`       // Nucleus sampling probability mass
+	MaxTokens   int           `yaml:"max_tokens"`  // Upper bound on tokens generated per reply
+	Seed        *int          `yaml:"seed"`        // Seed for more reproducible sampling
+	Timeout     time.Duration `yaml:"timeout"`     // Time allowed for one request, e.g. "45s"
+
+	models map[string]string // Model chosen for each provider, by provider name
+}
+
+// modelSettingKeys lists the settings accepted by Set, in display order
+var modelSettingKeys = []string{"name", "temperature", "top_p", "max_tokens", "seed", "timeout"}
+
+// Set changes one setting from its string form. The value "default" clears
+// the setting so the provider's default applies again.
+func (s *ModelSettings) Set(key, value string) error {
+	clear := value == "default"
+
+	switch key {
+	case "name", "model":
+		if clear {
+			value = ""
+		}
+		s.Name = value
+	case "temperature":
+		if clear {
+			s.Temperature = nil
+			return nil
+		}
+		v, err := strconv.ParseFloat(value, 32)
+		if err != nil || v < 0 || v > 2 {
+			return fmt.Errorf("temperature must be a number between 0 and 2")
+		}
+		f := float32(v)
+		s.Temperature = &f
+	case "top_p":
+		if clear {
+			s.TopP = nil
+			return nil
+		}
+		v, err := strconv.ParseFloat(value, 32)
+		if err != nil || v < 0 || v > 1 {
+			return fmt.Errorf("top_p must be a number between 0 and 1")
+		}
+		f := float32(v)
+		s.TopP = &f
+	case "max_tokens":
+		if clear {
+			s.MaxTokens = 0
+			return nil
+		}
+		v, err := strconv.Atoi(value)
+		if err != nil || v <= 0 {
+			return fmt.Errorf("max_tokens must be a positive integer")
+		}
+		s.MaxTokens = v
+	case "seed":
+		if clear {
+			s.Seed = nil
+			return nil
+		}
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("seed must be an integer")
+		}
+		s.Seed = &v
+	case "timeout":
+		if clear {
+			s.Timeout = 0
+			return nil
+		}
+		v, err := time.ParseDuration(value)
+		if err != nil || v <= 0 {
+			return fmt.Errorf("timeout must be a positive duration such as 45s")
+		}
+		s.Timeout = v
+	default:
+		return fmt.Errorf("unknown model setting %q (expected one of %s)", key, strings.Join(modelSettingKeys, ", "))
+	}
+	return nil
+}
+
+// Validate applies the checks of Set to settings read from the config file
+func (s *ModelSettings) Validate() error {
+	values := map[string]string{}
+	if s.Temperature != nil {
+		values["temperature"] = strconv.FormatFloat(float64(*s.Temperature), 'g', -1, 32)
+	}
+	if s.TopP != nil {
+		values["top_p"] = strconv.FormatFloat(float64(*s.TopP), 'g', -1, 32)
+	}
+	if s.MaxTokens != 0 {
+		values["max_tokens"] = strconv.Itoa(s.MaxTokens)
+	}
+	if s.Timeout != 0 {
+		values["timeout"] = s.Timeout.String()
+	}
+	for _, key := range modelSettingKeys {
+		if value, ok := values[key]; ok {
+			if err := s.Set(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyEnv overrides settings from VIBESH_MODEL, VIBESH_TEMPERATURE,
+// VIBESH_TOP_P, VIBESH_MAX_TOKENS, VIBESH_SEED and VIBESH_TIMEOUT
+func (s *ModelSettings) ApplyEnv() error {
+	for _, key := range modelSettingKeys {
+		name := "VIBESH_" + strings.ToUpper(key)
+		if key == "name" {
+			name = "VIBESH_MODEL"
+		}
+		if value := os.Getenv(name); value != "" {
+			if err := s.Set(key, value); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// RequestTimeout returns the time allowed for one model request
+func (s *ModelSettings) RequestTimeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return defaultRequestTimeout
+}
+
+// Scope makes the model named by Name, as set by the config file, the
+// environment or flags, apply to provider only
+func (s *ModelSettings) Scope(provider string) {
+	if s.Name != "" {
+		s.UseModel(provider, s.Name)
+	}
+	s.Name = ""
+}
+
+// UseModel chooses the model used with provider; "default" or "" returns to
+// the provider's own
+func (s *ModelSettings) UseModel(provider, name string) {
+	if s.models == nil {
+		s.models = map[string]string{}
+	}
+	if name == "" || name == "default" {
+		delete(s.models, provider)
+		return
+	}
+	s.models[provider] = name
+}
+
+// ModelFor returns the model used with provider
+func (s *ModelSettings) ModelFor(provider Provider) string {
+	if name := s.models[provider.Name()]; name != "" {
+		return name
+	}
+	return provider.Model()
+}
+
+// For returns the settings to send to provider, naming the model chosen
+// for it, if any
+func (s *ModelSettings) For(provider Provider) ModelSettings {
+	settings := *s
+	settings.Name = s.models[provider.Name()]
+	return settings
+}
+
+// Describe lists the settings for display, showing defaults where unset
+func (s *ModelSettings) Describe(provider Provider) string {
+	var b strings.Builder
+
+	if provider != nil {
+		fmt.Fprintf(&b, "Model:       %s (provider %s)\n", s.ModelFor(provider), provider.Name())
+	} else {
+		fmt.Fprintf(&b, "Model:       %s (no provider configured)\n", orDefault(s.Name))
+	}
+	if s.Temperature != nil {
+		fmt.Fprintf(&b, "Temperature: %g\n", *s.Temperature)
+	} else {
+		fmt.Fprintf(&b, "Temperature: default\n")
+	}
+	if s.TopP != nil {
+		fmt.Fprintf(&b, "Top P:       %g\n", *s.TopP)
+	} else {
+		fmt.Fprintf(&b, "Top P:       default\n")
+	}
+	if s.MaxTokens > 0 {
+		fmt.Fprintf(&b, "Max tokens:  %d\n", s.MaxTokens)
+	} else {
+		fmt.Fprintf(&b, "Max tokens:  default\n")
+	}
+	if s.Seed != nil {
+		fmt.Fprintf(&b, "Seed:        %d\n", *s.Seed)
+	} else {
+		fmt.Fprintf(&b, "Seed:        none\n")
+	}
+	fmt.Fprintf(&b, "Timeout:     %s\n", s.RequestTimeout())
+	return b.String()
+}
+
+// orDefault returns s, or "default" if it is empty
+func orDefault(s string) string {
+	if s == "" {
+		return "default"
+	}
+	return s
+}
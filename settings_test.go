@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModelSettingsSet(t *testing.T) {
+	tests := []struct {
+		key, value string
+		err        bool
+	}{
+		{"name", "gpt-4o", false},
+		{"temperature", "0", false},
+		{"temperature", "2", false},
+		{"temperature", "2.1", true},
+		{"temperature", "-0.5", true},
+		{"temperature", "hot", true},
+		{"top_p", "1", false},
+		{"top_p", "1.5", true},
+		{"max_tokens", "512", false},
+		{"max_tokens", "0", true},
+		{"max_tokens", "-1", true},
+		{"seed", "-7", false},
+		{"seed", "x", true},
+		{"timeout", "45s", false},
+		{"timeout", "45", true},
+		{"timeout", "-1s", true},
+		{"colour", "blue", true},
+	}
+	for _, tt := range tests {
+		var settings ModelSettings
+		if err := settings.Set(tt.key, tt.value); (err != nil) != tt.err {
+			t.Errorf("Set(%q, %q) = %v", tt.key, tt.value, err)
+		}
+	}
+
+	settings := ModelSettings{}
+	settings.Set("temperature", "0.5")
+	settings.Set("timeout", "1m")
+	settings.Set("temperature", "default")
+	settings.Set("timeout", "default")
+	if settings.Temperature != nil || settings.RequestTimeout() != defaultRequestTimeout {
+		t.Errorf("default did not clear the settings: %+v", settings)
+	}
+}
+
+func TestModelSettingsPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("model:\n  name: from-config\n  temperature: 0.2\n  max_tokens: 100\n  timeout: 10s\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("VIBESH_CONFIG", path)
+	t.Setenv("VIBESH_MODEL", "from-env")
+	t.Setenv("VIBESH_MAX_TOKENS", "200")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := config.Model
+	if err := settings.ApplyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	settings.Set("max_tokens", "300") // As a flag would
+	settings.Scope(config.DefaultProvider)
+
+	if *settings.Temperature != 0.2 || settings.MaxTokens != 300 || settings.Timeout != 10*time.Second {
+		t.Errorf("settings %+v", settings)
+	}
+	if got := settings.ModelFor(namedProvider("openai")); got != "from-env" {
+		t.Errorf("default provider model %q, want from-env", got)
+	}
+}
+
+func TestLoadConfigValidatesModel(t *testing.T) {
+	tests := []struct {
+		yaml string
+		err  string // Substring of the error; empty when valid
+	}{
+		{"model: {temperature: 0, top_p: 0.9, max_tokens: 1}", ""},
+		{"model: {temperature: 3}", "temperature must be"},
+		{"model: {top_p: -0.1}", "top_p must be"},
+		{"model: {max_tokens: -5}", "max_tokens must be"},
+		{"model: {timeout: -1s}", "timeout must be"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(tt.yaml), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("VIBESH_CONFIG", path)
+		_, err := LoadConfig()
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.yaml, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got error %v, want %q", tt.yaml, err, tt.err)
+		}
+	}
+}
+
+// namedProvider is a provider that only has a name, whose default model is
+// its name with "-default" appended
+type namedProvider string
+
+func (p namedProvider) Name() string  { return string(p) }
+func (p namedProvider) Model() string { return string(p) + "-default" }
+
+func (p namedProvider) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	return &ChatResponse{}, nil
+}
+
+func TestModelForProvider(t *testing.T) {
+	openai, ollama := namedProvider("openai"), namedProvider("ollama")
+	settings := ModelSettings{Name: "gpt-4o"}
+	settings.Scope("openai")
+	settings.UseModel("ollama", "llama3.1:70b")
+
+	tests := []struct {
+		provider Provider
+		want     string
+	}{
+		{openai, "gpt-4o"},
+		{ollama, "llama3.1:70b"},
+		{namedProvider("claude"), "claude-default"},
+	}
+	for _, tt := range tests {
+		if got := settings.ModelFor(tt.provider); got != tt.want {
+			t.Errorf("ModelFor(%s) = %q, want %q", tt.provider.Name(), got, tt.want)
+		}
+	}
+	if sent := settings.For(namedProvider("claude")); sent.Name != "" {
+		t.Errorf("claude would be sent model %q", sent.Name)
+	}
+
+	settings.UseModel("openai", "default")
+	if got := settings.ModelFor(openai); got != "openai-default" {
+		t.Errorf("after default: %q", got)
+	}
+	if got := settings.ModelFor(ollama); got != "llama3.1:70b" {
+		t.Errorf("ollama changed with openai: %q", got)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Interrupts delivers Ctrl-C and Ctrl-Z received by vibesh itself to
+// whatever is in the foreground. While a command or model request is in
+// progress, SIGINT cancels its context (which interrupts the session's
+// foreground job) and SIGTSTP is passed on to that job. At the prompt both
+// simply redraw the prompt, as in bash.
+//
+// While a command runs on the session's pseudo-terminal the user's terminal
+// is in raw mode, so Ctrl-C and Ctrl-Z reach the job through the pty instead.
+type Interrupts struct {
+	session *Session
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // Cancels the operation in progress, nil when idle
+	prompt string             // Prompt to redraw when idle, empty when not interactive
+}
+
+// NewInterrupts installs handlers for SIGINT and SIGTSTP
+func NewInterrupts(session *Session) *Interrupts {
+	i := &Interrupts{session: session}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTSTP)
+	go func() {
+		for sig := range signals {
+			i.handle(sig.(syscall.Signal))
+		}
+	}()
+	return i
+}
+
+// Begin returns a context for one operation that is cancelled on SIGINT.
+// The returned function must be called when the operation is over.
+func (i *Interrupts) Begin() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	i.mu.Lock()
+	i.cancel = cancel
+	i.mu.Unlock()
+
+	return ctx, func() {
+		i.mu.Lock()
+		i.cancel = nil
+		i.mu.Unlock()
+		cancel()
+	}
+}
+
+// SetPrompt records the prompt currently shown so it can be redrawn
+func (i *Interrupts) SetPrompt(prompt string) {
+	i.mu.Lock()
+	i.prompt = prompt
+	i.mu.Unlock()
+}
+
+func (i *Interrupts) handle(sig syscall.Signal) {
+	i.mu.Lock()
+	cancel, prompt := i.cancel, i.prompt
+	i.mu.Unlock()
+
+	switch {
+	case cancel != nil && sig == syscall.SIGINT:
+		cancel()
+	case cancel != nil:
+		i.session.Signal(sig)
+	case prompt != "":
+		// The terminal has already discarded the partial line
+		fmt.Print("\n" + prompt)
+	case sig == syscall.SIGINT:
+		// Not interactive and nothing running: behave like the default action
+		os.Exit(130)
+	}
+}
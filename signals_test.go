@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInterruptsCancel(t *testing.T) {
+	session, err := NewSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	interrupts := &Interrupts{session: session}
+
+	// Ctrl-C stops the command in progress, and the session carries on
+	ctx, done := interrupts.Begin()
+	time.AfterFunc(200*time.Millisecond, func() { interrupts.handle(syscall.SIGINT) })
+	start := time.Now()
+	status, err := session.Run(ctx, "sleep 10", Limits{}, &syncBuffer{}, &syncBuffer{})
+	done()
+	if err != nil || status == 0 || time.Since(start) > 5*time.Second {
+		t.Errorf("interrupted command: status %d, %v after %v", status, err, time.Since(start))
+	}
+	if ctx.Err() == nil {
+		t.Error("context not cancelled")
+	}
+
+	var out syncBuffer
+	if status, err := session.Run(context.Background(), "echo still here", Limits{}, &out, &out); status != 0 || err != nil || out.String() != "still here\n" {
+		t.Errorf("after the interrupt: %q, status %d, %v", out.String(), status, err)
+	}
+
+	// Once the operation is over, nothing is left to cancel
+	_, done = interrupts.Begin()
+	done()
+	if interrupts.cancel != nil {
+		t.Error("cancel kept after the operation")
+	}
+}
+
+func TestJobControl(t *testing.T) {
+	terminal, _ := newTestTerminal(t)
+	session, err := NewSession(terminal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	interrupts := &Interrupts{session: session}
+
+	// Ctrl-Z stops the foreground job and hands the session back
+	ctx, done := interrupts.Begin()
+	time.AfterFunc(200*time.Millisecond, func() { interrupts.handle(syscall.SIGTSTP) })
+	start := time.Now()
+	status, err := session.Run(ctx, "sleep 10", Limits{}, &syncBuffer{}, &syncBuffer{})
+	done()
+	if err != nil || status == 0 || time.Since(start) > 5*time.Second {
+		t.Fatalf("stopped command: status %d, %v after %v", status, err, time.Since(start))
+	}
+
+	var out syncBuffer
+	if _, err := session.Run(context.Background(), "jobs", Limits{}, &out, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Stopped") || !strings.Contains(out.String(), "sleep 10") {
+		t.Errorf("jobs: %q", out.String())
+	}
+	session.Run(context.Background(), "kill %1; kill -CONT %1 2>/dev/null; wait", Limits{}, &syncBuffer{}, &syncBuffer{})
+}
+
+func TestIsJobBuiltin(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"jobs", true},
+		{"fg", true},
+		{"fg %2", true},
+		{"bg %1", true},
+		{"jobs -l", true},
+		{"jobsearch", false},
+		{"echo fg", false},
+		{"ls", false},
+	}
+	for _, tt := range tests {
+		if got := isJobBuiltin(tt.input); got != tt.want {
+			t.Errorf("isJobBuiltin(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
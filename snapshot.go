@@ -0,0 +1,592 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Snapshot limits used when the config does not set them
+const (
+	defaultSnapshotKeep     = 20
+	defaultSnapshotMaxFiles = 20_000
+	defaultSnapshotMaxSize  = 512 // MiB
+)
+
+// errSnapshotTooLarge is returned for paths over the configured limits
+var errSnapshotTooLarge = errors.New("too large to snapshot")
+
+// attributionSlack allows for the coarse clocks of filesystems when judging
+// whether a file was made while a command ran
+const attributionSlack = time.Second
+
+// Snapshot is the state of some paths before a command that writes to them
+type Snapshot struct {
+	ID       int             `json:"id"`
+	Time     time.Time       `json:"time"`
+	Finished time.Time       `json:"finished,omitzero"` // When the command finished; zero if it was never told
+	Command  string          `json:"command"`
+	Roots    []string        `json:"roots"`   // Paths recorded, with everything below them
+	Entries  []snapshotEntry `json:"entries"` // Every path recorded, parents before children
+}
+
+// snapshotEntry is one path of a snapshot: a file, directory or symlink it
+// can put back, or a socket, device or pipe that undo leaves alone
+type snapshotEntry struct {
+	Path    string      `json:"path"`
+	Absent  bool        `json:"absent,omitempty"`  // The path did not exist
+	Special bool        `json:"special,omitempty"` // A socket, device or pipe, which has no contents to keep
+	Mode    fs.FileMode `json:"mode,omitempty"`    // Type and permissions
+	Size    int64       `json:"size,omitempty"`
+	ModTime time.Time   `json:"mtime,omitzero"`
+	Hash    string      `json:"hash,omitempty"` // SHA-256 of a file's contents, which names its object
+	Link    string      `json:"link,omitempty"` // Target of a symlink
+}
+
+// SnapshotStore keeps snapshots taken before commands that write, so the
+// `undo` builtin can put files back. File contents are stored once per
+// distinct content, under their hash, however many snapshots hold them.
+type SnapshotStore struct {
+	config *SnapshotConfig
+
+	mu sync.Mutex // Serialises changes to the store
+}
+
+func NewSnapshotStore(config *SnapshotConfig) *SnapshotStore {
+	return &SnapshotStore{config: config}
+}
+
+func (st *SnapshotStore) manifestDir() string {
+	return filepath.Join(st.config.Dir, "snapshots")
+}
+
+func (st *SnapshotStore) objectPath(hash string) string {
+	return filepath.Join(st.config.Dir, "objects", hash[:2], hash[2:])
+}
+
+// Take records roots, and everything below them, before command runs.
+// Roots in pseudo filesystems such as /dev are left out. It returns nil if
+// snapshots are turned off or there is nothing to record.
+func (st *SnapshotStore) Take(command string, roots []string) (*Snapshot, error) {
+	roots = slices.DeleteFunc(slices.Clone(roots), pseudoPath)
+	if st.config.Disabled || len(roots) == 0 {
+		return nil, nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	snapshots, err := st.list()
+	if err != nil {
+		return nil, err
+	}
+	// Files unchanged since the last snapshot need not be read again
+	known := map[string]snapshotEntry{}
+	id := 1
+	if len(snapshots) > 0 {
+		for _, entry := range snapshots[0].Entries {
+			known[entry.Path] = entry
+		}
+		id = snapshots[0].ID + 1
+	}
+
+	snapshot := &Snapshot{ID: id, Time: time.Now(), Command: command, Roots: roots}
+	var size int64
+	for _, root := range roots {
+		if _, err := os.Lstat(root); errors.Is(err, fs.ErrNotExist) {
+			snapshot.Entries = append(snapshot.Entries, snapshotEntry{Path: root, Absent: true})
+			continue
+		}
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if len(snapshot.Entries) >= st.config.MaxFiles {
+				return fmt.Errorf("%w: more than %d files", errSnapshotTooLarge, st.config.MaxFiles)
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			entry := snapshotEntry{Path: path, Mode: info.Mode(), ModTime: info.ModTime()}
+			switch {
+			case info.Mode()&fs.ModeSymlink != 0:
+				if entry.Link, err = os.Readlink(path); err != nil {
+					return err
+				}
+			case info.Mode().IsRegular():
+				entry.Size = info.Size()
+				if size += entry.Size; size > int64(st.config.MaxSizeMB)<<20 {
+					return fmt.Errorf("%w: more than %d MiB", errSnapshotTooLarge, st.config.MaxSizeMB)
+				}
+				if prev, ok := known[path]; ok && prev.Hash != "" && prev.Mode == entry.Mode &&
+					prev.Size == entry.Size && prev.ModTime.Equal(entry.ModTime) && st.hasObject(prev.Hash) {
+					entry.Hash = prev.Hash
+				} else if entry.Hash, err = st.store(path); err != nil {
+					return err
+				}
+			case !info.IsDir():
+				entry.Special = true
+			}
+			snapshot.Entries = append(snapshot.Entries, entry)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := st.write(snapshot); err != nil {
+		return nil, err
+	}
+	if len(snapshots)+1 > st.config.Keep {
+		if _, _, err := st.gc(); err != nil {
+			return snapshot, err
+		}
+	}
+	return snapshot, nil
+}
+
+// store copies a file into the store and returns its hash
+func (st *SnapshotStore) store(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	objects := filepath.Join(st.config.Dir, "objects")
+	if err := os.MkdirAll(objects, 0o700); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(objects, "tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), file); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if st.hasObject(sum) {
+		return sum, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(st.objectPath(sum)), 0o700); err != nil {
+		return "", err
+	}
+	return sum, os.Rename(tmp.Name(), st.objectPath(sum))
+}
+
+func (st *SnapshotStore) hasObject(hash string) bool {
+	_, err := os.Stat(st.objectPath(hash))
+	return err == nil
+}
+
+// write saves the manifest of a snapshot
+func (st *SnapshotStore) write(snapshot *Snapshot) error {
+	if err := os.MkdirAll(st.manifestDir(), 0o700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(st.manifestDir(), strconv.Itoa(snapshot.ID)+".json")
+	return os.WriteFile(path, data, 0o600)
+}
+
+// List returns the snapshots that can be undone, newest first
+func (st *SnapshotStore) List() ([]*Snapshot, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.list()
+}
+
+func (st *SnapshotStore) list() ([]*Snapshot, error) {
+	files, err := os.ReadDir(st.manifestDir())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []*Snapshot
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(st.manifestDir(), file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		snapshot := &Snapshot{}
+		if err := json.Unmarshal(data, snapshot); err != nil {
+			return nil, fmt.Errorf("invalid snapshot %s: %v", file.Name(), err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	slices.SortFunc(snapshots, func(a, b *Snapshot) int { return b.ID - a.ID })
+	return snapshots, nil
+}
+
+// Finish records that the command a snapshot was taken for has finished,
+// so Restore can tell what it made from what was made later
+func (st *SnapshotStore) Finish(snapshot *Snapshot) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	snapshot.Finished = time.Now()
+	return st.write(snapshot)
+}
+
+// Restore puts the paths of a snapshot back as they were and then drops the
+// snapshot. Of what was created below them since, only what the command
+// made while it ran is removed, and new directories only once empty; files
+// written later, by the user or other programs, are kept.
+func (st *SnapshotStore) Restore(snapshot *Snapshot) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	recorded := map[string]bool{}
+	for _, entry := range snapshot.Entries {
+		recorded[entry.Path] = !entry.Absent
+	}
+
+	for _, root := range snapshot.Roots {
+		// Sockets, devices and pipes are only ever left alone
+		var files, dirs []string
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || recorded[path] || specialFile(d.Type()) || !snapshot.madeByCommand(path) {
+				return nil
+			}
+			if d.IsDir() {
+				dirs = append(dirs, path)
+			} else {
+				files = append(files, path)
+			}
+			return nil
+		})
+		for _, path := range files {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+		// Deepest first, so a directory's new subdirectories go before it
+		for _, path := range slices.Backward(dirs) {
+			if entries, err := os.ReadDir(path); err != nil || len(entries) > 0 {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, entry := range snapshot.Entries {
+		if err := st.restoreEntry(entry); err != nil {
+			return fmt.Errorf("failed to restore %s: %v", entry.Path, err)
+		}
+	}
+	return os.Remove(filepath.Join(st.manifestDir(), strconv.Itoa(snapshot.ID)+".json"))
+}
+
+// madeByCommand reports whether path, which the snapshot does not hold, was
+// made while the command ran, judged by when its inode last changed. Without
+// the time the command finished, nothing is.
+func (snapshot *Snapshot) madeByCommand(path string) bool {
+	if snapshot.Finished.IsZero() {
+		return false
+	}
+	var stat unix.Stat_t
+	if err := unix.Lstat(path, &stat); err != nil {
+		return false
+	}
+	changed := time.Unix(stat.Ctim.Unix())
+	return !changed.Before(snapshot.Time.Add(-attributionSlack)) && !changed.After(snapshot.Finished.Add(attributionSlack))
+}
+
+// restoreEntry puts back one path, leaving it alone if it is unchanged or a
+// socket, device or pipe, then or now
+func (st *SnapshotStore) restoreEntry(entry snapshotEntry) error {
+	current, err := os.Lstat(entry.Path)
+	exists := err == nil
+	if entry.Special || exists && specialFile(current.Mode()) {
+		// Neither put back nor removed
+		return nil
+	}
+	if entry.Absent {
+		// Restore removes it if the command made it
+		return nil
+	}
+
+	switch {
+	case entry.Mode.IsDir():
+		if exists && !current.IsDir() {
+			if err := os.Remove(entry.Path); err != nil {
+				return err
+			}
+			exists = false
+		}
+		if !exists {
+			if err := os.Mkdir(entry.Path, entry.Mode.Perm()); err != nil {
+				return err
+			}
+		}
+		return os.Chmod(entry.Path, entry.Mode.Perm())
+
+	case entry.Mode&fs.ModeSymlink != 0:
+		if exists {
+			if link, err := os.Readlink(entry.Path); err == nil && link == entry.Link {
+				return nil
+			}
+			if err := os.RemoveAll(entry.Path); err != nil {
+				return err
+			}
+		}
+		return os.Symlink(entry.Link, entry.Path)
+	}
+
+	if exists && current.Mode().IsRegular() && current.Size() == entry.Size {
+		if same, _ := sameContents(st.objectPath(entry.Hash), entry.Path); same {
+			return os.Chmod(entry.Path, entry.Mode.Perm())
+		}
+	}
+	// Write alongside and rename, so the file is never half restored
+	tmp := filepath.Join(filepath.Dir(entry.Path), ".vibesh-undo-"+entry.Hash[:12])
+	os.Remove(tmp)
+	if err := copyFile(st.objectPath(entry.Hash), tmp, entry.Mode.Perm()); err != nil {
+		return err
+	}
+	if exists && current.IsDir() {
+		if err := os.RemoveAll(entry.Path); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, entry.Path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Chtimes(entry.Path, entry.ModTime, entry.ModTime)
+}
+
+// GC removes snapshots beyond the number kept and the stored files no
+// snapshot refers to any more. It returns how many of each it removed.
+func (st *SnapshotStore) GC() (int, int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.gc()
+}
+
+func (st *SnapshotStore) gc() (int, int, error) {
+	snapshots, err := st.list()
+	if err != nil {
+		return 0, 0, err
+	}
+	removedSnapshots := 0
+	if len(snapshots) > st.config.Keep {
+		for _, snapshot := range snapshots[st.config.Keep:] {
+			if err := os.Remove(filepath.Join(st.manifestDir(), strconv.Itoa(snapshot.ID)+".json")); err != nil {
+				return removedSnapshots, 0, err
+			}
+			removedSnapshots++
+		}
+		snapshots = snapshots[:st.config.Keep]
+	}
+
+	used := map[string]bool{}
+	for _, snapshot := range snapshots {
+		for _, entry := range snapshot.Entries {
+			if entry.Hash != "" {
+				used[st.objectPath(entry.Hash)] = true
+			}
+		}
+	}
+	removedObjects := 0
+	err = filepath.WalkDir(filepath.Join(st.config.Dir, "objects"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || used[path] {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removedObjects++
+		return nil
+	})
+	return removedSnapshots, removedObjects, err
+}
+
+// snapshotRoots returns the paths to snapshot before a command assessed as
+// a runs in dir: the paths it writes to, or the workspace if some of them
+// are not known. Outside the workspace that would be too much to put back,
+// so there is no snapshot and an error says why. Paths in pseudo
+// filesystems such as /dev are never snapshotted.
+func snapshotRoots(a Assessment, dir, workspace string) ([]string, error) {
+	var paths []string
+	unknown, pseudo := false, false
+	for _, cmd := range a.Local.Commands {
+		for _, path := range cmd.Writes {
+			if strings.Contains(path, "$") {
+				unknown = true
+				continue
+			}
+			path = expandPath(path, dir)
+			if pseudoPath(path) {
+				pseudo = true
+				continue
+			}
+			paths = append(paths, path)
+		}
+	}
+	if !unknown && len(paths) == 0 && pseudo {
+		return nil, nil
+	}
+	if unknown || len(paths) == 0 {
+		if underPattern(dir, workspace) {
+			return []string{workspace}, nil
+		}
+		return nil, fmt.Errorf("the paths it writes to are not known, and %s is outside the workspace", dir)
+	}
+	return topPaths(paths), nil
+}
+
+// specialFile reports whether mode is of a socket, device or pipe, which
+// undo never removes or replaces
+func specialFile(mode fs.FileMode) bool {
+	return !mode.IsDir() && !mode.IsRegular() && mode&fs.ModeSymlink == 0
+}
+
+// pseudoPath reports whether path is in a filesystem of devices or kernel
+// state, which a snapshot must never walk or restore
+func pseudoPath(path string) bool {
+	for _, dir := range []string{"/dev", "/proc", "/sys"} {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// topPaths drops duplicate paths and paths below others
+func topPaths(paths []string) []string {
+	slices.Sort(paths)
+	paths = slices.Compact(paths)
+	var top []string
+	for _, path := range paths {
+		if len(top) > 0 && underPattern(path, top[len(top)-1]) {
+			continue
+		}
+		top = append(top, path)
+	}
+	return top
+}
+
+// undoSnapshots restores the newest n snapshots, newest first, once the
+// user agrees
+func undoSnapshots(store *SnapshotStore, n int, stdio *IO) {
+	snapshots, err := store.List()
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "Failed to read snapshots: %v\n", err)
+		return
+	}
+	if len(snapshots) == 0 {
+		fmt.Fprintln(stdio.Stdout, "There is nothing to undo.")
+		return
+	}
+	if n > len(snapshots) {
+		fmt.Fprintf(stdio.Stdout, "Only %d command(s) can be undone.\n", len(snapshots))
+		return
+	}
+
+	fmt.Fprintln(stdio.Stdout, "This puts back the files these commands changed, newest first:")
+	for _, snapshot := range snapshots[:n] {
+		printSnapshot(stdio.Stdout, snapshot)
+	}
+	fmt.Fprint(stdio.Stdout, "Files these commands created there will be removed. Undo? [y/n]: ")
+	answer, _ := stdio.Input.ReadString('\n')
+	if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+		fmt.Fprintln(stdio.Stdout, "Nothing was undone.")
+		return
+	}
+
+	for _, snapshot := range snapshots[:n] {
+		if err := store.Restore(snapshot); err != nil {
+			fmt.Fprintf(stdio.Stderr, "Failed to undo %q: %v\n", snapshot.Command, err)
+			return
+		}
+		fmt.Fprintf(stdio.Stdout, "Undone: %s\n", snapshot.Command)
+	}
+	if _, _, err := store.GC(); err != nil {
+		fmt.Fprintf(stdio.Stderr, "Failed to clean up snapshots: %v\n", err)
+	}
+}
+
+// listSnapshots shows the snapshots that can be undone, newest first
+func listSnapshots(store *SnapshotStore, stdio *IO) {
+	snapshots, err := store.List()
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "Failed to read snapshots: %v\n", err)
+		return
+	}
+	if len(snapshots) == 0 {
+		fmt.Fprintln(stdio.Stdout, "No snapshots.")
+		return
+	}
+	for _, snapshot := range snapshots {
+		printSnapshot(stdio.Stdout, snapshot)
+	}
+}
+
+// printSnapshot shows one snapshot, with the paths it covers
+func printSnapshot(w io.Writer, snapshot *Snapshot) {
+	files := 0
+	var size int64
+	for _, entry := range snapshot.Entries {
+		if entry.Mode.IsRegular() {
+			files++
+			size += entry.Size
+		}
+	}
+	fmt.Fprintf(w, "  %3d  %s  %d file(s), %s  %s\n", snapshot.ID, snapshot.Time.Format(time.DateTime), files, formatSize(size), snapshot.Command)
+	for _, root := range snapshot.Roots {
+		fmt.Fprintf(w, "         %s\n", root)
+	}
+}
+
+// formatSize gives a size in bytes in the largest unit it has a whole one of
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
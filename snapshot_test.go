@@ -0,0 +1,184 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestSnapshotStore(t *testing.T) *SnapshotStore {
+	t.Helper()
+	return NewSnapshotStore(&SnapshotConfig{
+		Dir:       t.TempDir(),
+		Keep:      defaultSnapshotKeep,
+		MaxFiles:  defaultSnapshotMaxFiles,
+		MaxSizeMB: defaultSnapshotMaxSize,
+	})
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	store := newTestSnapshotStore(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "changed"), "before")
+	writeFile(t, filepath.Join(root, "deleted"), "keep me")
+	if err := os.Symlink("changed", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(root, "fifo"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := store.Take("test", []string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, filepath.Join(root, "changed"), "after")
+	os.Remove(filepath.Join(root, "deleted"))
+	os.Remove(filepath.Join(root, "link"))
+	writeFile(t, filepath.Join(root, "created"), "new")
+	if err := os.Mkdir(filepath.Join(root, "newdir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(root, "newfifo"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Finish(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(root, "changed")); got != "before" {
+		t.Errorf("changed file: %q, want %q", got, "before")
+	}
+	if got := readFile(t, filepath.Join(root, "deleted")); got != "keep me" {
+		t.Errorf("deleted file: %q, want %q", got, "keep me")
+	}
+	if link, err := os.Readlink(filepath.Join(root, "link")); err != nil || link != "changed" {
+		t.Errorf("symlink: %q, %v", link, err)
+	}
+	for _, name := range []string{"created", "newdir"} {
+		if _, err := os.Lstat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Errorf("%s still exists after undo", name)
+		}
+	}
+	for _, name := range []string{"fifo", "newfifo"} {
+		if info, err := os.Lstat(filepath.Join(root, name)); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+			t.Errorf("%s was not left alone: %v", name, err)
+		}
+	}
+	if snapshots, _ := store.List(); len(snapshots) != 0 {
+		t.Errorf("%d snapshot(s) left after undo", len(snapshots))
+	}
+}
+
+func TestSnapshotRestoreKeepsLaterFiles(t *testing.T) {
+	store := newTestSnapshotStore(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "changed"), "before")
+
+	snapshot, err := store.Take("test", []string{root, filepath.Join(root, "out")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "changed"), "after")
+	if err := store.Finish(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files made after the command finished, as if by the user
+	snapshot.Time = snapshot.Time.Add(-time.Hour)
+	snapshot.Finished = snapshot.Finished.Add(-time.Hour)
+	writeFile(t, filepath.Join(root, "notes.txt"), "mine")
+	if err := os.MkdirAll(filepath.Join(root, "out", "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "out", "sub", "report"), "mine too")
+
+	if err := store.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(root, "changed")); got != "before" {
+		t.Errorf("changed file: %q, want %q", got, "before")
+	}
+	for _, name := range []string{"notes.txt", "out/sub/report"} {
+		if _, err := os.Lstat(filepath.Join(root, name)); err != nil {
+			t.Errorf("%s was removed: %v", name, err)
+		}
+	}
+}
+
+func TestSnapshotRestoreUnfinished(t *testing.T) {
+	store := newTestSnapshotStore(t)
+	root := t.TempDir()
+	snapshot, err := store.Take("test", []string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "created"), "new")
+
+	// Without the time the command finished, new files cannot be attributed
+	if err := store.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "created")); err != nil {
+		t.Errorf("created file was removed: %v", err)
+	}
+}
+
+func TestSnapshotSkipsPseudoPaths(t *testing.T) {
+	store := newTestSnapshotStore(t)
+	snapshot, err := store.Take("cp x /dev/null", []string{"/dev/null", "/proc/self"})
+	if err != nil || snapshot != nil {
+		t.Errorf("got %v, %v; want no snapshot", snapshot, err)
+	}
+}
+
+func TestSnapshotRoots(t *testing.T) {
+	assessor := NewRiskAssessor(&RiskConfig{}, nil)
+	tests := []struct {
+		src  string
+		dir  string
+		want []string
+		err  bool
+	}{
+		{"touch a b", "/work", []string{"/work/a", "/work/b"}, false},
+		{"rm -rf sub sub/x", "/work/src", []string{"/work/src/sub"}, false},
+		{"cp x /dev/null", "/work", []string{"/work"}, false}, // Nothing but a discard path, so no known target
+		{"dd if=x of=/dev/sda", "/work", nil, false},
+		{"echo x > /proc/sys/vm/drop_caches", "/work", nil, false},
+		{"rm -rf $DIR", "/work/src", []string{"/work"}, false},
+		{"cd /tmp && touch x", "/work", []string{"/tmp/x"}, false},
+		{"touch x", "/home/me", []string{"/home/me/x"}, false},
+		{"rm -rf $DIR", "/home/me", nil, true},
+		{"cp x /dev/null", "/", nil, true},
+	}
+	for _, tt := range tests {
+		a := assessor.AssessLocal(NewShellCommand(tt.src))
+		got, err := snapshotRoots(a, tt.dir, "/work")
+		if !slices.Equal(got, tt.want) || (err != nil) != tt.err {
+			t.Errorf("%s in %s: roots %q, %v; want %q, error %v", tt.src, tt.dir, got, err, tt.want, tt.err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// Terminal owns the user's terminal when vibesh runs interactively. A single
+// goroutine reads keystrokes and hands them either to the line reader used
+// for prompts or, while a command runs, to that command's pseudo-terminal.
+// Reading stdin from one place keeps a finished command from swallowing the
+// next line typed at the prompt.
+type Terminal struct {
+	file  *os.File
+	lines *io.PipeReader
+	saved *term.State // Cooked-mode state restored after each command
+
+	mu     sync.Mutex
+	target io.Writer // Receives keystrokes while a command is attached
+}
+
+// NewTerminal starts reading keystrokes from f, which must be a terminal
+func NewTerminal(f *os.File) (*Terminal, error) {
+	saved, err := term.GetState(int(f.Fd()))
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	t := &Terminal{file: f, lines: pr, saved: saved}
+	go t.pump(pw)
+	return t, nil
+}
+
+// pump forwards everything read from the terminal to the current consumer
+func (t *Terminal) pump(prompt *io.PipeWriter) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := t.file.Read(buf)
+		if n > 0 {
+			t.mu.Lock()
+			target := t.target
+			t.mu.Unlock()
+
+			if target != nil {
+				target.Write(buf[:n])
+			} else if _, werr := prompt.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			prompt.CloseWithError(err)
+			return
+		}
+	}
+}
+
+// Read returns line input typed at the prompt
+func (t *Terminal) Read(p []byte) (int, error) {
+	return t.lines.Read(p)
+}
+
+// Attach switches the terminal to raw mode and sends every keystroke to w
+// until the returned function is called, which restores cooked mode.
+func (t *Terminal) Attach(w io.Writer) (func(), error) {
+	if _, err := term.MakeRaw(int(t.file.Fd())); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	t.target = w
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		t.target = nil
+		t.mu.Unlock()
+		t.Restore()
+	}, nil
+}
+
+// Restore puts the terminal back into the state it was in at startup
+func (t *Terminal) Restore() {
+	term.Restore(int(t.file.Fd()), t.saved)
+}
+
+// File returns the underlying terminal, e.g. for reading its window size
+func (t *Terminal) File() *os.File {
+	return t.file
+}
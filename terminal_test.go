@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// newTestTerminal returns a terminal on a new pseudo-terminal, and the
+// side of it the user types into
+func newTestTerminal(t *testing.T) (*Terminal, io.Writer) {
+	t.Helper()
+	user, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("no pseudo-terminal: %v", err)
+	}
+	t.Cleanup(func() {
+		user.Close()
+		tty.Close()
+	})
+	terminal, err := NewTerminal(tty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return terminal, user
+}
+
+func TestSessionOnTerminal(t *testing.T) {
+	terminal, user := newTestTerminal(t)
+	session, err := NewSession(terminal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	// Commands see a terminal, and state persists as without one
+	var out syncBuffer
+	for _, command := range []string{"cd /", "test -t 0 && test -t 1 && echo tty; pwd"} {
+		out.Reset()
+		if status, err := session.Run(context.Background(), command, Limits{}, &out, &out); status != 0 || err != nil {
+			t.Fatalf("%s: status %d, %v", command, status, err)
+		}
+	}
+	if got := strings.ReplaceAll(out.String(), "\r\n", "\n"); got != "tty\n/\n" {
+		t.Errorf("output %q", got)
+	}
+
+	// Keystrokes reach the command while it runs
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(user, "hello\r")
+	}()
+	out.Reset()
+	if _, err := session.Run(context.Background(), "stty -echo; read line; echo got $line", Limits{}, &out, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "got hello") {
+		t.Errorf("output %q", out.String())
+	}
+
+	// and the prompt gets what is typed after it finishes
+	io.WriteString(user, "next line\n")
+	line, err := bufio.NewReader(terminal).ReadString('\n')
+	if err != nil || line != "next line\n" {
+		t.Errorf("prompt read %q, %v", line, err)
+	}
+}
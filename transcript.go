@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// maxTurnOutput bounds how much of a command's output a turn keeps
+const maxTurnOutput = 2 * 1024
+
+// Turn is one line of input handled by a processor. Builtins such as `mode`
+// or `help` are not recorded.
+type Turn struct {
+	Input    string // What the user typed
+	Mode     string // Mode that handled the input
+	Reply    string // Explanation given by the AI or knowledge base, if any
+	Command  string // Command that ran, empty if nothing ran
+	ExitCode int    // Exit status of the command
+	Output   string // End of the command's output, at most maxTurnOutput bytes
+}
+
+// Transcript records the turns of a session, oldest first
+type Transcript struct {
+	turns []Turn
+}
+
+// Record adds a turn for input handled in mode. result may be nil if the
+// processor failed before producing one.
+func (t *Transcript) Record(input, mode string, result *Result) {
+	turn := Turn{Input: input, Mode: mode}
+	if result != nil {
+		turn.Reply = result.Reply
+		turn.Command = result.Command
+		turn.ExitCode = result.ExitCode
+		// Terminals end lines with \r\n, which only costs tokens
+		turn.Output = truncateTail(strings.ReplaceAll(result.Output, "\r\n", "\n"), maxTurnOutput)
+	}
+	t.turns = append(t.turns, turn)
+}
+
+// Turns returns the recorded turns. The slice must not be modified.
+func (t *Transcript) Turns() []Turn {
+	return t.turns[:len(t.turns):len(t.turns)]
+}
+
+// historyMessages turns earlier turns into conversation messages, so the
+// model can follow up on what it suggested and what came of it
+func historyMessages(turns []Turn) []ChatMessage {
+	var messages []ChatMessage
+	for i, turn := range turns {
+		messages = append(messages, turnMessages(i+1, turn)...)
+	}
+	return messages
+}
+
+// turnMessages returns the messages for turn n of the transcript. Commands
+// the AI ran are replayed as calls of runCommandTool answered with their
+// outcome, so requests that include history must offer that tool. Commands
+// the user typed in direct mode are told to the model in a user message.
+func turnMessages(n int, turn Turn) []ChatMessage {
+	if turn.Mode == "direct" {
+		if turn.Command == "" {
+			return nil
+		}
+		return []ChatMessage{{
+			Role: RoleUser,
+			Content: fmt.Sprintf("I ran this command myself:\n$ %s\nExit status: %d\nOutput:\n%s",
+				turn.Command, turn.ExitCode, turn.Output),
+		}}
+	}
+
+	messages := []ChatMessage{{Role: RoleUser, Content: turn.Input}}
+
+	if turn.Command == "" {
+		reply := turn.Reply
+		if reply == "" {
+			reply = "(No command was run.)"
+		}
+		return append(messages, ChatMessage{Role: RoleAssistant, Content: reply})
+	}
+
+	arguments, _ := json.Marshal(AIResponse{
+		Reply: turn.Reply,
+		Cmd:   []string{},
+		Shell: turn.Command,
+	})
+	call := ToolCall{
+		ID:        fmt.Sprintf("history_%d", n),
+		Name:      runCommandTool.Name,
+		Arguments: string(arguments),
+	}
+	outcome, _ := json.Marshal(map[string]interface{}{
+		"exit_code": turn.ExitCode,
+		"output":    turn.Output,
+	})
+	return append(messages,
+		ChatMessage{Role: RoleAssistant, Content: turn.Reply, ToolCalls: []ToolCall{call}},
+		ChatMessage{Role: RoleTool, Content: string(outcome), ToolCallID: call.ID},
+	)
+}
+
+// describeTurn formats a turn for the `history` builtin
+func describeTurn(turn Turn) string {
+	switch turn.Command {
+	case "":
+		return fmt.Sprintf("[%s] %s (nothing run)", turn.Mode, turn.Input)
+	case turn.Input:
+		return fmt.Sprintf("[%s] %s (exit %d)", turn.Mode, turn.Input, turn.ExitCode)
+	}
+	command := strings.ReplaceAll(turn.Command, "\n", "; ")
+	return fmt.Sprintf("[%s] %s -> %s (exit %d)", turn.Mode, turn.Input, command, turn.ExitCode)
+}
+
+// truncateTail keeps the end of s within max bytes, where errors usually are
+func truncateTail(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return "[... output truncated ...]\n" + s[len(s)-max:]
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTranscriptRecord(t *testing.T) {
+	var transcript Transcript
+	transcript.Record("list files", "ai", &Result{Command: "ls", Reply: "Lists files", ExitCode: 0, Output: "a\r\nb\r\n"})
+	transcript.Record("oops", "ai", nil)
+	transcript.Record("yes", "direct", &Result{Command: "yes", ExitCode: 130, Output: strings.Repeat("y\n", maxTurnOutput)})
+
+	turns := transcript.Turns()
+	if len(turns) != 3 {
+		t.Fatalf("%d turns", len(turns))
+	}
+	if turns[0] != (Turn{Input: "list files", Mode: "ai", Reply: "Lists files", Command: "ls", Output: "a\nb\n"}) {
+		t.Errorf("turn 1: %+v", turns[0])
+	}
+	if turns[1] != (Turn{Input: "oops", Mode: "ai"}) {
+		t.Errorf("turn 2: %+v", turns[1])
+	}
+	if output := turns[2].Output; !strings.HasPrefix(output, "[... output truncated ...]\n") || !strings.HasSuffix(output, "y\n") {
+		t.Errorf("turn 3 output: %q", output)
+	}
+
+	// Appending to the returned turns does not change the transcript
+	_ = append(turns, Turn{})
+	transcript.Record("pwd", "direct", &Result{Command: "pwd"})
+	if transcript.Turns()[3].Input != "pwd" {
+		t.Errorf("turn 4: %+v", transcript.Turns()[3])
+	}
+}
+
+func TestTurnMessages(t *testing.T) {
+	tests := []struct {
+		turn Turn
+		want []ChatMessage
+	}{
+		{Turn{Input: "cd /tmp", Mode: "direct"}, nil},
+		{
+			Turn{Input: "ls", Mode: "direct", Command: "ls", ExitCode: 2, Output: "ls: cannot access"},
+			[]ChatMessage{{Role: RoleUser, Content: "I ran this command myself:\n$ ls\nExit status: 2\nOutput:\nls: cannot access"}},
+		},
+		{
+			Turn{Input: "hello", Mode: "ai", Reply: "Hi!"},
+			[]ChatMessage{{Role: RoleUser, Content: "hello"}, {Role: RoleAssistant, Content: "Hi!"}},
+		},
+		{
+			Turn{Input: "oops", Mode: "ai"},
+			[]ChatMessage{{Role: RoleUser, Content: "oops"}, {Role: RoleAssistant, Content: "(No command was run.)"}},
+		},
+		{
+			Turn{Input: "list files", Mode: "agent", Reply: "Lists files", Command: "ls -la", ExitCode: 0, Output: "total 0\n"},
+			[]ChatMessage{
+				{Role: RoleUser, Content: "list files"},
+				{Role: RoleAssistant, Content: "Lists files", ToolCalls: []ToolCall{{
+					ID: "history_3", Name: runCommandTool.Name,
+					Arguments: `{"reply":"Lists files","cmd":[],"shell":"ls -la","risk_score":0,"does_read":false,"does_write":false}`,
+				}}},
+				{Role: RoleTool, Content: `{"exit_code":0,"output":"total 0\n"}`, ToolCallID: "history_3"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got := turnMessages(3, tt.turn)
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(tt.want)
+		if string(gotJSON) != string(wantJSON) {
+			t.Errorf("turnMessages(%+v):\n got %s\nwant %s", tt.turn, gotJSON, wantJSON)
+		}
+	}
+
+	// Every turn gets its own call ID
+	messages := historyMessages([]Turn{{Input: "a", Mode: "ai", Command: "a"}, {Input: "b", Mode: "ai", Command: "b"}})
+	if len(messages) != 6 || messages[2].ToolCallID != "history_1" || messages[5].ToolCallID != "history_2" {
+		t.Errorf("historyMessages: %+v", messages)
+	}
+}
+
+func TestDescribeTurn(t *testing.T) {
+	tests := []struct {
+		turn Turn
+		want string
+	}{
+		{Turn{Input: "hello", Mode: "ai"}, "[ai] hello (nothing run)"},
+		{Turn{Input: "ls", Mode: "direct", Command: "ls", ExitCode: 1}, "[direct] ls (exit 1)"},
+		{Turn{Input: "list files", Mode: "ai", Command: "ls"}, "[ai] list files -> ls (exit 0)"},
+		{Turn{Input: "build", Mode: "ai", Command: "make\nmake test", ExitCode: 2}, "[ai] build -> make; make test (exit 2)"},
+	}
+	for _, tt := range tests {
+		if got := describeTurn(tt.turn); got != tt.want {
+			t.Errorf("describeTurn(%+v) = %q, want %q", tt.turn, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateTail(t *testing.T) {
+	tests := []struct {
+		s    string
+		max  int
+		want string
+	}{
+		{"", 5, ""},
+		{"hello", 5, "hello"},
+		{"hello world", 5, "[... output truncated ...]\nworld"},
+	}
+	for _, tt := range tests {
+		if got := truncateTail(tt.s, tt.max); got != tt.want {
+			t.Errorf("truncateTail(%q, %d) = %q, want %q", tt.s, tt.max, got, tt.want)
+		}
+	}
+}